@@ -4,21 +4,33 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	// /debug/vars and /debug/pprof
 	_ "expvar"
 	_ "net/http/pprof"
 
+	"github.com/dstroot/simple-go-webserver/pkg/admin"
+	"github.com/dstroot/simple-go-webserver/pkg/handlers"
+	"github.com/dstroot/simple-go-webserver/pkg/health"
 	"github.com/dstroot/simple-go-webserver/pkg/info"
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/dstroot/simple-go-webserver/pkg/maintenance"
 	"github.com/dstroot/simple-go-webserver/pkg/metrics"
+	"github.com/dstroot/simple-go-webserver/pkg/requestid"
 	"github.com/dstroot/simple-go-webserver/pkg/router"
 	"github.com/dstroot/simple-go-webserver/pkg/tracing"
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	stats "github.com/uber/jaeger-lib/metrics"
-	"github.com/uber/jaeger-lib/metrics/go-kit"
-	"github.com/uber/jaeger-lib/metrics/go-kit/expvar"
 	// "github.com/unrolled/secure"
 	"github.com/urfave/negroni"
 )
@@ -28,23 +40,126 @@ var (
 )
 
 func main() {
+	// structured logging for everything, LOG_FORMAT=json for machines and
+	// LOG_LEVEL for the levels, e.g. LOG_LEVEL=info,tracing=debug
+	logOpts, err := logging.FromEnv(logging.Options{})
+	if err == nil {
+		err = logging.Init(logOpts)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.Named("main")
+
+	// SIGUSR2 toggles debug logs, which revert after LOG_DEBUG_EXPIRY (0
+	// keeps them), the admin endpoint changes any level
+	debugExpiry := 15 * time.Minute
+	if v := os.Getenv("LOG_DEBUG_EXPIRY"); v != "" {
+		debugExpiry, err = time.ParseDuration(v)
+		if err != nil {
+			logging.Fatal(logger, "cannot parse LOG_DEBUG_EXPIRY", "err", err)
+		}
+	}
+
 	// Let's put the expvar and pprof http server on a separate port on
 	// localhost, separate from the application http server. Both register
 	// handlers on the default mux automatically:
 	//  - http://localhost:6060/debug/vars
 	//  - http://localhost:6060/debug/pprof
 	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
+		logger.Error("debug server stopped", "err", http.ListenAndServe("localhost:6060", nil))
 	}()
 
 	// initialize program info
-	err := info.Init()
+	err = info.Init()
+	if err != nil {
+		logging.Fatal(logger, "info could not be initialized", "err", err)
+	}
+
+	// maintenance mode takes this instance out of rotation without
+	// stopping it. Public routes serve the maintenance page meanwhile,
+	// unless MAINTENANCE_PAGE=false keeps them serving.
+	mode := maintenance.New()
+	maintOpts := maintenance.Options{}
+	if os.Getenv("MAINTENANCE_PAGE") != "false" {
+		maintOpts.Render = handlers.Render
+	}
+
+	// liveness and readiness checks behind all our health endpoints
+	checker := health.NewChecker(health.Options{
+		ServiceID: info.Report.Program,
+		Version:   info.Report.Version,
+		ReleaseID: info.Report.Commit,
+	})
+
+	// per-route SLOs, e.g. SLO_CONFIG=slo.json
+	var slos []metrics.SLO
+	if path := os.Getenv("SLO_CONFIG"); path != "" {
+		slos, err = metrics.LoadSLOs(path)
+		if err != nil {
+			logging.Fatal(logger, "cannot load SLOs", "err", err)
+		}
+	}
+
+	// optionally report to a StatsD agent as well, e.g.
+	// STATSD_ADDR=localhost:8125 or DOGSTATSD_ADDR=localhost:8125
+	var sd *metrics.StatsD
+	if addr, dog := statsdAddr(); addr != "" {
+		sd, err = metrics.NewStatsD(metrics.StatsDOptions{
+			Addr:      addr,
+			Prefix:    strings.ToLower(info.Report.Program) + ".",
+			Tags:      []string{"host:" + info.Report.HostName},
+			DogStatsD: dog,
+		})
+		if err != nil {
+			logging.Fatal(logger, "cannot create StatsD client", "err", err)
+		}
+	}
+
+	// Prometheus metrics middleware, /metrics serves the same registry
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(metrics.Options{
+		Registerer: reg,
+		Host:       info.Report.HostName,
+		Service:    info.Report.Program,
+		Runtime:    true,
+		TraceID:    tracing.TraceID, // trace exemplars on latency
+		SLOs:       slos,
+		StatsD:     sd,
+	})
+	if err != nil {
+		logging.Fatal(logger, "cannot create metrics", "err", err)
+	}
+
+	// the sampler, reporter and agent are configured with the standard
+	// JAEGER_* environment variables, JAEGER_DISABLED=true turns tracing off.
+	// OTEL_TRACES_EXPORTER=otlp exports to an OpenTelemetry collector instead
+	// (see OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_PROTOCOL), and
+	// OTEL_TRACES_EXPORTER=memory keeps traces in process for /debug/traces.
+	// OTEL_PROPAGATORS picks the trace headers, W3C and Jaeger by default.
+	// TRACING_TAIL_SAMPLING=true keeps failed and slow traces as they end.
+	tracingOpts, err := tracing.FromEnv(tracing.Options{
+		Tags: map[string]string{"version": info.Report.Version},
+	})
 	if err != nil {
-		log.Fatalf("info could not be initialized")
+		logging.Fatal(logger, "cannot configure tracing", "err", err)
+	}
+	var traces http.Handler
+	if tracingOpts.Backend == tracing.BackendMemory {
+		tracingOpts.Recorder = tracing.NewRecorder()
+		traces = tracingOpts.Recorder.Handler(handlers.Render)
 	}
 
 	// create an HTTP router (a mux)
-	r := router.New()
+	r := router.New(router.Options{
+		Health:      checker,
+		Maintenance: mode,
+		AdminToken:  admin.Token(),
+		Gatherer:    m.Gatherer(),
+		SLO:         m.SLOHandler(handlers.Render),
+		Stats:       m.StatsHandler(handlers.Render),
+		Traces:      traces,
+	})
 
 	// // initialize security
 	// secureMiddleware := secure.New(secure.Options{
@@ -54,38 +169,166 @@ func main() {
 	// 	// ContentSecurityPolicy: "default-src 'self'", // ContentSecurityPolicy allows the Content-Security-Policy header value to be set with a custom value. Default is "". Passing a template string will replace `$NONCE` with a dynamic nonce value of 16 bytes for each request which can be later retrieved using the Nonce function.
 	// })
 
+	// request IDs, kept from our proxies, e.g. TRUSTED_PROXIES=10.0.0.0/8
+	var proxies []string
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		proxies = strings.Split(v, ",")
+	}
+	rid, err := requestid.New(requestid.Options{
+		TrustedProxies: proxies,
+		TraceID:        tracing.TraceID,
+	})
+	if err != nil {
+		logging.Fatal(logger, "cannot create request ID middleware", "err", err)
+	}
+
+	// the access log, e.g. ACCESS_LOG_FORMAT=combined and
+	// ACCESS_LOG_FILE=access.log rotated by ACCESS_LOG_MAX_SIZE and
+	// ACCESS_LOG_MAX_AGE, probes and scrapes aren't logged by default
+	accessOpts, err := logging.AccessFromEnv(logging.AccessOptions{
+		Exclude: []string{"/healthz", "/livez", "/readyz", "/metrics"},
+	})
+	if err != nil {
+		logging.Fatal(logger, "cannot configure the access log", "err", err)
+	}
+	access, err := logging.NewMiddleware(accessOpts)
+	if err != nil {
+		logging.Fatal(logger, "cannot create the access log", "err", err)
+	}
+
 	// negroni middleware stack
 	n := negroni.New()
-	n.Use(negroni.NewRecovery())
-	n.Use(metrics.NewMetrics(info.Report.HostName, info.Report.Program))
-	n.Use(negroni.NewLogger())
+	n.Use(rid) // first, so even the panic page shows the IDs
+	recovery := negroni.NewRecovery()
+	recovery.Logger = log.New(ioutil.Discard, "", 0) // we log panics with the IDs
+	recovery.Formatter = handlers.PanicPage{}
+	recovery.PanicHandlerFunc = func(info *negroni.PanicInformation) {
+		tracing.LogPanic(info) // panics go on the span too
+		handlers.LogPanic(info)
+	}
+	n.Use(recovery)
+	n.Use(tracing.NewMiddleware()) // names spans by route pattern, tags them
+	n.Use(m)
+	n.Use(access)                      // after the request ID, so the lines have it
+	n.Use(logging.NewDumpMiddleware()) // redacted dumps with LOG_LEVEL=dump=debug
+	n.Use(maintenance.NewMiddleware(mode, maintOpts))
 	// n.Use(negroni.HandlerFunc(secureMiddleware.HandlerFuncWithNext))
 	n.UseHandler(r) // pass mux to negroni
 
-	// create a tracer
-	metricsFactory = xkit.Wrap("", expvar.NewFactory(10)) // 10 buckets for histograms
+	// create a tracer, its metrics go to the same registry (and to
+	// expvar as well with TRACING_EXPVAR=true)
+	metricsFactory = tracing.NewMetricsFactory(tracing.MetricsOptions{
+		Registerer: reg,
+		Expvar:     os.Getenv("TRACING_EXPVAR") == "true",
+	})
 	tracer, closer, err := tracing.Init(
 		info.Report.Program,
-		metricsFactory.Namespace(info.Report.Program, nil),
+		metricsFactory.Namespace(strings.ToLower(info.Report.Program), nil),
+		tracingOpts,
 	)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "cannot create tracer", "err", err)
 	}
 	defer closer.Close()
 
-	// instrument the router for tracing
+	// handlers starting spans of their own and the outbound clients of
+	// pkg/httpclient use the global tracer
+	opentracing.SetGlobalTracer(tracer)
+
+	// instrument the router for tracing, the span is named "HTTP GET"
+	// until the tracing middleware knows the route
 	mw := nethttp.Middleware(
 		tracer,
 		n, // pass in negroni
-		nethttp.OperationNameFunc(func(r *http.Request) string {
-			return "HTTP " + r.Method + " " + r.URL.Path
-		}),
 	)
 
 	// run our server
 	s := NewServer(info.Report.Port, mw) // pass port and mux
+
+	// the server's own errors are counted by category and rate limited,
+	// LOG_HTTP_STACKS=true logs where superfluous WriteHeader calls come from
+	errorLog, err := logging.NewErrorLog(logging.ErrorLogOptions{
+		Registerer: reg,
+		Stacks:     os.Getenv("LOG_HTTP_STACKS") == "true",
+	})
+	if err != nil {
+		logging.Fatal(logger, "cannot create the server error log", "err", err)
+	}
+	s.SetErrorLog(errorLog)
+
+	s.OnSignal(syscall.SIGUSR1, func() {
+		on := mode.Toggle("maintenance toggled by SIGUSR1")
+		logger.Info("maintenance toggled by SIGUSR1", "host", info.Report.HostName, "on", on)
+	})
+	s.OnSignal(syscall.SIGUSR2, func() {
+		debug := logging.ToggleDebug(debugExpiry)
+		logger.Info("debug logs toggled by SIGUSR2", "host", info.Report.HostName, "on", debug, "expiry", debugExpiry)
+	})
+	s.OnSignal(syscall.SIGHUP, func() {
+		// logrotate moved the access log away
+		if err := access.Reopen(); err != nil {
+			logger.Error("cannot reopen the access log", "err", err)
+		}
+	})
+	s.OnShutdown(func() { access.Close() })
+
+	// optionally serve the grpc.health.v1 service for load balancers
+	// and service meshes that speak gRPC health checking
+	if port := os.Getenv("GRPC_HEALTH_PORT"); port != "" {
+		lis, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			logging.Fatal(logger, "cannot listen for gRPC health", "err", err)
+		}
+		g := health.NewGRPCServer(checker)
+		go func() {
+			logger.Info("gRPC health available", "host", info.Report.HostName, "port", port)
+			if err := g.Serve(lis); err != nil {
+				logger.Error("gRPC health stopped", "err", err)
+			}
+		}()
+		s.OnShutdown(g.GracefulStop)
+	}
+
+	if sd != nil {
+		s.OnShutdown(func() { sd.Close() })
+	}
+
+	// optionally push to a Pushgateway on shutdown (so the last counter
+	// increments are not lost) and every PUSH_INTERVAL for batch runs
+	if url := os.Getenv("PUSHGATEWAY_URL"); url != "" {
+		var interval time.Duration
+		if v := os.Getenv("PUSH_INTERVAL"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil {
+				logging.Fatal(logger, "cannot parse PUSH_INTERVAL", "err", err)
+			}
+		}
+		p, err := metrics.NewPusher(m.Gatherer(), metrics.PushOptions{
+			URL:      url,
+			Interval: interval,
+		})
+		if err != nil {
+			logging.Fatal(logger, "cannot push metrics", "err", err)
+		}
+		p.Start()
+		s.OnShutdown(func() {
+			if err := p.Stop(); err != nil {
+				logger.Error("cannot push metrics", "err", err)
+			}
+		})
+	}
+
 	err = s.Run()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "server failed", "err", err)
+	}
+}
+
+// statsdAddr returns the StatsD agent address from the environment and
+// whether it speaks DogStatsD
+func statsdAddr() (string, bool) {
+	if addr := os.Getenv("DOGSTATSD_ADDR"); addr != "" {
+		return addr, true
 	}
+	return os.Getenv("STATSD_ADDR"), false
 }
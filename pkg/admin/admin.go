@@ -0,0 +1,57 @@
+/*
+Package admin implements a library to protect our administrative HTTP
+endpoints. Admin endpoints change the state of a running instance (for
+example switching it into maintenance mode) so they must never be
+reachable without credentials.
+
+Callers authenticate with a bearer token:
+
+	curl -H "Authorization: Bearer $ADMIN_TOKEN" -X POST localhost:8000/admin/maintenance
+*/
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	tokenEnv     = "ADMIN_TOKEN"
+	bearerPrefix = "Bearer "
+)
+
+// Token returns the admin token from the environment. An empty token
+// disables all admin endpoints.
+func Token() string {
+	return os.Getenv(tokenEnv)
+}
+
+// Authorize wraps an admin handler and only lets requests through that
+// carry the expected bearer token. If no token is configured every request
+// is refused, so admin endpoints fail closed.
+func Authorize(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, bearerPrefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// constant time compare so the token can't be guessed by timing
+		given := strings.TrimPrefix(auth, bearerPrefix)
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// test data
+	var tests = []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", "/admin/maintenance", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		Authorize(tt.token, ok).ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("token %q header %q: got %v want %v",
+				tt.token, tt.header, status, tt.status)
+		}
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/dstroot/simple-go-webserver/pkg/requestid"
 	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
 	"github.com/julienschmidt/httprouter"
+	"github.com/urfave/negroni"
 )
 
 // Render is exported so we can change the options in our test files
@@ -19,26 +22,14 @@ var Render = tmpl.New(
 	},
 )
 
+var logger = logging.Named("handlers")
+
 // Index handler handles GET /
 func Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
-	// // If you want to debug your HTTP requests, then import the
-	// // net/http/httputil package, and invoke DumpRequest
-	// // with the parameter *http.Request and a boolean to specify if you
-	// // want to dump the request body as well. The function returns a
-	// // []byte, error. You could use it like this:
-	// dump := func(r *http.Request) {
-	// 	output, err := httputil.DumpRequest(r, true)
-	// 	if err != nil {
-	// 		log.Println("Error dumping request:", err)
-	// 		return
-	// 	}
-	// 	fmt.Println(string(output))
-	// }
-	//
-	// // The function call will dump your request method, URI with
-	// // query parameters, headers and request body if you have one.
-	// dump(r)
+	// To debug your HTTP requests, turn on the dumps of
+	// logging.DumpMiddleware (e.g. LOG_LEVEL=info,dump=debug): the
+	// request method, URI, headers and body, with their secrets redacted.
 
 	// page data to render page
 	data := map[string]interface{}{
@@ -48,9 +39,9 @@ func Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	// render page template
-	err := Render.Template(w, "index.html", data)
+	err := Render.TemplateContext(r.Context(), w, "index.html", data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ServerError(w, r, err)
 		return
 	}
 }
@@ -66,9 +57,9 @@ func Page(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	// render page template
-	err := Render.Template(w, "page.html", data)
+	err := Render.TemplateContext(r.Context(), w, "page.html", data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ServerError(w, r, err)
 		return
 	}
 }
@@ -81,17 +72,66 @@ func Hello(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 // NotFound handles 404 pages
 func NotFound(w http.ResponseWriter, r *http.Request) {
 
-	// page data to render page
+	// page data to render page, with the IDs to quote
 	data := map[string]interface{}{
-		"title": "404",
+		"title":     "404",
+		"RequestID": requestid.RequestID(r.Context()),
+		"TraceID":   requestid.TraceID(r.Context()),
 	}
 
 	// render page template
 	w.WriteHeader(404)
-	err := Render.Template(w, "404.html", data)
+	err := Render.TemplateContext(r.Context(), w, "404.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 }
+
+// ServerError logs err, with the request and trace IDs the request
+// context carries, and responds with our 500 page, showing them so a user
+// reporting it can quote them
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.ErrorContext(r.Context(), "server error", "method", r.Method, "path", r.URL.Path, "err", err)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	errorPage(w, r)
+}
+
+// errorPage renders the 500 page, or the IDs as plain text if even that
+// fails. The status code has been written.
+func errorPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"title":     "500",
+		"RequestID": requestid.RequestID(r.Context()),
+		"TraceID":   requestid.TraceID(r.Context()),
+	}
+
+	err := Render.TemplateContext(r.Context(), w, "500.html", data)
+	if err != nil {
+		fmt.Fprintf(w, "%s\nRequest ID: %s\nTrace ID: %s\n", http.StatusText(http.StatusInternalServerError),
+			data["RequestID"], data["TraceID"])
+	}
+}
+
+// LogPanic logs a panic recovered by negroni's Recovery with the request
+// and trace IDs the request context carries, the request, redacted, and
+// its stack. Use it as (or in) the Recovery's PanicHandlerFunc.
+func LogPanic(info *negroni.PanicInformation) {
+	r := info.Request
+	redact := logging.DefaultRedactor()
+	logger.ErrorContext(r.Context(), "panic", "method", r.Method, "path", r.URL.Path,
+		"uri", redact.URL(r.URL.RequestURI()), "headers", redact.Header(r.Header),
+		"panic", fmt.Sprint(info.RecoveredPanic), "stack", string(info.Stack))
+}
+
+// PanicPage renders panics recovered by negroni's Recovery as our 500
+// page. Use it as the Recovery's Formatter.
+type PanicPage struct{}
+
+// FormatPanicError implements negroni.PanicFormatter
+func (PanicPage) FormatPanicError(w http.ResponseWriter, r *http.Request, infos *negroni.PanicInformation) {
+	errorPage(w, r)
+}
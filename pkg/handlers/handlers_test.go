@@ -1,13 +1,23 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/dstroot/simple-go-webserver/pkg/requestid"
 	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
 	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
 )
 
 func TestIndex(t *testing.T) {
@@ -147,6 +157,81 @@ func TestNotFound(t *testing.T) {
 	}
 }
 
+func TestErrorPages(t *testing.T) {
+	// set template relative path
+	Render = tmpl.New(
+		tmpl.Options{
+			TemplateDirectory: "../../templates",
+		},
+	)
+	var logs bytes.Buffer
+	logging.Init(logging.Options{Output: &logs})
+	defer logging.Init(logging.Options{Output: os.Stderr})
+
+	rid, err := requestid.New(requestid.Options{
+		TraceID: func(ctx context.Context) (string, bool) { return "4bf92f3577b34da6a3ce929d0e0e4736", true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery := negroni.NewRecovery()
+	recovery.Logger = log.New(ioutil.Discard, "", 0)
+	recovery.Formatter = PanicPage{}
+	recovery.PanicHandlerFunc = LogPanic
+
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(NotFound)
+	router.GET("/error", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ServerError(w, r, errors.New("failed"))
+	})
+	router.GET("/panic", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		panic("boom")
+	})
+	n := negroni.New(rid, recovery)
+	n.UseHandler(router)
+
+	// test data
+	var tests = []struct {
+		path   string
+		status int
+		title  string
+		log    string
+	}{
+		{"/404", http.StatusNotFound, "Bootstrap &middot; 404", ""},
+		{"/error", http.StatusInternalServerError, "Bootstrap &middot; 500", "msg=\"server error\""},
+		{"/panic", http.StatusInternalServerError, "Bootstrap &middot; 500", "msg=panic"},
+	}
+
+	for _, tt := range tests {
+		logs.Reset()
+		req, _ := http.NewRequest("GET", tt.path+"?token=s3cret", nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		n.ServeHTTP(rr, req)
+
+		// but never the secrets of the request
+		assert.NotContains(t, logs.String(), "s3cret", tt.path)
+
+		// the error is logged with the IDs
+		if tt.log != "" {
+			assert.Contains(t, logs.String(), tt.log, tt.path)
+			assert.Contains(t, logs.String(), "request_id="+rr.Header().Get(requestid.RequestIDHeader), tt.path)
+			assert.Contains(t, logs.String(), "trace_id=4bf92f3577b34da6a3ce929d0e0e4736", tt.path)
+		}
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s returned wrong status code: got %v want %v",
+				tt.path, status, tt.status)
+		}
+
+		// the page shows the IDs sent in the headers
+		body := rr.Body.String()
+		assert.Contains(t, body, tt.title, tt.path)
+		assert.Contains(t, body, rr.Header().Get(requestid.RequestIDHeader), tt.path)
+		assert.Contains(t, body, "4bf92f3577b34da6a3ce929d0e0e4736", tt.path)
+	}
+}
+
 // func TestIndexHandler(t *testing.T) {
 // 	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
 // 	// pass 'nil' as the third parameter.
@@ -0,0 +1,300 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of checks we run. They double as the endpoint names.
+const (
+	Liveness  = "livez"
+	Readiness = "readyz"
+)
+
+const (
+	healthJSON = "application/health+json"
+
+	statusPass = "pass"
+	statusFail = "fail"
+)
+
+// ErrUnknownCheck is returned when a check name has not been registered
+var ErrUnknownCheck = errors.New("unknown check")
+
+// Options describes the Checker options. They are reported in the
+// health+json format.
+type Options struct {
+	ServiceID string
+	Version   string
+	ReleaseID string
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Name     string
+	Err      error
+	Time     time.Time
+	Duration time.Duration
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Checker holds the liveness and readiness checks. The Kubernetes style
+// endpoints, the health+json format, the legacy '/healthz' handler and
+// the gRPC health service are all fed by the same Checker. A failing
+// liveness check also fails readiness.
+type Checker struct {
+	mu     sync.RWMutex
+	opts   Options
+	checks map[string][]check
+}
+
+// NewChecker returns a Checker with a single "ping" liveness check that
+// always passes.
+func NewChecker(opts ...Options) *Checker {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+
+	c := &Checker{
+		opts:   opt,
+		checks: make(map[string][]check),
+	}
+	c.AddLivenessCheck("ping", func() error { return nil })
+	return c
+}
+
+// AddLivenessCheck registers a check that must pass for us to be alive
+func (c *Checker) AddLivenessCheck(name string, fn func() error) {
+	c.add(Liveness, name, fn)
+}
+
+// AddReadinessCheck registers a check that must pass for us to serve traffic
+func (c *Checker) AddReadinessCheck(name string, fn func() error) {
+	c.add(Readiness, name, fn)
+}
+
+func (c *Checker) add(kind, name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[kind] = append(c.checks[kind], check{name: name, fn: fn})
+}
+
+// list returns the checks for kind in the order they were registered
+func (c *Checker) list(kind string) []check {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var list []check
+	list = append(list, c.checks[Liveness]...)
+	if kind == Readiness {
+		list = append(list, c.checks[Readiness]...)
+	}
+	return list
+}
+
+// Run runs the checks for kind, skipping any excluded names, and reports
+// whether all of them passed.
+func (c *Checker) Run(kind string, exclude ...string) ([]Result, bool) {
+	skip := make(map[string]bool)
+	for _, name := range exclude {
+		skip[name] = true
+	}
+
+	ok := true
+	var results []Result
+	for _, ch := range c.list(kind) {
+		if skip[ch.name] {
+			continue
+		}
+		res := run(ch)
+		if res.Err != nil {
+			ok = false
+		}
+		results = append(results, res)
+	}
+	return results, ok
+}
+
+// RunCheck runs the single named check of kind
+func (c *Checker) RunCheck(kind, name string) (Result, error) {
+	for _, ch := range c.list(kind) {
+		if ch.name == name {
+			return run(ch), nil
+		}
+	}
+	return Result{}, errors.Wrap(ErrUnknownCheck, name)
+}
+
+func run(ch check) Result {
+	start := time.Now()
+	err := ch.fn()
+	return Result{
+		Name:     ch.name,
+		Err:      err,
+		Time:     start.UTC(),
+		Duration: time.Since(start),
+	}
+}
+
+// Handler serves the Kubernetes style '/livez' and '/readyz' endpoints.
+// It returns 200 and "ok" when every check passes. With '?verbose' it
+// lists every check, e.g. "[+]ping ok", and failures are always listed
+// with their reason and a 503. Checks can be skipped with
+// '?exclude=name'. Clients that accept application/health+json get the
+// health+json format instead.
+func (c *Checker) Handler(kind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := c.Run(kind, r.URL.Query()["exclude"]...)
+		c.write(w, r, kind, results, ok)
+	})
+}
+
+// CheckHandler serves a single check of kind named by the last path
+// element, e.g. '/readyz/maintenance'.
+func (c *Checker) CheckHandler(kind string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := c.RunCheck(kind, path.Base(r.URL.Path))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		c.write(w, r, kind, []Result{res}, res.Err == nil)
+	})
+}
+
+// Healthz serves the legacy '/healthz' JSON format fed by the liveness checks
+func (c *Checker) Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := c.Run(Liveness)
+		if !ok {
+			j, err := json.Marshal(struct {
+				Healthy bool   `json:"healthy"`
+				Reason  string `json:"reason"`
+			}{false, failures(results)})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(j)
+			return
+		}
+		Handler(w, r)
+	})
+}
+
+// write renders results in the format the client asked for
+func (c *Checker) write(w http.ResponseWriter, r *http.Request, kind string, results []Result, ok bool) {
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), healthJSON) {
+		c.writeHealthJSON(w, status, results, ok)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	_, verbose := r.URL.Query()["verbose"]
+	if ok && !verbose {
+		fmt.Fprint(w, "ok")
+		return
+	}
+
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(w, "[-]%s failed: %v\n", res.Name, res.Err)
+			continue
+		}
+		fmt.Fprintf(w, "[+]%s ok\n", res.Name)
+	}
+	if ok {
+		fmt.Fprintf(w, "%s check passed\n", kind)
+		return
+	}
+	fmt.Fprintf(w, "%s check failed\n", kind)
+}
+
+// writeHealthJSON writes the health+json format, see
+// https://tools.ietf.org/html/draft-inadarei-api-health-check
+func (c *Checker) writeHealthJSON(w http.ResponseWriter, status int, results []Result, ok bool) {
+	type checkJSON struct {
+		Status        string `json:"status"`
+		Time          string `json:"time"`
+		ObservedValue int64  `json:"observedValue"`
+		ObservedUnit  string `json:"observedUnit"`
+		Output        string `json:"output,omitempty"`
+	}
+
+	body := struct {
+		Status    string                 `json:"status"`
+		Version   string                 `json:"version,omitempty"`
+		ReleaseID string                 `json:"releaseId,omitempty"`
+		ServiceID string                 `json:"serviceId,omitempty"`
+		Checks    map[string][]checkJSON `json:"checks"`
+	}{
+		Status:    statusPass,
+		Version:   c.opts.Version,
+		ReleaseID: c.opts.ReleaseID,
+		ServiceID: c.opts.ServiceID,
+		Checks:    make(map[string][]checkJSON),
+	}
+	if !ok {
+		body.Status = statusFail
+	}
+
+	for _, res := range results {
+		cj := checkJSON{
+			Status:        statusPass,
+			Time:          res.Time.Format(time.RFC3339),
+			ObservedValue: int64(res.Duration / time.Millisecond),
+			ObservedUnit:  "ms",
+		}
+		if res.Err != nil {
+			cj.Status = statusFail
+			cj.Output = res.Err.Error()
+		}
+		body.Checks[res.Name+":responseTime"] = append(body.Checks[res.Name+":responseTime"], cj)
+	}
+
+	j, err := json.MarshalIndent(body, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", healthJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// failures joins the reasons of all failed checks
+func failures(results []Result) string {
+	var reasons []string
+	for _, res := range results {
+		if res.Err != nil {
+			reasons = append(reasons, res.Err.Error())
+		}
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
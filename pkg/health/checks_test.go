@@ -0,0 +1,136 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	c := NewChecker()
+	down := errors.New("maintenance: database upgrade")
+	var err error
+	c.AddReadinessCheck("maintenance", func() error { return err })
+
+	// everything passes
+	results, ok := c.Run(Readiness)
+	assert.True(t, ok)
+	assert.Len(t, results, 2)
+
+	// liveness doesn't include readiness checks
+	results, ok = c.Run(Liveness)
+	assert.True(t, ok)
+	assert.Len(t, results, 1)
+
+	// readiness fails, liveness doesn't
+	err = down
+	_, ok = c.Run(Readiness)
+	assert.False(t, ok)
+	_, ok = c.Run(Liveness)
+	assert.True(t, ok)
+
+	// unless the check is excluded
+	_, ok = c.Run(Readiness, "maintenance")
+	assert.True(t, ok)
+
+	// single checks
+	res, e := c.RunCheck(Readiness, "maintenance")
+	assert.NoError(t, e)
+	assert.Equal(t, down, res.Err)
+	_, e = c.RunCheck(Liveness, "maintenance")
+	assert.Error(t, e)
+}
+
+func TestHandlerFormats(t *testing.T) {
+	c := NewChecker(Options{Version: "1.0.0"})
+	var err error
+	c.AddReadinessCheck("maintenance", func() error { return err })
+
+	serve := func(h http.Handler, target, accept string) *httptest.ResponseRecorder {
+		req, e := http.NewRequest("GET", target, nil)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// test data
+	var tests = []struct {
+		target  string
+		failing bool
+		status  int
+		body    string
+	}{
+		{"/readyz", false, http.StatusOK, "ok"},
+		{"/readyz?verbose", false, http.StatusOK, "[+]ping ok\n[+]maintenance ok\nreadyz check passed\n"},
+		{"/readyz", true, http.StatusServiceUnavailable, "[+]ping ok\n[-]maintenance failed: maintenance: db\nreadyz check failed\n"},
+		{"/readyz?exclude=maintenance", true, http.StatusOK, "ok"},
+	}
+
+	for _, tt := range tests {
+		err = nil
+		if tt.failing {
+			err = errors.New("maintenance: db")
+		}
+		rr := serve(c.Handler(Readiness), tt.target, "")
+		assert.Equal(t, tt.status, rr.Code, tt.target)
+		assert.Equal(t, tt.body, rr.Body.String(), tt.target)
+	}
+
+	// single check
+	err = errors.New("maintenance: db")
+	rr := serve(c.CheckHandler(Readiness), "/readyz/maintenance", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	rr = serve(c.CheckHandler(Readiness), "/readyz/nonexistant", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// health+json
+	rr = serve(c.Handler(Readiness), "/readyz", "application/health+json")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "application/health+json", rr.Header().Get("Content-Type"))
+
+	var body struct {
+		Status  string
+		Version string
+		Checks  map[string][]struct {
+			Status string
+			Output string
+		}
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "fail", body.Status)
+	assert.Equal(t, "1.0.0", body.Version)
+	assert.Equal(t, "pass", body.Checks["ping:responseTime"][0].Status)
+	assert.Equal(t, "maintenance: db", body.Checks["maintenance:responseTime"][0].Output)
+}
+
+func TestHealthz(t *testing.T) {
+	c := NewChecker()
+	var err error
+	c.AddLivenessCheck("deadlock", func() error { return err })
+
+	req, e := http.NewRequest("GET", "/healthz", nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	rr := httptest.NewRecorder()
+	c.Healthz().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"healthy": true}`, rr.Body.String())
+
+	err = errors.New("deadlocked")
+	rr = httptest.NewRecorder()
+	c.Healthz().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, `{"healthy":false,"reason":"deadlocked"}`, rr.Body.String())
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how often Watch re-runs the checks to look for a status change
+	watchInterval = 1 * time.Second
+)
+
+// grpcHealth implements the grpc.health.v1.Health service on top of a
+// Checker. The service names map onto our checks:
+//
+//	""        - all readiness checks (the overall server status)
+//	"livez"   - all liveness checks
+//	"readyz"  - all readiness checks
+//	"<check>" - a single registered check, e.g. "maintenance"
+type grpcHealth struct {
+	checker  *Checker
+	interval time.Duration
+}
+
+// NewGRPCServer returns a gRPC server with the grpc.health.v1 service
+// registered and fed by c.
+func NewGRPCServer(c *Checker) *grpc.Server {
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, &grpcHealth{checker: c, interval: watchInterval})
+	return s
+}
+
+// Check returns the serving status of the requested service
+func (g *grpcHealth) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st, ok := g.status(in.Service)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch streams the serving status of the requested service whenever it
+// changes, until the client goes away.
+func (g *grpcHealth) Watch(in *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		st, ok := g.status(in.Service)
+		if !ok {
+			st = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+		if st != last {
+			err := stream.Send(&healthpb.HealthCheckResponse{Status: st})
+			if err != nil {
+				return status.Error(codes.Canceled, "stream has ended")
+			}
+			last = st
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		}
+	}
+}
+
+// status runs the checks behind service and reports whether the service
+// is known.
+func (g *grpcHealth) status(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	var passed bool
+	switch service {
+	case "", Readiness:
+		_, passed = g.checker.Run(Readiness)
+	case Liveness:
+		_, passed = g.checker.Run(Liveness)
+	default:
+		res, err := g.checker.RunCheck(Readiness, service)
+		if err != nil {
+			return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+		}
+		passed = res.Err == nil
+	}
+
+	if passed {
+		return healthpb.HealthCheckResponse_SERVING, true
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING, true
+}
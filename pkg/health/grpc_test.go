@@ -0,0 +1,120 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCHealth(t *testing.T) {
+	c := NewChecker()
+	var err error
+	c.AddReadinessCheck("maintenance", func() error { return err })
+
+	// start a server on a random local port
+	lis, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := NewGRPCServer(c)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, e := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// test data
+	var tests = []struct {
+		service string
+		failing bool
+		status  healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{"", false, healthpb.HealthCheckResponse_SERVING},
+		{"", true, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"livez", true, healthpb.HealthCheckResponse_SERVING},
+		{"readyz", true, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"maintenance", true, healthpb.HealthCheckResponse_NOT_SERVING},
+		{"maintenance", false, healthpb.HealthCheckResponse_SERVING},
+	}
+
+	for _, tt := range tests {
+		err = nil
+		if tt.failing {
+			err = errors.New("maintenance: db")
+		}
+		res, e := client.Check(ctx, &healthpb.HealthCheckRequest{Service: tt.service})
+		if e != nil {
+			t.Fatal(e)
+		}
+		assert.Equal(t, tt.status, res.Status, tt.service)
+	}
+
+	// unknown services are NotFound
+	_, e = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "nonexistant"})
+	assert.Equal(t, codes.NotFound, status.Code(e))
+}
+
+func TestGRPCWatch(t *testing.T) {
+	c := NewChecker()
+	var failing = make(chan error, 1)
+	failing <- nil
+	var err error
+	c.AddReadinessCheck("maintenance", func() error {
+		select {
+		case err = <-failing:
+		default:
+		}
+		return err
+	})
+
+	lis, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, &grpcHealth{checker: c, interval: 10 * time.Millisecond})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, e := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, e := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	res, e := stream.Recv()
+	if e != nil {
+		t.Fatal(e)
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	// a status change is streamed to the client
+	failing <- errors.New("maintenance: db")
+	res, e = stream.Recv()
+	if e != nil {
+		t.Fatal(e)
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+}
@@ -1,11 +1,22 @@
 /*
 Package health implements a library that defines health and
 readiness HTTP handlers.  These will be used by our router package
-to expose '/healthz' and '/readyz' endpoints for Kubernetes.
+to expose '/healthz', '/livez' and '/readyz' endpoints for Kubernetes.
+
+The endpoints are fed by a Checker holding named liveness and readiness
+checks, and serve the standard formats:
+
+	GET /readyz                  # "ok", or the failed checks and a 503
+	GET /readyz?verbose          # [+]ping ok ... readyz check passed
+	GET /readyz/maintenance      # a single check
+	Accept: application/health+json
+
+The same checks also back an optional grpc.health.v1 service.
 */
 package health
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"sync/atomic"
@@ -14,32 +25,56 @@ import (
 // Handler supports a liveness probe. It is a simple handler which
 // always returns response code 200 and {"alive": true}
 func Handler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	io.WriteString(w, `{"healthy": true}`)
 }
 
 // Ready supports a readiness probe.  For the readiness probe we might
 // need to wait for some event (e.g. the database is ready) to be able
-// to serve traffic. We return 200 only if the variable "isReady" is true.
-func Ready(isReady *atomic.Value) http.HandlerFunc {
+// to serve traffic. We return 200 only if the variable "isReady" is true
+// and none of the optional checks (e.g. maintenance mode) return an error.
+// A failing check is reported as 503 with its error as the reason.
+func Ready(isReady *atomic.Value, checks ...func() error) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		if isReady == nil || !isReady.Load().(bool) {
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		for _, check := range checks {
+			if err := check(); err != nil {
+				notReady(w, err.Error())
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, `{"ready": true}`)
 	}
 }
 
+// notReady writes a 503 with the reason we are out of rotation
+func notReady(w http.ResponseWriter, reason string) {
+	j, err := json.Marshal(struct {
+		Ready  bool   `json:"ready"`
+		Reason string `json:"reason"`
+	}{false, reason})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(j)
+}
+
 // HandlerFunc returns the info HTTP Handler.
 func HandlerFunc() http.Handler {
 	return http.HandlerFunc(Handler)
 }
 
 // ReadyFunc returns the info HTTP Handler.
-func ReadyFunc(isReady *atomic.Value) http.Handler {
-	return Ready(isReady)
+func ReadyFunc(isReady *atomic.Value, checks ...func() error) http.Handler {
+	return Ready(isReady, checks...)
 }
@@ -1,6 +1,7 @@
 package health
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -41,6 +42,7 @@ func TestHandler(t *testing.T) {
 
 	// using testify
 	assert.Equal(t, `{"healthy": true}`, rr.Body.String(), "body should equal expected result")
+	assert.Equal(t, "application/json", rr.Result().Header.Get("Content-Type"), "the header is sent")
 }
 
 func TestReady(t *testing.T) {
@@ -89,6 +91,8 @@ func TestReady(t *testing.T) {
 			status, http.StatusOK)
 	}
 
+	assert.Equal(t, "application/json", rr.Result().Header.Get("Content-Type"), "the header is sent")
+
 	// Check the response body is what we expect.
 	expected := `{"ready": true}`
 	if rr.Body.String() != expected {
@@ -96,3 +100,31 @@ func TestReady(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestReadyChecks(t *testing.T) {
+
+	isReady := &atomic.Value{}
+	isReady.Store(true)
+
+	failing := func() error { return errors.New("maintenance: database upgrade") }
+
+	// Create a request to pass to our handler.
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Ready(isReady, failing))
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+
+	// Check the reason is reported.
+	expected := `{"ready":false,"reason":"maintenance: database upgrade"}`
+	assert.Equal(t, expected, rr.Body.String(), "body should carry the reason")
+}
@@ -0,0 +1,302 @@
+/*
+Package httpclient builds instrumented HTTP clients for calling other
+services from our handlers. Outbound requests get a client span that is
+a child of the inbound request's span, with the trace context injected
+in the headers in the tracer's formats (see tracing.Options.Propagators),
+so the downstream service continues our trace. The span's URL has its
+query secrets masked by logging.DefaultRedactor. Requests are counted and
+timed per host in Prometheus.
+
+Each attempt gets its own timeout, cut short by the deadline of the
+request context if that comes first. Pass the inbound request's context
+along so we never wait on a downstream service longer than our caller
+waits on us:
+
+	c, err := httpclient.New(httpclient.Options{
+		Tracer:     tracer,
+		Registerer: reg,
+		Timeout:    2 * time.Second,
+	})
+
+	func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequest("GET", "http://inventory/items", nil)
+		res, err := c.Do(req.WithContext(r.Context()))
+		...
+	}
+
+Idempotent requests (GET, HEAD, OPTIONS, TRACE, PUT and DELETE) are
+retried on network errors and 502, 503 and 504 responses, with jittered
+exponential backoff.
+*/
+package httpclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	dflTimeout    = 10 * time.Second
+	dflMaxRetries = 2
+	dflBackoff    = 100 * time.Millisecond
+	dflMaxBackoff = 2 * time.Second
+
+	reqsName    = "http_client_requests_total"
+	reqsHelp    = "Outbound HTTP requests (each attempt), partitioned by host, method and status code."
+	latencyName = "http_client_request_duration_seconds"
+	latencyHelp = "How long outbound HTTP requests took until the response headers, partitioned by host and method."
+	retriesName = "http_client_retries_total"
+	retriesHelp = "Outbound HTTP requests retried, partitioned by host and method."
+
+	// code label of attempts that got no response
+	codeError = "error"
+)
+
+var (
+	// methods we retry, the ones RFC 7231 defines as idempotent
+	idempotent = map[string]bool{
+		"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+	}
+
+	// responses we retry
+	retryable = map[int]bool{
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	}
+)
+
+// Options describes the client options
+type Options struct {
+	Tracer     opentracing.Tracer    // = opentracing.GlobalTracer()
+	Registerer prometheus.Registerer // = prometheus.DefaultRegisterer
+	Namespace  string                // metric name prefix, e.g. "myapp"
+	Buckets    []float64             // latency buckets in seconds, = prometheus.DefBuckets
+
+	Transport http.RoundTripper // = http.DefaultTransport
+
+	Timeout    time.Duration // per attempt, = 10 seconds
+	MaxRetries int           // retries of idempotent requests, = 2, negative for none
+	Backoff    time.Duration // first retry waits up to this long, doubling after, = 100ms
+	MaxBackoff time.Duration // = 2 seconds
+}
+
+// New returns an instrumented *http.Client. Its metrics are registered
+// with opts.Registerer, or shared with an earlier client registered with
+// the same one.
+func New(opts ...Options) (*http.Client, error) {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Tracer == nil {
+		opt.Tracer = opentracing.GlobalTracer()
+	}
+	if opt.Registerer == nil {
+		opt.Registerer = prometheus.DefaultRegisterer
+	}
+	if opt.Transport == nil {
+		opt.Transport = http.DefaultTransport
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = dflTimeout
+	}
+	if opt.MaxRetries == 0 {
+		opt.MaxRetries = dflMaxRetries
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = dflBackoff
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = dflMaxBackoff
+	}
+
+	t := &transport{opts: opt}
+
+	reqs, err := register(opt.Registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: opt.Namespace,
+		Name:      reqsName,
+		Help:      reqsHelp,
+	}, []string{"host", "method", "code"}))
+	if err != nil {
+		return nil, err
+	}
+	t.reqs = reqs.(*prometheus.CounterVec)
+
+	latency, err := register(opt.Registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: opt.Namespace,
+		Name:      latencyName,
+		Help:      latencyHelp,
+		Buckets:   opt.Buckets,
+	}, []string{"host", "method"}))
+	if err != nil {
+		return nil, err
+	}
+	t.latency = latency.(*prometheus.HistogramVec)
+
+	retries, err := register(opt.Registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: opt.Namespace,
+		Name:      retriesName,
+		Help:      retriesHelp,
+	}, []string{"host", "method"}))
+	if err != nil {
+		return nil, err
+	}
+	t.retries = retries.(*prometheus.CounterVec)
+
+	return &http.Client{Transport: t}, nil
+}
+
+// register registers c, or returns the collector already registered in
+// its place
+func register(r prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := r.Register(c)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return are.ExistingCollector, nil
+	}
+	return c, errors.Wrap(err, "httpclient: cannot register metrics")
+}
+
+// transport traces, measures, times out and retries requests
+type transport struct {
+	opts    Options
+	reqs    *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	retries *prometheus.CounterVec
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retry := idempotent[req.Method] && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 0; ; attempt++ {
+		res, err := t.attempt(req, attempt)
+		if !retry || attempt >= t.opts.MaxRetries || ctx.Err() != nil {
+			return res, err
+		}
+		if err == nil && !retryable[res.StatusCode] {
+			return res, nil
+		}
+
+		// give up rather than wait past our caller's deadline
+		wait := t.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		t.retries.WithLabelValues(req.URL.Host, req.Method).Inc()
+	}
+}
+
+// attempt sends req once, as a child span of the span in its context
+func (t *transport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.opts.Timeout)
+
+	out := req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, errors.Wrap(err, "httpclient: cannot rewind request body")
+		}
+		out.Body = body
+	}
+
+	span := t.startSpan(out, attempt)
+
+	start := time.Now()
+	res, err := t.opts.Transport.RoundTrip(out)
+	t.latency.WithLabelValues(req.URL.Host, req.Method).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		t.reqs.WithLabelValues(req.URL.Host, req.Method, codeError).Inc()
+		ext.Error.Set(span, true)
+		span.LogFields(log.String("event", "error"), log.Error(err))
+		span.Finish()
+		cancel()
+		return nil, err
+	}
+
+	t.reqs.WithLabelValues(req.URL.Host, req.Method, strconv.Itoa(res.StatusCode)).Inc()
+	ext.HTTPStatusCode.Set(span, uint16(res.StatusCode))
+	if res.StatusCode >= http.StatusInternalServerError {
+		ext.Error.Set(span, true)
+	}
+
+	// the timeout covers reading the body too, so the attempt is only
+	// done once the caller closes it
+	res.Body = &body{ReadCloser: res.Body, done: func() {
+		span.Finish()
+		cancel()
+	}}
+	return res, nil
+}
+
+// startSpan starts a client span for req and injects its context
+func (t *transport) startSpan(req *http.Request, attempt int) opentracing.Span {
+	opts := []opentracing.StartSpanOption{ext.SpanKindRPCClient}
+	if parent := opentracing.SpanFromContext(req.Context()); parent != nil {
+		opts = append(opts, opentracing.ChildOf(parent.Context()))
+	}
+	span := t.opts.Tracer.StartSpan("HTTP "+req.Method, opts...)
+	ext.Component.Set(span, "net/http")
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, logging.DefaultRedactor().URL(req.URL.Redacted()))
+	ext.PeerHostname.Set(span, req.URL.Hostname())
+	if attempt > 0 {
+		span.SetTag("retry", attempt)
+	}
+
+	err := t.opts.Tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	if err != nil {
+		span.LogFields(log.String("event", "inject failed"), log.Error(err))
+	}
+	return span
+}
+
+// backoff returns how long to wait before retry attempt+1, a random
+// duration between half and all of the exponential backoff
+func (t *transport) backoff(attempt int) time.Duration {
+	d := t.opts.Backoff << uint(attempt)
+	if d > t.opts.MaxBackoff || d <= 0 {
+		d = t.opts.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// body calls done once when it is closed
+type body struct {
+	io.ReadCloser
+	done   func()
+	closed bool
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.done()
+	}
+	return err
+}
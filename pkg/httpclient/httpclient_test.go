@@ -0,0 +1,194 @@
+package httpclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// flaky returns a server failing with code the first n requests, and a
+// count of the requests it got
+func flaky(n int32, code int) (*httptest.Server, *int32) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= n {
+			w.WriteHeader(code)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("ok "), b...))
+	}))
+	return ts, &count
+}
+
+func TestRetries(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		method   string
+		body     string
+		fails    int32
+		code     int
+		requests int32
+		status   int
+	}{
+		{"GET", "", 2, http.StatusServiceUnavailable, 3, http.StatusOK},
+		{"GET", "", 5, http.StatusBadGateway, 3, http.StatusBadGateway}, // out of retries
+		{"GET", "", 1, http.StatusInternalServerError, 1, http.StatusInternalServerError},
+		{"PUT", "data", 1, http.StatusGatewayTimeout, 2, http.StatusOK}, // the body is sent again
+		{"POST", "data", 1, http.StatusServiceUnavailable, 1, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		ts, count := flaky(tt.fails, tt.code)
+		reg := prometheus.NewRegistry()
+		c, err := New(Options{
+			Registerer: reg,
+			Tracer:     mocktracer.New(),
+			Backoff:    time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(tt.method, ts.URL, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ts.Close()
+
+		name := tt.method + " " + http.StatusText(tt.code)
+		assert.Equal(t, tt.status, res.StatusCode, name)
+		assert.Equal(t, tt.requests, atomic.LoadInt32(count), name)
+		if tt.status == http.StatusOK {
+			assert.Equal(t, "ok "+tt.body, string(b), name)
+		}
+
+		host := strings.TrimPrefix(ts.URL, "http://")
+		retries := testutil.ToFloat64(c.Transport.(*transport).retries.WithLabelValues(host, tt.method))
+		assert.Equal(t, float64(tt.requests-1), retries, name)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer ts.Close()
+
+	tracer := mocktracer.New()
+	c, err := New(Options{Registerer: prometheus.NewRegistry(), Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as if in a handler, with the inbound request's span
+	parent := tracer.StartSpan("HTTP GET /hello")
+	req, err := http.NewRequest("GET", ts.URL+"/items?page=2&access_token=s3cret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Do(req.WithContext(opentracing.ContextWithSpan(context.Background(), parent)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	parent.Finish()
+
+	spans := tracer.FinishedSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	client := spans[0]
+	assert.Equal(t, "HTTP GET", client.OperationName)
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, client.ParentID)
+	assert.Equal(t, ext.SpanKindRPCClientEnum, client.Tag("span.kind"))
+	assert.Equal(t, uint16(200), client.Tag("http.status_code"))
+	assert.Equal(t, ts.URL+"/items?page=2&access_token=[REDACTED]", client.Tag("http.url"))
+
+	// the server got the client span's context
+	sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, client.SpanContext.SpanID, sc.(mocktracer.MockSpanContext).SpanID)
+}
+
+func TestTimeouts(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+
+	reg := prometheus.NewRegistry()
+	c, err := New(Options{
+		Registerer: reg,
+		Tracer:     mocktracer.New(),
+		Timeout:    20 * time.Millisecond,
+		Backoff:    time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every attempt times out
+	_, err = c.Get(ts.URL)
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	// the inbound deadline cuts the attempt short, and leaves no time to
+	// retry
+	atomic.StoreInt32(&count, 0)
+	c, err = New(Options{Registerer: reg, Tracer: mocktracer.New(), Timeout: time.Minute, Backoff: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+
+	start := time.Now()
+	_, err = c.Do(req.WithContext(ctx))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, time.Since(start).String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// both clients share the registered metrics
+	host := strings.TrimPrefix(ts.URL, "http://")
+	assert.Equal(t, float64(4), testutil.ToFloat64(c.Transport.(*transport).reqs.WithLabelValues(host, "GET", codeError)))
+}
+
+func TestBackoff(t *testing.T) {
+	tr := &transport{opts: Options{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 10; i++ {
+			d := tr.backoff(attempt)
+			assert.True(t, d >= max/2 && d <= max, "attempt %d waits %v", attempt, d)
+		}
+	}
+}
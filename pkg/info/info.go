@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
 	"github.com/dstroot/utility"
 	"github.com/pkg/errors"
 )
@@ -49,6 +50,7 @@ type Metrics struct {
 	GoVersion string
 	PID       int
 	RunTime   string
+	LogLevels string // current, they can change while we run
 }
 
 func getPort() string {
@@ -89,11 +91,14 @@ func Init() (err error) {
 	return nil
 }
 
-// Handler writes a JSON object with the current metrics
+// Handler writes a JSON object with the current metrics. They are filled
+// in on a copy of Report, which concurrent requests share.
 func Handler(w http.ResponseWriter, _ *http.Request) {
-	Report.RunTime = fmt.Sprintf("%v", utility.RoundDuration(time.Since(start), time.Second))
+	report := Report
+	report.RunTime = fmt.Sprintf("%v", utility.RoundDuration(time.Since(start), time.Second))
+	report.LogLevels = logging.Levels()
 
-	j, err := json.MarshalIndent(Report, "", "    ")
+	j, err := json.MarshalIndent(report, "", "    ")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,6 +3,7 @@ package info
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	// . "github.com/smartystreets/goconvey/convey"
 )
@@ -44,6 +45,16 @@ func TestHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
+	// Check the current log levels are there.
+	if body := rr.Body.String(); !strings.Contains(body, `"LogLevels": "info"`) {
+		t.Errorf("handler returned no log levels: got %v", body)
+	}
+
+	// on a copy, Report is shared by concurrent requests
+	if Report.LogLevels != "" || Report.RunTime != "" {
+		t.Errorf("handler changed the shared Report: %+v", Report)
+	}
+
 	// 	// Check the response body is what we expect.
 	// 	expected := `{
 	//     "HostName": "Dan-iMac-DCPSC04BH3GY",
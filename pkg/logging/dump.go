@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"github.com/urfave/negroni"
+)
+
+// DumpMiddleware dumps requests and their responses, redacted, through
+// the "dump" logger at debug level. It costs nothing until that level is
+// on, e.g. for a while with the log level admin endpoint:
+//
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" \
+//		-d '{"levels": "dump=debug", "expiry": "5m"}' localhost:8000/admin/log-level
+//
+// Bodies are only dumped when they are JSON or forms, so they can be
+// redacted.
+
+const (
+	dumpLogger  = "dump"
+	dflMaxBody  = 4 << 10
+	contentType = "Content-Type"
+)
+
+// DumpOptions describes the dump middleware options
+type DumpOptions struct {
+	MaxBody  int       // bytes of the request body dumped, = 4KB, negative for none
+	Redactor *Redactor // = DefaultRedactor()
+}
+
+// DumpMiddleware is a Negroni middleware dumping requests
+type DumpMiddleware struct {
+	opts   DumpOptions
+	logger *slog.Logger
+}
+
+// NewDumpMiddleware returns a new DumpMiddleware
+func NewDumpMiddleware(opts ...DumpOptions) *DumpMiddleware {
+	var opt DumpOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.MaxBody == 0 {
+		opt.MaxBody = dflMaxBody
+	}
+	return &DumpMiddleware{opts: opt, logger: Named(dumpLogger)}
+}
+
+func (m *DumpMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx := r.Context()
+	if !m.logger.Enabled(ctx, slog.LevelDebug) {
+		next(rw, r)
+		return
+	}
+	redact := m.opts.Redactor
+	if redact == nil {
+		redact = DefaultRedactor()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("uri", redact.URL(r.URL.RequestURI())),
+		slog.String("proto", r.Proto),
+		slog.String("host", r.Host),
+		slog.Any("headers", redact.Header(r.Header)),
+	}
+	if m.opts.MaxBody > 0 && r.Body != nil && r.Body != http.NoBody {
+		var body []byte
+		body, r.Body = peek(r.Body, m.opts.MaxBody)
+		attrs = append(attrs, dumpBody(redact, r.Header.Get(contentType), body, m.opts.MaxBody))
+	}
+	m.logger.LogAttrs(ctx, slog.LevelDebug, "request", attrs...)
+
+	next(rw, r)
+
+	res := rw.(negroni.ResponseWriter)
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.logger.LogAttrs(ctx, slog.LevelDebug, "response",
+		slog.Int("status", status),
+		slog.Int("size", res.Size()),
+		slog.Any("headers", redact.Header(res.Header())),
+	)
+}
+
+// peek reads up to max+1 bytes of body, and returns them and a body
+// reading them again first
+func peek(body io.ReadCloser, max int) ([]byte, io.ReadCloser) {
+	b, _ := ioutil.ReadAll(io.LimitReader(body, int64(max)+1))
+	return b, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}
+}
+
+// dumpBody returns the attribute of the body b, of type typ, redacted or
+// left out if it can't be
+func dumpBody(redact *Redactor, typ string, b []byte, max int) slog.Attr {
+	if len(b) > max {
+		return slog.String("body", "[over the dumped size]")
+	}
+	typ, _, _ = mime.ParseMediaType(typ)
+	switch typ {
+	case "application/json":
+		if j, err := redact.JSON(b); err == nil {
+			return slog.String("body", string(j))
+		}
+		return slog.String("body", "[invalid JSON]")
+	case "application/x-www-form-urlencoded":
+		return slog.String("body", redact.Query(string(b)))
+	}
+	if typ == "" {
+		typ = "untyped body"
+	}
+	return slog.String("body", "["+typ+" not dumped]")
+}
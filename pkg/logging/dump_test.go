@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+func TestDumpMiddleware(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	n := negroni.New(NewDumpMiddleware(DumpOptions{MaxBody: 64}))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the handler reads the whole body
+		body, _ := ioutil.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret"})
+		w.Write(body)
+	})
+
+	// test data
+	var tests = []struct {
+		typ  string
+		body string
+		want string // the body dumped
+	}{
+		{"application/json", `{"user":"bob","password":"s3cret"}`, `{"password":"[REDACTED]","user":"bob"}`},
+		{"application/x-www-form-urlencoded", "user=bob&password=s3cret", "user=bob&password=[REDACTED]"},
+		{"application/json; charset=utf-8", `{"user":`, "[invalid JSON]"},
+		{"application/json", `{"data":"` + strings.Repeat("x", 64) + `"}`, "[over the dumped size]"},
+		{"text/plain", "s3cret", "[text/plain not dumped]"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/login?token=s3cret", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.typ)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+
+		// nothing until the dump logger is at debug
+		SetLevel(dumpLogger, slog.LevelInfo)
+		n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		assert.Len(t, logged(t, &b), 0)
+		SetLevel(dumpLogger, slog.LevelDebug)
+
+		n.ServeHTTP(rr, req)
+		assert.Equal(t, tt.body, rr.Body.String(), tt.typ)
+
+		logs := b.String()
+		assert.NotContains(t, logs, "s3cret", tt.typ)
+		lines := logged(t, &b)
+		if !assert.Len(t, lines, 2, tt.typ) {
+			continue
+		}
+		assert.Equal(t, "request", lines[0]["msg"], tt.typ)
+		assert.Equal(t, "/login?token=[REDACTED]", lines[0]["uri"], tt.typ)
+		assert.Equal(t, tt.want, lines[0]["body"], tt.typ)
+		assert.Equal(t, "response", lines[1]["msg"], tt.typ)
+		assert.Equal(t, float64(200), lines[1]["status"], tt.typ)
+	}
+}
@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The http.Server logs what goes wrong outside of our handlers (TLS
+// handshakes failing, clients going away, handlers misusing the
+// ResponseWriter...) as unstructured lines to its ErrorLog. NewErrorLog
+// returns an ErrorLog sorting those lines into categories, counting them
+// and logging them through the "http" logger, each category at most Limit
+// times per Interval so a flood of failing handshakes can't drown the
+// logs:
+//
+//	errorLog, err := logging.NewErrorLog(logging.ErrorLogOptions{Registerer: reg})
+//	...
+//	server := &http.Server{ErrorLog: errorLog}
+
+const (
+	errorsName = "http_server_errors_total"
+	errorsHelp = "How many errors the HTTP server logged, partitioned by category."
+
+	dflErrorLimit    = 10
+	dflErrorInterval = time.Minute
+)
+
+// the categories of http.Server errors
+const (
+	CategoryTLSHandshake     = "tls_handshake"
+	CategoryClientReset      = "client_reset"
+	CategoryHeaderTooLarge   = "header_too_large"
+	CategorySuperfluousWrite = "superfluous_write_header"
+	CategoryHijacked         = "hijacked"
+	CategoryContentLength    = "content_length"
+	CategoryBodyNotAllowed   = "body_not_allowed"
+	CategoryAccept           = "accept"
+	CategoryPanic            = "panic"
+	CategoryHTTP2            = "http2"
+	CategoryOther            = "other"
+)
+
+// categories maps what the lines contain to their category and level, in
+// the order they're matched
+var categories = []struct {
+	contains []string
+	category string
+	level    slog.Level
+}{
+	{[]string{"TLS handshake error"}, CategoryTLSHandshake, slog.LevelInfo},
+	{[]string{"connection reset by peer", "broken pipe", "use of closed network connection"}, CategoryClientReset, slog.LevelInfo},
+	{[]string{"header too large"}, CategoryHeaderTooLarge, slog.LevelWarn},
+	{[]string{"superfluous response.WriteHeader", "multiple response.WriteHeader"}, CategorySuperfluousWrite, slog.LevelWarn},
+	{[]string{"hijacked connection", "Hijack"}, CategoryHijacked, slog.LevelWarn},
+	{[]string{"Content-Length"}, CategoryContentLength, slog.LevelWarn},
+	{[]string{"does not allow body"}, CategoryBodyNotAllowed, slog.LevelWarn},
+	{[]string{"Accept error"}, CategoryAccept, slog.LevelError},
+	{[]string{"panic serving"}, CategoryPanic, slog.LevelError},
+	{[]string{"http2:"}, CategoryHTTP2, slog.LevelWarn},
+}
+
+// ErrorLogOptions describes the http.Server error log options
+type ErrorLogOptions struct {
+	Registerer prometheus.Registerer // = prometheus.DefaultRegisterer
+	Namespace  string                // metric name prefix, e.g. "myapp"
+	Limit      int                   // lines logged per category per Interval, = 10
+	Interval   time.Duration         // = 1 minute
+	Stacks     bool                  // log the stack of superfluous WriteHeader calls
+}
+
+// NewErrorLog returns an http.Server ErrorLog classifying its lines
+func NewErrorLog(opts ...ErrorLogOptions) (*log.Logger, error) {
+	var opt ErrorLogOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Registerer == nil {
+		opt.Registerer = prometheus.DefaultRegisterer
+	}
+	if opt.Limit <= 0 {
+		opt.Limit = dflErrorLimit
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = dflErrorInterval
+	}
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: opt.Namespace,
+		Name:      errorsName,
+		Help:      errorsHelp,
+	}, []string{"category"})
+	err := opt.Registerer.Register(counter)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		counter, err = are.ExistingCollector.(*prometheus.CounterVec), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot register server error metrics")
+	}
+
+	w := &errorLog{
+		opts:    opt,
+		logger:  Named("http"),
+		counter: counter,
+		windows: map[string]*window{},
+		now:     time.Now,
+	}
+	return log.New(w, "", 0), nil
+}
+
+// Classify returns the category of an http.Server error line, and the
+// level to log it at
+func Classify(line string) (string, slog.Level) {
+	for _, c := range categories {
+		for _, s := range c.contains {
+			if strings.Contains(line, s) {
+				return c.category, c.level
+			}
+		}
+	}
+	return CategoryOther, slog.LevelError
+}
+
+// errorLog is the writer of the ErrorLog
+type errorLog struct {
+	opts    ErrorLogOptions
+	logger  *slog.Logger
+	counter *prometheus.CounterVec
+	now     func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*window // by category
+}
+
+// window counts the lines of a category in the current interval
+type window struct {
+	start      time.Time
+	logged     int
+	suppressed int // since the last line logged, reported with the next
+}
+
+func (e *errorLog) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	category, level := Classify(line)
+	e.counter.WithLabelValues(category).Inc()
+
+	suppressed, ok := e.allow(category)
+	if !ok {
+		return len(p), nil
+	}
+
+	attrs := []slog.Attr{slog.String("category", category)}
+	if suppressed > 0 {
+		attrs = append(attrs, slog.Int("suppressed", suppressed))
+	}
+	if e.opts.Stacks && category == CategorySuperfluousWrite {
+		// we're still in the handler's goroutine
+		attrs = append(attrs, slog.String("stack", string(debug.Stack())))
+	}
+	e.logger.LogAttrs(context.Background(), level, line, attrs...)
+	return len(p), nil
+}
+
+// allow tells whether to log a line of category, and how many were
+// suppressed since the last one logged
+func (e *errorLog) allow(category string) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	w := e.windows[category]
+	if w == nil {
+		w = &window{start: now}
+		e.windows[category] = w
+	}
+	if now.Sub(w.start) >= e.opts.Interval {
+		w.start, w.logged = now, 0
+	}
+	if w.logged >= e.opts.Limit {
+		w.suppressed++
+		return 0, false
+	}
+	w.logged++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return suppressed, true
+}
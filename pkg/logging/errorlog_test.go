@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	// test data, as logged by net/http
+	var tests = []struct {
+		line     string
+		category string
+		level    slog.Level
+	}{
+		{"http: TLS handshake error from 10.0.0.1:51234: EOF", CategoryTLSHandshake, slog.LevelInfo},
+		{"http: TLS handshake error from 10.0.0.1:51234: read tcp: connection reset by peer", CategoryTLSHandshake, slog.LevelInfo},
+		{"http: Accept error: accept tcp [::]:8000: accept4: too many open files; retrying in 5ms", CategoryAccept, slog.LevelError},
+		{"http: superfluous response.WriteHeader call from main.handler (main.go:12)", CategorySuperfluousWrite, slog.LevelWarn},
+		{"http: multiple response.WriteHeader calls", CategorySuperfluousWrite, slog.LevelWarn},
+		{"http: response.Write on hijacked connection from main.handler (main.go:12)", CategoryHijacked, slog.LevelWarn},
+		{"http: Hijack called after ResponseWriter.Write", CategoryHijacked, slog.LevelWarn},
+		{"http: wrote more than the declared Content-Length", CategoryContentLength, slog.LevelWarn},
+		{"http: request method or response status code does not allow body", CategoryBodyNotAllowed, slog.LevelWarn},
+		{"http: panic serving 10.0.0.1:51234: oops", CategoryPanic, slog.LevelError},
+		{"http: request header too large", CategoryHeaderTooLarge, slog.LevelWarn},
+		{"write tcp 10.0.0.2:8000->10.0.0.1:51234: write: broken pipe", CategoryClientReset, slog.LevelInfo},
+		{"http2: server: error reading preface from client 10.0.0.1:51234: bogus greeting", CategoryHTTP2, slog.LevelWarn},
+		{"http: URL query contains semicolon", CategoryOther, slog.LevelError},
+	}
+
+	for _, tt := range tests {
+		category, level := Classify(tt.line)
+		assert.Equal(t, tt.category, category, tt.line)
+		assert.Equal(t, tt.level, level, tt.line)
+	}
+}
+
+func TestErrorLog(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	reg := prometheus.NewRegistry()
+	l, err := NewErrorLog(ErrorLogOptions{Registerer: reg, Limit: 2, Interval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := l.Writer().(*errorLog)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		l.Print("http: TLS handshake error from 10.0.0.1:51234: EOF")
+	}
+	l.Print("http: panic serving 10.0.0.1:51234: oops")
+
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "http", lines[0][nameKey])
+		assert.Equal(t, "INFO", lines[0]["level"])
+		assert.Equal(t, CategoryTLSHandshake, lines[0]["category"])
+		assert.Equal(t, "http: TLS handshake error from 10.0.0.1:51234: EOF", lines[0]["msg"])
+		assert.Equal(t, "ERROR", lines[2]["level"])
+		assert.Equal(t, CategoryPanic, lines[2]["category"])
+	}
+
+	// all are counted
+	assert.Equal(t, float64(5), testutil.ToFloat64(e.counter.WithLabelValues(CategoryTLSHandshake)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(e.counter.WithLabelValues(CategoryPanic)))
+
+	// the next interval tells how many were left out
+	now = now.Add(time.Minute)
+	l.Print("http: TLS handshake error from 10.0.0.1:51234: EOF")
+	lines = logged(t, &b)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, float64(3), lines[0]["suppressed"])
+	}
+
+	// the counter is shared with an error log registered before
+	_, err = NewErrorLog(ErrorLogOptions{Registerer: reg})
+	assert.NoError(t, err)
+}
+
+func TestErrorLogStacks(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	for _, stacks := range []bool{false, true} {
+		l, err := NewErrorLog(ErrorLogOptions{Registerer: prometheus.NewRegistry(), Stacks: stacks})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		s.Config.ErrorLog = l
+		s.Start()
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		s.Close()
+
+		lines := logged(t, &b)
+		if !assert.Len(t, lines, 1) {
+			continue
+		}
+		assert.Equal(t, CategorySuperfluousWrite, lines[0]["category"])
+		if stacks {
+			assert.Contains(t, lines[0]["stack"], "TestErrorLogStacks")
+		} else {
+			assert.Nil(t, lines[0]["stack"])
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// File is a log file rotating itself by size and age. The file being
+// written keeps its path, rotated files get the time they were rotated
+// appended, e.g. access.log.20261019T150405.000.
+//
+// Reopen reopens the path, for logrotate and friends moving the file
+// away from under us, e.g. on SIGHUP:
+//
+//	f, err := logging.OpenFile("access.log", logging.FileOptions{MaxSize: 100 << 20})
+//	...
+//	s.OnSignal(syscall.SIGHUP, func() { f.Reopen() })
+
+const (
+	rotatedLayout = "20060102T150405.000"
+)
+
+// FileOptions describes the rotation of a File
+type FileOptions struct {
+	MaxSize    int64         // in bytes before rotating, never if zero
+	MaxAge     time.Duration // of a file before rotating, e.g. 24h, never if zero
+	MaxBackups int           // rotated files kept, all if zero
+}
+
+// File is a rotating log file, safe for concurrent use
+type File struct {
+	path string
+	opts FileOptions
+	now  func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenFile opens (or creates) the log file at path for appending
+func OpenFile(path string, opts ...FileOptions) (*File, error) {
+	f := &File{path: path, now: time.Now}
+	if opts != nil {
+		f.opts = opts[0]
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write implements io.Writer, rotating the file first if p would take it
+// over its size or it is too old
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, errors.Errorf("log file %s is closed", f.path)
+	}
+	if f.full(int64(len(p))) {
+		// a failed rotation keeps writing to the file, it's retried on
+		// the next write
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the file aside and starts a new one
+func (f *File) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// Reopen closes and reopens the file at path, which someone else may have
+// moved away
+func (f *File) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	return f.open()
+}
+
+// Close closes the file, writes fail afterwards
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// full tells whether the file is due for a rotation before writing n bytes
+func (f *File) full(n int64) bool {
+	if f.opts.MaxSize > 0 && f.size > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.MaxAge > 0 && f.now().Sub(f.opened) >= f.opts.MaxAge
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "cannot open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "cannot stat log file")
+	}
+	f.file, f.size, f.opened = file, info.Size(), f.now()
+	return nil
+}
+
+func (f *File) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	rotated := f.path + "." + f.now().Format(rotatedLayout)
+	if err := os.Rename(f.path, rotated); err != nil && !os.IsNotExist(err) {
+		// carry on with the file at path
+		f.open()
+		return errors.Wrap(err, "cannot rotate log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+// prune removes the oldest rotated files over MaxBackups
+func (f *File) prune() error {
+	if f.opts.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return errors.Wrap(err, "cannot list rotated log files")
+	}
+	var rotated []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotatedLayout, strings.TrimPrefix(m, f.path+".")); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+	sort.Strings(rotated) // oldest first, by the time appended
+	for len(rotated) > f.opts.MaxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return errors.Wrap(err, "cannot remove rotated log file")
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
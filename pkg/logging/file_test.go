@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rotated returns the rotated files of path, oldest first
+func rotated(t *testing.T, path string) []string {
+	files, err := filepath.Glob(path + ".2*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	// appends to what is there
+	err = ioutil.WriteFile(path, []byte("old\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, FileOptions{MaxSize: 10, MaxAge: time.Hour, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	now := time.Date(2026, 10, 19, 15, 4, 5, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	// test data
+	var tests = []struct {
+		write   string
+		later   time.Duration
+		current string
+		rotated int
+	}{
+		{"12345\n", 0, "old\n12345\n", 0},
+		{"abc\n", time.Second, "abc\n", 1}, // over MaxSize
+		{"de\n", time.Second, "abc\nde\n", 1},
+		{"f\n", time.Hour, "f\n", 2},                               // over MaxAge
+		{"too long a line\n", time.Second, "too long a line\n", 2}, // only 2 kept
+		{"g\n", time.Second, "g\n", 2},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.later)
+		n, err := f.Write([]byte(tt.write))
+		assert.NoError(t, err, tt.write)
+		assert.Equal(t, len(tt.write), n, tt.write)
+
+		b, _ := ioutil.ReadFile(path)
+		assert.Equal(t, tt.current, string(b), tt.write)
+		assert.Len(t, rotated(t, path), tt.rotated, tt.write)
+	}
+
+	// the newest are kept
+	files := rotated(t, path)
+	b, _ := ioutil.ReadFile(files[len(files)-1])
+	assert.Equal(t, "too long a line\n", string(b))
+
+	assert.NoError(t, f.Close())
+	_, err = f.Write([]byte("closed\n"))
+	assert.Error(t, err)
+}
+
+func TestFileRotateError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := OpenFile(path, FileOptions{MaxSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	now := time.Date(2026, 10, 19, 15, 4, 5, 0, time.UTC)
+	f.now = func() time.Time { return now }
+
+	// a directory in the way of the rotated file
+	err = os.MkdirAll(filepath.Join(path+"."+now.Format(rotatedLayout), "taken"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, f.Rotate())
+	for _, line := range []string{"abc\n", "def\n"} {
+		_, err = f.Write([]byte(line))
+		assert.NoError(t, err, line)
+	}
+	b, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "abc\ndef\n", string(b))
+}
+
+func TestOpenFileError(t *testing.T) {
+	_, err := OpenFile(filepath.Join("missing", "dir", "access.log"))
+	assert.Error(t, err)
+}
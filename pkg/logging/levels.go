@@ -0,0 +1,198 @@
+package logging
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The levels can be changed while we run, for a while or for good, with
+// the admin endpoint:
+//
+//	# debug the tracing package for 15 minutes
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" \
+//		-d '{"levels": "tracing=debug", "expiry": "15m"}' \
+//		localhost:8000/admin/log-level
+//
+//	# back to the levels we started with
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" -X DELETE localhost:8000/admin/log-level
+//
+// or with ToggleDebug, e.g. on a signal.
+
+// LevelStatus describes the current levels
+type LevelStatus struct {
+	Levels   string     `json:"levels"`
+	Expires  *time.Time `json:"expires,omitempty"`   // when they revert, if they do
+	RevertTo string     `json:"revert_to,omitempty"` // the levels they revert to
+}
+
+// LevelRequest is the body of a change of levels
+type LevelRequest struct {
+	Levels string `json:"levels"`           // e.g. "debug" or "warn,tracing=debug"
+	Expiry string `json:"expiry,omitempty"` // e.g. "15m", for good if empty
+}
+
+// overrides are the levels set by Init, and a change expiring
+type overrides struct {
+	mu      sync.Mutex
+	initial *levelSet
+	saved   *levelSet // reverted to when the change expires
+	expires time.Time
+	timer   *time.Timer
+	gen     int // of the change, so a stopped timer firing anyway is ignored
+}
+
+var (
+	override overrides
+	logger   = Named("logging")
+)
+
+// setInitial sets the levels l we start with and revert to
+func setInitial(l *levelSet) {
+	override.mu.Lock()
+	defer override.mu.Unlock()
+	override.stop()
+	override.initial = l
+	levels.replace(l.clone())
+}
+
+// SetLevels sets the levels s, like "debug" or "warn,tracing=debug", on
+// top of the current ones. They revert after expiry, or stay if zero.
+func SetLevels(s string, expiry time.Duration) error {
+	override.mu.Lock()
+	next := levels.clone()
+	if err := next.parse(s); err != nil {
+		override.mu.Unlock()
+		return err
+	}
+	saved := override.saved
+	if saved == nil {
+		saved = levels.clone()
+	}
+	override.stop()
+	if expiry > 0 {
+		gen := override.gen
+		override.saved = saved
+		override.expires = time.Now().Add(expiry)
+		override.timer = time.AfterFunc(expiry, func() { revert(gen) })
+	}
+	levels.replace(next)
+	override.mu.Unlock()
+
+	logger.Info("log levels changed", "levels", Levels(), "expiry", expiry)
+	return nil
+}
+
+// ResetLevels reverts to the levels set by Init
+func ResetLevels() {
+	override.mu.Lock()
+	override.stop()
+	if override.initial != nil {
+		levels.replace(override.initial.clone())
+	} else {
+		levels.replace(&levelSet{dfl: dflLevel})
+	}
+	override.mu.Unlock()
+
+	logger.Info("log levels reset", "levels", Levels())
+}
+
+// ToggleDebug switches all loggers to debug for expiry (for good if
+// zero), or back to the levels set by Init if they already are, and tells
+// whether they now are. They stay at debug if Init set them there.
+func ToggleDebug(expiry time.Duration) bool {
+	if Level("") <= slog.LevelDebug {
+		ResetLevels()
+	} else {
+		SetLevels("debug", expiry)
+	}
+	return Level("") <= slog.LevelDebug
+}
+
+// CurrentLevels returns the current levels, and when they revert
+func CurrentLevels() LevelStatus {
+	override.mu.Lock()
+	defer override.mu.Unlock()
+	s := LevelStatus{Levels: Levels()}
+	if override.saved != nil {
+		expires := override.expires
+		s.Expires = &expires
+		s.RevertTo = override.saved.String()
+	}
+	return s
+}
+
+// revert reverts the change gen as it expires
+func revert(gen int) {
+	override.mu.Lock()
+	if override.gen != gen || override.saved == nil {
+		override.mu.Unlock()
+		return
+	}
+	levels.replace(override.saved)
+	override.stop()
+	override.mu.Unlock()
+
+	logger.Info("log levels reverted", "levels", Levels())
+}
+
+// stop forgets the change expiring, with mu held
+func (o *overrides) stop() {
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.timer, o.saved, o.expires = nil, nil, time.Time{}
+	o.gen++
+}
+
+// LevelHandler serves the admin endpoint. GET returns the LevelStatus,
+// POST/PUT with a JSON LevelRequest changes the levels and DELETE reverts
+// to those set by Init. It must be wrapped with admin.Authorize.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var req LevelRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "invalid request body").Error(), http.StatusBadRequest)
+			return
+		}
+		var expiry time.Duration
+		if req.Expiry != "" {
+			expiry, err = time.ParseDuration(req.Expiry)
+			if err != nil {
+				http.Error(w, errors.Wrap(err, "invalid expiry").Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		err = SetLevels(req.Levels, expiry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		ResetLevels()
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	j, err := json.Marshal(CurrentLevels())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// LevelHandlerFunc returns the admin HTTP Handler.
+func LevelHandlerFunc() http.Handler {
+	return http.HandlerFunc(LevelHandler)
+}
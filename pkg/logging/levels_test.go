@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLevels(t *testing.T) {
+	err := Init(Options{Level: "warn,http=error", Output: os.Stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	// on top of the current levels, for good
+	assert.NoError(t, SetLevels("tracing=debug", 0))
+	assert.Equal(t, "warn,http=error,tracing=debug", Levels())
+	assert.Nil(t, CurrentLevels().Expires)
+
+	// for a while
+	assert.NoError(t, SetLevels("debug", time.Hour))
+	s := CurrentLevels()
+	assert.Equal(t, "debug,http=error,tracing=debug", s.Levels)
+	assert.Equal(t, "warn,http=error,tracing=debug", s.RevertTo)
+	if assert.NotNil(t, s.Expires) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *s.Expires, time.Minute)
+	}
+
+	// another change reverts to the same levels
+	assert.NoError(t, SetLevels("http=debug", 10*time.Millisecond))
+	assert.Equal(t, "warn,http=error,tracing=debug", CurrentLevels().RevertTo)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, LevelStatus{Levels: "warn,http=error,tracing=debug"}, CurrentLevels())
+
+	assert.Error(t, SetLevels("loud", 0))
+	assert.Equal(t, "warn,http=error,tracing=debug", Levels())
+
+	// back to the levels of Init
+	assert.NoError(t, SetLevels("error", time.Hour))
+	ResetLevels()
+	assert.Equal(t, LevelStatus{Levels: "warn,http=error"}, CurrentLevels())
+}
+
+func TestToggleDebug(t *testing.T) {
+	err := Init(Options{Level: "warn", Output: os.Stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	assert.True(t, ToggleDebug(time.Hour))
+	assert.Equal(t, slog.LevelDebug, Level("tmpl"))
+	assert.NotNil(t, CurrentLevels().Expires)
+
+	assert.False(t, ToggleDebug(time.Hour))
+	assert.Equal(t, slog.LevelWarn, Level("tmpl"))
+	assert.Nil(t, CurrentLevels().Expires)
+
+	// debug from the start stays on
+	err = Init(Options{Level: "debug", Output: os.Stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, ToggleDebug(time.Hour))
+	assert.Equal(t, slog.LevelDebug, Level("tmpl"))
+}
+
+func TestLevelHandler(t *testing.T) {
+	err := Init(Options{Level: "info", Output: os.Stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	// test data
+	var tests = []struct {
+		method  string
+		body    string
+		status  int
+		levels  string
+		expires bool
+	}{
+		{"GET", "", 200, "info", false},
+		{"POST", `{"levels": "tracing=debug"}`, 200, "info,tracing=debug", false},
+		{"PUT", `{"levels": "debug", "expiry": "15m"}`, 200, "debug,tracing=debug", true},
+		{"POST", `{"levels": "loud"}`, 400, "", false},
+		{"POST", `{"levels": "debug", "expiry": "soon"}`, 400, "", false},
+		{"POST", `levels=debug`, 400, "", false},
+		{"DELETE", "", 200, "info", false},
+		{"PATCH", "", 405, "", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.method + " " + tt.body
+		req := httptest.NewRequest(tt.method, "/admin/log-level", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		LevelHandlerFunc().ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.status, rr.Code, name)
+		if rr.Code != 200 {
+			continue
+		}
+		var s LevelStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.levels, s.Levels, name)
+		assert.Equal(t, tt.expires, s.Expires != nil, name)
+	}
+}
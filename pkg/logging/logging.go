@@ -0,0 +1,408 @@
+/*
+Package logging is our structured, leveled logging, on log/slog. Every
+package logs through a logger named after it:
+
+	var logger = logging.Named("tmpl")
+
+	logger.Error("cannot parse templates", "err", err)
+
+Init, first thing in main, sets the format, output and levels of all of
+them, including the loggers named before it ran. It makes the standard
+log package (and the libraries logging through it) and slog.Default log
+through us too:
+
+	opts, err := logging.FromEnv(logging.Options{})
+	...
+	err = logging.Init(opts)
+
+Levels are set for all loggers and per logger name, e.g. "warn,tracing=debug".
+
+Handlers log with the request context, which carries the fields of the
+request (see With), e.g. the request ID:
+
+	logger.ErrorContext(r.Context(), "cannot render page", "err", err)
+*/
+package logging
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console" // slog's key=value text
+
+	dflLevel = slog.LevelInfo
+
+	// the logger name attribute
+	nameKey = "logger"
+)
+
+// Options describes the logging options
+type Options struct {
+	Format    string    // json or console, = console
+	Level     string    // e.g. "info", or "warn,tracing=debug" per logger name, = info
+	Output    io.Writer // = os.Stderr
+	AddSource bool      // log the file and line of each call
+	Redact    RedactOptions
+}
+
+// FromEnv returns opts overridden by the LOG_* environment variables that
+// are set:
+//
+//	LOG_FORMAT   json or console
+//	LOG_LEVEL    e.g. info, or warn,tracing=debug
+//	LOG_SOURCE   true logs the file and line of each call
+//	LOG_REDACT_HEADERS, LOG_REDACT_QUERY, LOG_REDACT_FIELDS
+//	             more to redact, e.g. X-Session,X-Signature:hash
+//	LOG_REDACT_MASK
+//	             full, partial or hash
+func FromEnv(opts Options) (Options, error) {
+	var err error
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		opts.Format = v
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		opts.Level = v
+	}
+	if v := os.Getenv("LOG_REDACT_HEADERS"); v != "" {
+		opts.Redact.Headers = strings.Split(v, ",")
+	}
+	if v := os.Getenv("LOG_REDACT_QUERY"); v != "" {
+		opts.Redact.Query = strings.Split(v, ",")
+	}
+	if v := os.Getenv("LOG_REDACT_FIELDS"); v != "" {
+		opts.Redact.Fields = strings.Split(v, ",")
+	}
+	if v := os.Getenv("LOG_REDACT_MASK"); v != "" {
+		opts.Redact.Mask = v
+	}
+	if v := os.Getenv("LOG_SOURCE"); v != "" {
+		opts.AddSource, err = strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse LOG_SOURCE")
+		}
+	}
+	return opts, nil
+}
+
+// the configuration all our loggers share
+var (
+	mu   sync.RWMutex
+	base slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: minLevel})
+	gen  int          // of base, bumped by Init
+
+	format   string    = FormatConsole // of base
+	output   io.Writer = os.Stderr     // of base
+	redactor           = mustRedactor()
+
+	levels = &levelSet{dfl: dflLevel}
+)
+
+// mustRedactor returns the Redactor of the default options
+func mustRedactor() *Redactor {
+	r, err := NewRedactor()
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// minLevel lets everything through the base handler, our loggers decide
+const minLevel = slog.Level(-100)
+
+// Init configures all our loggers, and routes the standard log package
+// and slog.Default through them
+func Init(opts ...Options) error {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Output == nil {
+		opt.Output = os.Stderr
+	}
+
+	l, err := parseLevels(opt.Level)
+	if err != nil {
+		return err
+	}
+
+	red, err := NewRedactor(opt.Redact)
+	if err != nil {
+		return err
+	}
+
+	ho := &slog.HandlerOptions{Level: minLevel, AddSource: opt.AddSource}
+	var h slog.Handler
+	switch opt.Format {
+	case "", FormatConsole:
+		h = slog.NewTextHandler(opt.Output, ho)
+	case FormatJSON:
+		h = slog.NewJSONHandler(opt.Output, ho)
+	default:
+		return errors.Errorf("unknown log format %q", opt.Format)
+	}
+
+	mu.Lock()
+	base, format, output, redactor = h, opt.Format, opt.Output, red
+	if format == "" {
+		format = FormatConsole
+	}
+	gen++
+	mu.Unlock()
+	setInitial(l)
+
+	// log.Printf and friends log at info
+	slog.SetDefault(Named(""))
+	log.SetFlags(0)
+	return nil
+}
+
+// DefaultRedactor returns the Redactor set by Init, everything logging
+// about requests uses it by default
+func DefaultRedactor() *Redactor {
+	mu.RLock()
+	defer mu.RUnlock()
+	return redactor
+}
+
+// Named returns the logger with name, e.g. the package's
+func Named(name string) *slog.Logger {
+	return slog.New(named(name, nil))
+}
+
+// named returns the handler of the logger with name, on base if not nil
+// instead of the shared one
+func named(name string, base slog.Handler) *handler {
+	h := &handler{name: name, fixed: base}
+	if name != "" {
+		h.ops = []func(slog.Handler) slog.Handler{func(b slog.Handler) slog.Handler {
+			return b.WithAttrs([]slog.Attr{slog.String(nameKey, name)})
+		}}
+	}
+	return h
+}
+
+// StdLogger returns a standard *log.Logger logging at level through the
+// logger with name, e.g. for an http.Server's ErrorLog
+func StdLogger(name string, level slog.Level) *log.Logger {
+	return slog.NewLogLogger(Named(name).Handler(), level)
+}
+
+// Fatal logs msg at error level, then exits
+func Fatal(l *slog.Logger, msg string, args ...interface{}) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Level returns the level of the logger with name
+func Level(name string) slog.Level {
+	return levels.get(name)
+}
+
+// SetLevel sets the level of the logger with name, or of all the loggers
+// without a level of their own if name is ""
+func SetLevel(name string, level slog.Level) {
+	levels.set(name, level)
+}
+
+// Levels returns the levels in the format of Options.Level
+func Levels() string {
+	return levels.String()
+}
+
+// handler is the slog.Handler of our named loggers. It replays the
+// attributes and groups of the logger on the current base handler, so
+// loggers named before Init follow it.
+type handler struct {
+	name  string
+	fixed slog.Handler                      // the base handler instead of the shared one
+	ops   []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, in order
+
+	mu    sync.Mutex
+	gen   int
+	built slog.Handler // base with ops, for gen
+}
+
+// Enabled implements slog.Handler
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= levels.get(h.name)
+}
+
+// Handle implements slog.Handler
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if f := fields(ctx); len(f) > 0 {
+		r = r.Clone()
+		r.AddAttrs(f...)
+	}
+	return h.handler().Handle(ctx, r)
+}
+
+// handler returns the base handler with our attributes and groups
+func (h *handler) handler() slog.Handler {
+	mu.RLock()
+	b, g := base, gen
+	mu.RUnlock()
+	if h.fixed != nil {
+		b, g = h.fixed, 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.built == nil || h.gen != g {
+		for _, op := range h.ops {
+			b = op(b)
+		}
+		h.built, h.gen = b, g
+	}
+	return h.built
+}
+
+// WithAttrs implements slog.Handler
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+// WithGroup implements slog.Handler
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{name: h.name, fixed: h.fixed, ops: append(ops, op)}
+}
+
+// levelSet is the default level, and the levels of named loggers
+type levelSet struct {
+	mu    sync.RWMutex
+	dfl   slog.Level
+	named map[string]slog.Level
+}
+
+// parseLevels parses levels like "warn,tracing=debug"
+func parseLevels(s string) (*levelSet, error) {
+	l := &levelSet{dfl: dflLevel}
+	if err := l.parse(s); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parse sets the levels s, like "warn,tracing=debug", on l
+func (l *levelSet) parse(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return errors.Wrapf(err, "invalid log level %q", part)
+		}
+		l.set(name, level)
+	}
+	return nil
+}
+
+func (l *levelSet) get(name string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.named[name]; ok {
+		return level
+	}
+	return l.dfl
+}
+
+func (l *levelSet) set(name string, level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if name == "" {
+		l.dfl = level
+		return
+	}
+	if l.named == nil {
+		l.named = map[string]slog.Level{}
+	}
+	l.named[name] = level
+}
+
+// replace replaces l's levels with other's
+func (l *levelSet) replace(other *levelSet) {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dfl, l.named = other.dfl, other.named
+}
+
+// clone returns a copy of l
+func (l *levelSet) clone() *levelSet {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	c := &levelSet{dfl: l.dfl}
+	for name, level := range l.named {
+		if c.named == nil {
+			c.named = map[string]slog.Level{}
+		}
+		c.named[name] = level
+	}
+	return c
+}
+
+func (l *levelSet) String() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	parts := []string{strings.ToLower(l.dfl.String())}
+	names := make([]string, 0, len(l.named))
+	for name := range l.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+"="+strings.ToLower(l.named[name].String()))
+	}
+	return strings.Join(parts, ",")
+}
+
+type key int
+
+const fieldsKey key = 0
+
+// With returns a copy of ctx carrying the fields args, as key-value pairs
+// or slog.Attrs, on top of those ctx carries. Everything logged with the
+// context has them.
+func With(ctx context.Context, args ...interface{}) context.Context {
+	r := slog.Record{}
+	r.Add(args...)
+	f := append([]slog.Attr{}, fields(ctx)...)
+	r.Attrs(func(a slog.Attr) bool {
+		f = append(f, a)
+		return true
+	})
+	return context.WithValue(ctx, fieldsKey, f)
+}
+
+// fields returns the fields ctx carries
+func fields(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	f, _ := ctx.Value(fieldsKey).([]slog.Attr)
+	return f
+}
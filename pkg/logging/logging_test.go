@@ -0,0 +1,184 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logged returns the JSON lines in b
+func logged(t *testing.T, b *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		lines = append(lines, m)
+	}
+	b.Reset()
+	return lines
+}
+
+func TestInit(t *testing.T) {
+	// named before Init, as package loggers are
+	early := Named("early")
+
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Level: "warn, tracing=debug", Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	// test data
+	var tests = []struct {
+		logger string
+		level  slog.Level
+		logged bool
+	}{
+		{"early", slog.LevelWarn, true},
+		{"early", slog.LevelInfo, false},
+		{"tmpl", slog.LevelError, true},
+		{"tracing", slog.LevelDebug, true},
+		{"tracing", slog.LevelDebug - 1, false},
+	}
+
+	for _, tt := range tests {
+		l := Named(tt.logger)
+		if tt.logger == "early" {
+			l = early
+		}
+		l.Log(context.Background(), tt.level, "hello", "n", 1)
+
+		lines := logged(t, &b)
+		name := tt.logger + " " + tt.level.String()
+		if !tt.logged {
+			assert.Len(t, lines, 0, name)
+			continue
+		}
+		if assert.Len(t, lines, 1, name) {
+			assert.Equal(t, tt.logger, lines[0][nameKey], name)
+			assert.Equal(t, "hello", lines[0]["msg"], name)
+			assert.Equal(t, float64(1), lines[0]["n"], name)
+		}
+	}
+
+	// the standard logger logs through us at info
+	SetLevel("", slog.LevelInfo)
+	log.Printf("from %s", "log")
+	slog.Info("from slog")
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "from log", lines[0]["msg"])
+		assert.Equal(t, "INFO", lines[0]["level"])
+		assert.Nil(t, lines[0][nameKey])
+		assert.Equal(t, "from slog", lines[1]["msg"])
+	}
+
+	assert.Equal(t, "info,tracing=debug", Levels())
+	assert.Equal(t, slog.LevelDebug, Level("tracing"))
+	assert.Equal(t, slog.LevelInfo, Level("tmpl"))
+}
+
+func TestInitErrors(t *testing.T) {
+	assert.Error(t, Init(Options{Format: "xml"}))
+	assert.Error(t, Init(Options{Level: "loud"}))
+	assert.Error(t, Init(Options{Level: "info,tracing=loud"}))
+	assert.Error(t, Init(Options{Redact: RedactOptions{Mask: "blur"}}))
+}
+
+func TestWith(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	ctx := With(context.Background(), "request_id", "abc")
+	child := With(ctx, slog.Int("attempt", 2))
+
+	l := Named("handlers").With("route", "/")
+	l.InfoContext(child, "hello")
+	l.InfoContext(ctx, "hello")
+	l.Info("hello")
+
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "abc", lines[0]["request_id"])
+		assert.Equal(t, float64(2), lines[0]["attempt"])
+		assert.Equal(t, "/", lines[0]["route"])
+		assert.Equal(t, "handlers", lines[0][nameKey])
+
+		// the parent context is unchanged
+		assert.Equal(t, "abc", lines[1]["request_id"])
+		assert.Nil(t, lines[1]["attempt"])
+
+		assert.Nil(t, lines[2]["request_id"])
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	StdLogger("http", slog.LevelError).Print("http: TLS handshake error")
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "ERROR", lines[0]["level"])
+		assert.Equal(t, "http", lines[0][nameKey])
+		assert.Equal(t, "http: TLS handshake error", lines[0]["msg"])
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"LOG_FORMAT": "json",
+		"LOG_LEVEL":  "debug,http=error",
+		"LOG_SOURCE": "true",
+
+		"LOG_REDACT_HEADERS": "X-Session:hash",
+		"LOG_REDACT_QUERY":   "sig,state",
+		"LOG_REDACT_FIELDS":  "pin",
+		"LOG_REDACT_MASK":    "partial",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	opts, err := FromEnv(Options{Format: FormatConsole})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Options{
+		Format:    FormatJSON,
+		Level:     "debug,http=error",
+		AddSource: true,
+		Redact: RedactOptions{
+			Headers: []string{"X-Session:hash"},
+			Query:   []string{"sig", "state"},
+			Fields:  []string{"pin"},
+			Mask:    MaskPartial,
+		},
+	}, opts)
+
+	os.Setenv("LOG_SOURCE", "invalid")
+	_, err = FromEnv(Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,402 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/pkg/errors"
+	"github.com/urfave/negroni"
+)
+
+// The access log is a line per request, through the "access" logger in
+// the format of the other logs by default, or one of:
+//
+//	combined   Apache's combined format, followed by the latency in
+//	           microseconds, the route pattern, the request ID and trace ID
+//	{{...}}    a text/template of an AccessEntry, e.g.
+//	           '{{.Status}} {{.Method}} {{.Route}} {{.Duration}}'
+//
+// It goes where the other logs go, or to a File rotated by size and age:
+//
+//	access, err := logging.NewMiddleware(logging.AccessOptions{
+//		Format:  logging.FormatCombined,
+//		File:    "access.log",
+//		Rotate:  logging.FileOptions{MaxSize: 100 << 20, MaxBackups: 10},
+//		Exclude: []string{"/healthz", "/metrics"},
+//	})
+//	...
+//	s.OnSignal(syscall.SIGHUP, func() { access.Reopen() })
+//
+// Use it after the middleware setting the request fields (e.g. requestid),
+// so the lines carry them.
+
+const (
+	// FormatCombined is Apache's combined log format, with our extras
+	FormatCombined = "combined"
+
+	// CombinedFormat is the template of FormatCombined
+	CombinedFormat = `{{.Host}} - {{escape .User}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] ` +
+		`"{{.Method}} {{escape .URI}} {{.Proto}}" {{.Status}} {{.Size}} {{quote .Referer}} {{quote .UserAgent}} ` +
+		`{{.Duration.Microseconds}} {{quote .Route}} {{quote .RequestID}} {{quote .TraceID}}`
+
+	accessLogger = "access"
+)
+
+// AccessOptions describes the access log options
+type AccessOptions struct {
+	Format  string      // json, console, combined or a template, = the format of the other logs
+	File    string      // path of the log file, = the output of the other logs
+	Rotate  FileOptions // of the File
+	Exclude []string    // paths not logged, a trailing "/" excludes all below, e.g. /healthz
+	Sample  float64     // of the requests logged, server errors always are, = 1
+
+	// masks the query of URI and Referer, = DefaultRedactor()
+	Redactor *Redactor
+}
+
+// AccessFromEnv returns opts overridden by the ACCESS_LOG_* environment
+// variables that are set:
+//
+//	ACCESS_LOG_FORMAT        json, console, combined or a template
+//	ACCESS_LOG_FILE          path of the log file
+//	ACCESS_LOG_MAX_SIZE      in bytes before rotating the file
+//	ACCESS_LOG_MAX_AGE       before rotating the file, e.g. 24h
+//	ACCESS_LOG_MAX_BACKUPS   rotated files kept
+//	ACCESS_LOG_EXCLUDE       paths not logged, e.g. /healthz,/metrics
+//	ACCESS_LOG_SAMPLE        of the requests logged, e.g. 0.1
+func AccessFromEnv(opts AccessOptions) (AccessOptions, error) {
+	var err error
+	if v := os.Getenv("ACCESS_LOG_FORMAT"); v != "" {
+		opts.Format = v
+	}
+	if v := os.Getenv("ACCESS_LOG_FILE"); v != "" {
+		opts.File = v
+	}
+	if v := os.Getenv("ACCESS_LOG_MAX_SIZE"); v != "" {
+		opts.Rotate.MaxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse ACCESS_LOG_MAX_SIZE")
+		}
+	}
+	if v := os.Getenv("ACCESS_LOG_MAX_AGE"); v != "" {
+		opts.Rotate.MaxAge, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse ACCESS_LOG_MAX_AGE")
+		}
+	}
+	if v := os.Getenv("ACCESS_LOG_MAX_BACKUPS"); v != "" {
+		opts.Rotate.MaxBackups, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse ACCESS_LOG_MAX_BACKUPS")
+		}
+	}
+	if v := os.Getenv("ACCESS_LOG_EXCLUDE"); v != "" {
+		opts.Exclude = strings.Split(v, ",")
+	}
+	if v := os.Getenv("ACCESS_LOG_SAMPLE"); v != "" {
+		opts.Sample, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse ACCESS_LOG_SAMPLE")
+		}
+	}
+	return opts, nil
+}
+
+// AccessEntry is a logged request, the data of the access log templates
+type AccessEntry struct {
+	Time      time.Time // the request started
+	Method    string
+	URI       string // as requested, with the query redacted
+	Path      string
+	Proto     string
+	Route     string // pattern, "" if no route matched
+	Status    int
+	Size      int // of the response body
+	Duration  time.Duration
+	Remote    string // address of the client, or the proxy in front of us
+	User      string // of basic auth
+	Referer   string // with the query redacted
+	UserAgent string
+	RequestID string
+	TraceID   string
+}
+
+// Host returns the IP of Remote
+func (e AccessEntry) Host() string {
+	host, _, err := net.SplitHostPort(e.Remote)
+	if err != nil {
+		return e.Remote
+	}
+	return host
+}
+
+// Middleware is a Negroni middleware logging every request, in place of
+// negroni's Logger
+type Middleware struct {
+	logger  *slog.Logger       // for the levels, and json and console
+	tmpl    *template.Template // other formats
+	out     io.Writer          // of tmpl, = the output of the other logs
+	file    *File
+	exclude []string
+	sample  float64
+	redact  *Redactor
+
+	mu   sync.Mutex // of out and rand
+	rand *rand.Rand
+}
+
+// NewMiddleware returns a new access log Middleware
+func NewMiddleware(opts ...AccessOptions) (*Middleware, error) {
+	var opt AccessOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Sample <= 0 || opt.Sample > 1 {
+		opt.Sample = 1
+	}
+
+	m := &Middleware{
+		logger:  Named(accessLogger),
+		exclude: opt.Exclude,
+		sample:  opt.Sample,
+		redact:  opt.Redactor,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	text := ""
+	switch opt.Format {
+	case "", FormatJSON, FormatConsole:
+	case FormatCombined:
+		text = CombinedFormat
+	default:
+		if !strings.Contains(opt.Format, "{{") {
+			return nil, errors.Errorf("unknown access log format %q", opt.Format)
+		}
+		text = opt.Format
+	}
+	if text != "" {
+		t, err := template.New(accessLogger).Funcs(template.FuncMap{"quote": quote, "escape": escape}).Parse(text)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse access log format")
+		}
+		m.tmpl = t
+	}
+
+	if opt.File != "" {
+		f, err := OpenFile(opt.File, opt.Rotate)
+		if err != nil {
+			return nil, err
+		}
+		m.file, m.out = f, f
+	}
+	if m.tmpl == nil && (opt.Format != "" || m.out != nil) {
+		m.logger = slog.New(named(accessLogger, newBase(opt.Format, m.out)))
+	}
+	return m, nil
+}
+
+// newBase returns a base handler writing format f to w, in the format and
+// to the output of the other logs if not set
+func newBase(f string, w io.Writer) slog.Handler {
+	mu.RLock()
+	if f == "" {
+		f = format
+	}
+	if w == nil {
+		w = output
+	}
+	mu.RUnlock()
+	if f == FormatJSON {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: minLevel})
+	}
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: minLevel})
+}
+
+// Reopen reopens the log file, e.g. on SIGHUP once logrotate moved it
+func (m *Middleware) Reopen() error {
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Reopen()
+}
+
+// Close closes the log file
+func (m *Middleware) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	return m.file.Close()
+}
+
+func (m *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if m.excluded(r.URL.Path) {
+		next(rw, r)
+		return
+	}
+
+	start := time.Now()
+	r = route.New(r)
+
+	// the handler may panic, to be recovered further out into a 500,
+	// which is logged as such
+	done := false
+	defer func() {
+		status := rw.(negroni.ResponseWriter).Status()
+		switch {
+		case !done:
+			status = http.StatusInternalServerError
+		case status == 0:
+			status = http.StatusOK
+		}
+		m.record(rw, r, start, status)
+	}()
+
+	next(rw, r)
+	done = true
+}
+
+// record logs the request r served with status
+func (m *Middleware) record(rw http.ResponseWriter, r *http.Request, start time.Time, status int) {
+	res := rw.(negroni.ResponseWriter)
+	ctx := r.Context()
+	if !m.logger.Enabled(ctx, slog.LevelInfo) || !m.sampled(status) {
+		return
+	}
+
+	e := AccessEntry{
+		Time:      start,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		Route:     route.Pattern(r),
+		Status:    status,
+		Size:      res.Size(),
+		Duration:  time.Since(start),
+		Remote:    r.RemoteAddr,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if e.URI == "" {
+		e.URI = r.URL.RequestURI()
+	}
+	redact := m.redact
+	if redact == nil {
+		redact = DefaultRedactor()
+	}
+	e.URI, e.Referer = redact.URL(e.URI), redact.URL(e.Referer)
+	e.User, _, _ = r.BasicAuth()
+	if m.tmpl == nil {
+		m.log(ctx, e)
+		return
+	}
+
+	e.RequestID, e.TraceID = field(ctx, "request_id"), field(ctx, "trace_id")
+	var b bytes.Buffer
+	if err := m.tmpl.Execute(&b, e); err != nil {
+		m.logger.ErrorContext(ctx, "cannot format access log", "err", err)
+		return
+	}
+	b.WriteByte('\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := m.out
+	if out == nil {
+		mu.RLock()
+		out = output
+		mu.RUnlock()
+	}
+	out.Write(b.Bytes())
+}
+
+// log logs e through the logger, the request fields come with ctx
+func (m *Middleware) log(ctx context.Context, e AccessEntry) {
+	attrs := []slog.Attr{
+		slog.String("method", e.Method),
+		slog.String("path", e.Path),
+	}
+	if e.Route != "" {
+		attrs = append(attrs, slog.String("route", e.Route))
+	}
+	attrs = append(attrs,
+		slog.Int("status", e.Status),
+		slog.Int("size", e.Size),
+		slog.Duration("duration", e.Duration),
+		slog.String("remote", e.Remote),
+	)
+	m.logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+}
+
+// excluded tells whether requests for path are not logged
+func (m *Middleware) excluded(path string) bool {
+	for _, p := range m.exclude {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled tells whether to log a request with status
+func (m *Middleware) sampled(status int) bool {
+	if m.sample >= 1 || status >= http.StatusInternalServerError {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rand.Float64() < m.sample
+}
+
+// field returns the string value of the request field key in ctx
+func field(ctx context.Context, key string) string {
+	for _, a := range fields(ctx) {
+		if a.Key == key {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+// quote quotes s for the combined format, "-" if empty
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + escape(s) + `"`
+}
+
+// escape escapes quotes, backslashes and control characters in s for the
+// combined format, as Apache does, so a request can't forge a line. It
+// returns - if s is empty.
+func escape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,292 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+// accessServer returns a server logging its requests with opts, /hello/
+// matches the route /hello/:name, /fail fails, /missing is not found and
+// /panic panics
+func accessServer(t *testing.T, opts AccessOptions) (*negroni.Negroni, *Middleware) {
+	m, err := NewMiddleware(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.UseFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		next(rw, r.WithContext(With(r.Context(), "request_id", "abc", "trace_id", "def")))
+	})
+	n.Use(m)
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/hello/"):
+			route.Set(r, "/hello/:name")
+		case r.URL.Path == "/fail":
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+			return
+		case r.URL.Path == "/panic":
+			panic("boom")
+		}
+		w.Write([]byte("hello"))
+	})
+	return n, m
+}
+
+func get(n http.Handler, path string) {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", `curl "quoted"`)
+	n.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestMiddleware(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	n, _ := accessServer(t, AccessOptions{})
+
+	// test data
+	var tests = []struct {
+		path   string
+		route  interface{}
+		status float64
+		size   float64
+	}{
+		{"/", nil, 200, 5},
+		{"/hello/bob", "/hello/:name", 200, 5},
+		{"/missing", nil, 404, 19},
+	}
+
+	for _, tt := range tests {
+		get(n, tt.path)
+
+		lines := logged(t, &b)
+		if !assert.Len(t, lines, 1, tt.path) {
+			continue
+		}
+		line := lines[0]
+		assert.Equal(t, "access", line[nameKey], tt.path)
+		assert.Equal(t, "request", line["msg"], tt.path)
+		assert.Equal(t, "GET", line["method"], tt.path)
+		assert.Equal(t, tt.path, line["path"], tt.path)
+		assert.Equal(t, tt.route, line["route"], tt.path)
+		assert.Equal(t, tt.status, line["status"], tt.path)
+		assert.Equal(t, tt.size, line["size"], tt.path)
+		assert.Equal(t, "10.0.0.1:1234", line["remote"], tt.path)
+		assert.Equal(t, "abc", line["request_id"], tt.path)
+		assert.Equal(t, "def", line["trace_id"], tt.path)
+		assert.Contains(t, line, "duration", tt.path)
+	}
+
+	// the access logger has a level like the others
+	SetLevel(accessLogger, slog.LevelWarn)
+	get(n, "/")
+	assert.Len(t, logged(t, &b), 0)
+}
+
+func TestMiddlewareFormats(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	// test data
+	var tests = []struct {
+		format string
+		want   string // in the line
+	}{
+		{FormatCombined, `10.0.0.1 - - [`},
+		{FormatCombined, `] "GET /hello/bob?x=1&token=[REDACTED] HTTP/1.1" 200 5 "-" "curl \"quoted\"" `},
+		{FormatCombined, ` "/hello/:name" "abc" "def"` + "\n"},
+		{"{{.Status}} {{.Route}} {{.RequestID}}", "200 /hello/:name abc\n"},
+	}
+
+	for _, tt := range tests {
+		n, _ := accessServer(t, AccessOptions{Format: tt.format})
+		get(n, "/hello/bob?x=1&token=s3cret")
+		assert.Contains(t, b.String(), tt.want, tt.format)
+		assert.Equal(t, 1, strings.Count(b.String(), "\n"), tt.format)
+		b.Reset()
+	}
+
+	// JSON whatever the other logs are
+	n, _ := accessServer(t, AccessOptions{Format: FormatJSON})
+	get(n, "/")
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "abc", lines[0]["request_id"])
+	}
+
+	_, err = NewMiddleware(AccessOptions{Format: "xml"})
+	assert.Error(t, err)
+	_, err = NewMiddleware(AccessOptions{Format: "{{.Status"})
+	assert.Error(t, err)
+}
+
+func TestMiddlewareEscapes(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	n, _ := accessServer(t, AccessOptions{Format: FormatCombined})
+
+	// a client trying to forge a line
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RequestURI = "/?x=\" HTTP/1.1\" 200 5\n10.6.6.6 - - [a"
+	req.SetBasicAuth("bob\n10.6.6.6", "pw")
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := b.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"), line)
+	assert.Contains(t, line, ` - bob\x0a10.6.6.6 [`)
+	assert.Contains(t, line, `"GET /?x=\" HTTP/1.1\" 200 5\x0a10.6.6.6 - - [a HTTP/1.1" 200 5 `)
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	// the panic is recovered outside of the access log
+	n, _ := accessServer(t, AccessOptions{})
+	recovery := negroni.NewRecovery()
+	recovery.Logger = log.New(ioutil.Discard, "", 0)
+	outer := negroni.New(recovery)
+	outer.UseHandler(n)
+	get(outer, "/panic")
+
+	lines := logged(t, &b)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "/panic", lines[0]["path"])
+		assert.Equal(t, float64(500), lines[0]["status"])
+	}
+}
+
+func TestMiddlewareExcludeAndSample(t *testing.T) {
+	var b bytes.Buffer
+	err := Init(Options{Format: FormatJSON, Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Init(Options{Output: os.Stderr})
+
+	n, _ := accessServer(t, AccessOptions{
+		Exclude: []string{"/healthz", "/hello/"},
+		Sample:  1e-9,
+	})
+
+	// test data
+	var tests = []struct {
+		path   string
+		logged bool
+	}{
+		{"/healthz", false},
+		{"/hello/bob", false},
+		{"/", false},         // not sampled
+		{"/fail", true},      // errors always are
+		{"/healthzz", false}, // not excluded, but not sampled either
+	}
+
+	for _, tt := range tests {
+		get(n, tt.path)
+		lines := logged(t, &b)
+		if tt.logged {
+			assert.Len(t, lines, 1, tt.path)
+		} else {
+			assert.Len(t, lines, 0, tt.path)
+		}
+	}
+}
+
+func TestMiddlewareFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	n, m := accessServer(t, AccessOptions{Format: "{{.Path}}", File: path})
+	get(n, "/")
+
+	// logrotate moves the file away, then signals us
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get(n, "/moved")
+	assert.NoError(t, m.Reopen())
+	get(n, "/reopened")
+	assert.NoError(t, m.Close())
+
+	b, _ := ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "/\n/moved\n", string(b))
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "/reopened\n", string(b))
+}
+
+func TestAccessFromEnv(t *testing.T) {
+	env := map[string]string{
+		"ACCESS_LOG_FORMAT":      "combined",
+		"ACCESS_LOG_FILE":        "/var/log/access.log",
+		"ACCESS_LOG_MAX_SIZE":    "1048576",
+		"ACCESS_LOG_MAX_AGE":     "24h",
+		"ACCESS_LOG_MAX_BACKUPS": "7",
+		"ACCESS_LOG_EXCLUDE":     "/healthz,/metrics",
+		"ACCESS_LOG_SAMPLE":      "0.5",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	opts, err := AccessFromEnv(AccessOptions{Exclude: []string{"/livez"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, AccessOptions{
+		Format:  FormatCombined,
+		File:    "/var/log/access.log",
+		Rotate:  FileOptions{MaxSize: 1 << 20, MaxAge: 24 * time.Hour, MaxBackups: 7},
+		Exclude: []string{"/healthz", "/metrics"},
+		Sample:  0.5,
+	}, opts)
+
+	for _, k := range []string{"ACCESS_LOG_MAX_SIZE", "ACCESS_LOG_MAX_AGE", "ACCESS_LOG_MAX_BACKUPS", "ACCESS_LOG_SAMPLE"} {
+		v := os.Getenv(k)
+		os.Setenv(k, "invalid")
+		_, err = AccessFromEnv(AccessOptions{})
+		assert.Error(t, err, k)
+		os.Setenv(k, v)
+	}
+}
@@ -0,0 +1,222 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// What we log about requests (the access log, panic reports, dumps) goes
+// through a Redactor first, masking the headers, query parameters and
+// JSON fields on its deny lists, e.g. Authorization and ?access_token=.
+// The lists are on top of the defaults, and an entry can pick its own
+// masking, e.g. "X-Session:hash" to still tell sessions apart:
+//
+//	r, err := logging.NewRedactor(logging.RedactOptions{
+//		Headers: []string{"X-Session:hash"},
+//		Mask:    logging.MaskPartial,
+//	})
+//
+// Init sets the one everything uses by default (see DefaultRedactor).
+
+// the ways to mask a value
+const (
+	MaskFull    = "full"    // [REDACTED]
+	MaskPartial = "partial" // the last 4 characters of long values, e.g. ****f00d
+	MaskHash    = "hash"    // a hash to tell values apart, e.g. sha256:2c26b46b68ff
+
+	redacted = "[REDACTED]"
+)
+
+var (
+	// DefaultHeaders are always redacted
+	DefaultHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"}
+
+	// DefaultQuery are the query (and form) parameters always redacted
+	DefaultQuery = []string{"token", "access_token", "refresh_token", "id_token", "api_key", "apikey", "key", "password", "secret", "signature", "code"}
+
+	// DefaultFields are the JSON fields always redacted, at any depth
+	DefaultFields = []string{"password", "secret", "token", "access_token", "refresh_token", "api_key", "client_secret", "credit_card", "ssn"}
+)
+
+// RedactOptions describes the redaction options
+type RedactOptions struct {
+	Headers []string // names, on top of DefaultHeaders, with an optional ":mask"
+	Query   []string // parameters, on top of DefaultQuery, with an optional ":mask"
+	Fields  []string // JSON fields, on top of DefaultFields, with an optional ":mask"
+	Mask    string   // full, partial or hash, = full
+}
+
+// Redactor masks secrets in what we log about requests. It is safe for
+// concurrent use.
+type Redactor struct {
+	headers map[string]string // canonical name to mask
+	query   map[string]string // lower case name to mask
+	fields  map[string]string // lower case name to mask
+}
+
+// NewRedactor returns a new Redactor
+func NewRedactor(opts ...RedactOptions) (*Redactor, error) {
+	var opt RedactOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Mask == "" {
+		opt.Mask = MaskFull
+	}
+	if !validMask(opt.Mask) {
+		return nil, errors.Errorf("unknown redaction mask %q", opt.Mask)
+	}
+
+	r := &Redactor{}
+	var err error
+	r.headers, err = denyList(DefaultHeaders, opt.Headers, opt.Mask, http.CanonicalHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	r.query, err = denyList(DefaultQuery, opt.Query, opt.Mask, strings.ToLower)
+	if err != nil {
+		return nil, err
+	}
+	r.fields, err = denyList(DefaultFields, opt.Fields, opt.Mask, strings.ToLower)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// denyList maps the names of dfl and more, normalized by norm, to their
+// masks
+func denyList(dfl, more []string, mask string, norm func(string) string) (map[string]string, error) {
+	l := map[string]string{}
+	for _, name := range dfl {
+		l[norm(name)] = mask
+	}
+	for _, entry := range more {
+		name, m := strings.TrimSpace(entry), mask
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			name, m = name[:i], name[i+1:]
+			if !validMask(m) {
+				return nil, errors.Errorf("unknown redaction mask %q", entry)
+			}
+		}
+		if name != "" {
+			l[norm(name)] = m
+		}
+	}
+	return l, nil
+}
+
+func validMask(m string) bool {
+	return m == MaskFull || m == MaskPartial || m == MaskHash
+}
+
+// mask masks v the way m says
+func mask(m, v string) string {
+	switch {
+	case v == "":
+		return ""
+	case m == MaskHash:
+		sum := sha256.Sum256([]byte(v))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	case m == MaskPartial && len(v) > 8:
+		return "****" + v[len(v)-4:]
+	}
+	return redacted
+}
+
+// Header returns a copy of h with the denied headers masked
+func (r *Redactor) Header(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for name, values := range h {
+		m, deny := r.headers[http.CanonicalHeaderKey(name)]
+		c[name] = make([]string, len(values))
+		for i, v := range values {
+			if deny {
+				v = mask(m, v)
+			}
+			c[name][i] = v
+		}
+	}
+	return c
+}
+
+// URL returns s, a URL or request URI, with the denied query parameters
+// masked
+func (r *Redactor) URL(s string) string {
+	i := strings.Index(s, "?")
+	if i < 0 {
+		return s
+	}
+	base, query := s[:i], s[i+1:]
+	fragment := ""
+	if j := strings.Index(query, "#"); j >= 0 {
+		query, fragment = query[:j], query[j:]
+	}
+	return base + "?" + r.Query(query) + fragment
+}
+
+// Query returns the raw query (or form) q with the denied parameters
+// masked, in their order and otherwise as they were
+func (r *Redactor) Query(q string) string {
+	pairs := strings.Split(q, "&")
+	for i, pair := range pairs {
+		j := strings.Index(pair, "=")
+		if j < 0 {
+			continue
+		}
+		name, err := url.QueryUnescape(pair[:j])
+		if err != nil {
+			name = pair[:j]
+		}
+		if m, deny := r.query[strings.ToLower(name)]; deny {
+			value, err := url.QueryUnescape(pair[j+1:])
+			if err != nil {
+				value = pair[j+1:]
+			}
+			pairs[i] = pair[:j+1] + mask(m, value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// JSON returns the JSON document b with the denied fields masked, at any
+// depth. It returns an error if b isn't JSON.
+func (r *Redactor) JSON(b []byte) ([]byte, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber() // as they were
+	if err := d.Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "cannot redact JSON")
+	}
+	return json.Marshal(r.value(doc))
+}
+
+// value returns the JSON value v with the denied fields masked
+func (r *Redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if m, deny := r.fields[strings.ToLower(name)]; deny {
+				if s, ok := field.(string); ok {
+					v[name] = mask(m, s)
+				} else {
+					v[name] = redacted
+				}
+				continue
+			}
+			v[name] = r.value(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = r.value(v[i])
+		}
+	}
+	return v
+}
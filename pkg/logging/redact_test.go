@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactOptions{
+		Headers: []string{"X-Session:hash"},
+		Query:   []string{"sig:partial"},
+		Fields:  []string{"pin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := r.Header(http.Header{
+		"Authorization": {"Bearer s3cret"},
+		"X-Session":     {"abc"},
+		"Accept":        {"text/html"},
+	})
+	assert.Equal(t, http.Header{
+		"Authorization": {"[REDACTED]"},
+		"X-Session":     {"sha256:ba7816bf8f01"},
+		"Accept":        {"text/html"},
+	}, h)
+
+	// test data
+	var tests = []struct {
+		url  string
+		want string
+	}{
+		{"/hello", "/hello"},
+		{"/hello?x=1", "/hello?x=1"},
+		{"/hello?x=1&Token=s3cret&y=%20", "/hello?x=1&Token=[REDACTED]&y=%20"},
+		{"/cb?code=abc&sig=0123456789abcdef#top", "/cb?code=[REDACTED]&sig=****cdef#top"},
+		{"/cb?sig=short&access%5Ftoken=s3cret", "/cb?sig=[REDACTED]&access%5Ftoken=[REDACTED]"},
+		{"https://example.com/login?password=s3cret", "https://example.com/login?password=[REDACTED]"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, r.URL(tt.url), tt.url)
+	}
+
+	j, err := r.JSON([]byte(`{"user": "bob", "password": "s3cret", "id": 12345678901234567890,
+		"cards": [{"pin": 1234, "Token": "abc"}], "nested": {"secret": {"a": 1}}}`))
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"user": "bob", "password": "[REDACTED]", "id": 12345678901234567890,
+			"cards": [{"pin": "[REDACTED]", "Token": "[REDACTED]"}], "nested": {"secret": "[REDACTED]"}}`, string(j))
+	}
+	_, err = r.JSON([]byte("password=s3cret"))
+	assert.Error(t, err)
+}
+
+func TestNewRedactorErrors(t *testing.T) {
+	_, err := NewRedactor(RedactOptions{Mask: "blur"})
+	assert.Error(t, err)
+	_, err = NewRedactor(RedactOptions{Headers: []string{"X-Session:blur"}})
+	assert.Error(t, err)
+	_, err = NewRedactor(RedactOptions{Mask: MaskPartial, Fields: []string{"pin:hash"}})
+	assert.NoError(t, err)
+}
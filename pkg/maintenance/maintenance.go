@@ -0,0 +1,260 @@
+/*
+Package maintenance implements a library to take an instance out of
+rotation without stopping it. While maintenance mode is on the readiness
+probe fails with the reason, so Kubernetes stops sending traffic, and the
+public routes can optionally serve a rendered maintenance page.
+
+Maintenance mode is switched with the admin endpoint:
+
+	# turn it on
+	curl -H "Authorization: Bearer $ADMIN_TOKEN" \
+		-d '{"enabled": true, "reason": "database maintenance"}' \
+		localhost:8000/admin/maintenance
+
+	# and off again
+	curl -H "Authorization: Bearer $ADMIN_TOKEN" \
+		-d '{"enabled": false}' localhost:8000/admin/maintenance
+
+or by sending the process a SIGUSR1, which toggles it.
+*/
+package maintenance
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTemplate   = "maintenance.html"
+	defaultRetryAfter = 5 * time.Minute
+	defaultReason     = "maintenance"
+)
+
+var (
+	// paths that keep working during maintenance so probes, metrics and
+	// the admin endpoint itself stay reachable.
+	dflExempt = []string{
+		"/healthz", "/livez", "/livez/", "/readyz", "/readyz/",
+		"/metrics", "/slo", "/debug/stats", "/debug/traces", "/info",
+		"/admin/", "/public/",
+	}
+)
+
+// Mode holds the maintenance state of this instance. It is safe for
+// concurrent use.
+type Mode struct {
+	mu      sync.RWMutex
+	enabled bool
+	reason  string
+	since   time.Time
+}
+
+// Status describes the current maintenance state
+type Status struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// New returns a new Mode with maintenance switched off
+func New() *Mode {
+	return &Mode{}
+}
+
+// Enable switches maintenance mode on
+func (m *Mode) Enable(reason string) {
+	if reason == "" {
+		reason = defaultReason
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.enabled {
+		m.since = time.Now().UTC()
+	}
+	m.enabled = true
+	m.reason = reason
+}
+
+// Disable switches maintenance mode off and restores normal serving
+func (m *Mode) Disable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = false
+	m.reason = ""
+	m.since = time.Time{}
+}
+
+// Toggle flips maintenance mode and reports whether it is now on
+func (m *Mode) Toggle(reason string) bool {
+	if reason == "" {
+		reason = defaultReason
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.enabled {
+		m.enabled = false
+		m.reason = ""
+		m.since = time.Time{}
+		return false
+	}
+	m.enabled = true
+	m.reason = reason
+	m.since = time.Now().UTC()
+	return true
+}
+
+// Enabled reports whether maintenance mode is on
+func (m *Mode) Enabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.enabled
+}
+
+// Status returns a snapshot of the maintenance state
+func (m *Mode) Status() Status {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := Status{
+		Enabled: m.enabled,
+		Reason:  m.reason,
+	}
+	if m.enabled {
+		since := m.since
+		s.Since = &since
+	}
+	return s
+}
+
+// Check is a readiness check. It returns an error carrying the reason
+// while maintenance mode is on.
+func (m *Mode) Check() error {
+	s := m.Status()
+	if s.Enabled {
+		return errors.Errorf("maintenance: %s", s.Reason)
+	}
+	return nil
+}
+
+// Handler serves the admin endpoint. GET returns the current status,
+// POST/PUT with a JSON body of {"enabled": bool, "reason": string}
+// switches maintenance mode. It must be wrapped with admin.Authorize.
+func (m *Mode) Handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var s Status
+		err := json.NewDecoder(r.Body).Decode(&s)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "invalid request body").Error(), http.StatusBadRequest)
+			return
+		}
+		if s.Enabled {
+			m.Enable(s.Reason)
+		} else {
+			m.Disable()
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	j, err := json.Marshal(m.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// HandlerFunc returns the admin HTTP Handler.
+func (m *Mode) HandlerFunc() http.Handler {
+	return http.HandlerFunc(m.Handler)
+}
+
+// Options describes the maintenance middleware options
+type Options struct {
+	Render     *tmpl.Render  // renders the maintenance page; nil keeps public routes serving
+	Template   string        // = "maintenance.html"
+	RetryAfter time.Duration // = 5 minutes
+	Exempt     []string      // paths never blocked, or prefixes when they end in "/"
+}
+
+// Middleware is Negroni middleware that serves the maintenance page on
+// public routes while maintenance mode is on.
+type Middleware struct {
+	mode *Mode
+	opts Options
+}
+
+// NewMiddleware returns a new instance of maintenance middleware for Negroni.
+func NewMiddleware(m *Mode, opts ...Options) *Middleware {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+
+	if opt.Template == "" {
+		opt.Template = defaultTemplate
+	}
+	if opt.RetryAfter <= 0 {
+		opt.RetryAfter = defaultRetryAfter
+	}
+	if opt.Exempt == nil {
+		opt.Exempt = dflExempt
+	}
+
+	return &Middleware{mode: m, opts: opt}
+}
+
+// Negroni middleware to serve the maintenance page
+func (mw *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if mw.opts.Render == nil || mw.exempt(r.URL.Path) {
+		next(rw, r)
+		return
+	}
+
+	s := mw.mode.Status()
+	if !s.Enabled {
+		next(rw, r)
+		return
+	}
+
+	// page data to render page
+	data := map[string]interface{}{
+		"title":  "Maintenance",
+		"Reason": s.Reason,
+		"Since":  s.Since,
+	}
+
+	// render page template
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Retry-After", strconv.Itoa(int(mw.opts.RetryAfter/time.Second)))
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	err := mw.opts.Render.TemplateContext(r.Context(), rw, mw.opts.Template, data)
+	if err != nil {
+		// the status is already written, so fall back to plain text
+		io.WriteString(rw, http.StatusText(http.StatusServiceUnavailable))
+	}
+}
+
+// exempt reports whether path is never blocked by maintenance mode
+func (mw *Middleware) exempt(path string) bool {
+	for _, p := range mw.opts.Exempt {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+func TestMode(t *testing.T) {
+	m := New()
+
+	// off by default
+	assert.False(t, m.Enabled())
+	assert.NoError(t, m.Check())
+
+	m.Enable("database upgrade")
+	assert.True(t, m.Enabled())
+	assert.EqualError(t, m.Check(), "maintenance: database upgrade")
+	assert.NotNil(t, m.Status().Since)
+
+	// toggle back off
+	assert.False(t, m.Toggle(""))
+	assert.NoError(t, m.Check())
+	assert.Nil(t, m.Status().Since)
+
+	// toggle on with the default reason
+	assert.True(t, m.Toggle(""))
+	assert.Equal(t, defaultReason, m.Status().Reason)
+
+	// concurrent toggles each flip it once
+	m.Disable()
+	var wg sync.WaitGroup
+	var on int32
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m.Toggle("") {
+				atomic.AddInt32(&on, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(50), on)
+	assert.False(t, m.Enabled())
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+
+	// test data
+	var tests = []struct {
+		method  string
+		body    string
+		status  int
+		enabled bool
+	}{
+		{"GET", "", http.StatusOK, false},
+		{"POST", `{"enabled": true, "reason": "db"}`, http.StatusOK, true},
+		{"GET", "", http.StatusOK, true},
+		{"POST", `not json`, http.StatusBadRequest, true},
+		{"PUT", `{"enabled": false}`, http.StatusOK, false},
+		{"DELETE", "", http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/admin/maintenance", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		m.HandlerFunc().ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s %s: got %v want %v", tt.method, tt.body, status, tt.status)
+		}
+		assert.Equal(t, tt.enabled, m.Enabled())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+
+	n := negroni.New()
+	n.Use(NewMiddleware(m, Options{
+		Render: tmpl.New(tmpl.Options{TemplateDirectory: "../../templates"}),
+	}))
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		n.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// normal serving
+	rr := serve("/")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+
+	// public routes serve the maintenance page
+	m.Enable("database upgrade")
+	rr = serve("/")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "300", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), "database upgrade")
+
+	// probes keep working
+	rr = serve("/healthz")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("/admin/maintenance")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// switching back restores normal serving
+	m.Disable()
+	rr = serve("/")
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -5,7 +5,34 @@ It is best practice to provide an endpoint for instrumentation tools
 middleware like the negroni.Loggermiddleware (after negroni.Recovery,
 before every other middleware).
 
-You also need to implement a corresponding route to expose the metrics:
+Metrics are registered with the Registerer passed in the Options, so
+several instances (e.g. public and admin) can live side by side:
+
+	m, err := metrics.New(metrics.Options{
+		Registerer: prometheus.NewRegistry(),
+		Namespace:  "myapp",
+		Host:       info.Report.HostName,
+		Service:    info.Report.Program,
+	})
+
+Per-route SLOs can be tracked as well, exporting the error budget left
+and multi-window burn rates as gauges. SLOHandler serves their current
+standing as JSON or HTML:
+
+	slos, err := metrics.LoadSLOs("slo.json")
+	m, err := metrics.New(metrics.Options{SLOs: slos})
+	r.Handler("GET", "/slo", m.SLOHandler(handlers.Render))
+
+The middleware also keeps live stats (uptime, request rate, status codes
+and p50/p95/p99 latency per route) for a dashboard that works without
+Prometheus:
+
+	r.Handler("GET", "/debug/stats", m.StatsHandler(handlers.Render))
+
+You also need to implement a corresponding route to expose the metrics,
+serving the registry the middleware registered with. Enable OpenMetrics
+so scrapers that negotiate it get the trace exemplars on our latency
+histograms:
 
 	import (
 		"github.com/julienschmidt/httprouter"
@@ -18,11 +45,12 @@ You also need to implement a corresponding route to expose the metrics:
 		r := httprouter.New()
 
 		// Prometheus metrics
-		r.Handler("GET", "/metrics", promhttp.Handler())
+		r.Handler("GET", "/metrics", promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}))
 
 		return r
 	}
-
 */
 package metrics
 
@@ -32,87 +60,482 @@ package metrics
 // other middleware.
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/urfave/negroni"
 )
 
 var (
-	dflBuckets = []float64{.25, .5, 1, 2.5, 5, 10}
+	// latency buckets are in seconds
+	dflLatencyBuckets = prometheus.DefBuckets
+
+	// size buckets are in bytes
+	dflSizeBuckets = []float64{1000, 5000, 10000, 500000}
+
+	// labels partitioning our request metrics
+	labels = []string{"code", "class", "method", "route"}
+
+	// labels partitioning our size and cancellation metrics
+	sizeLabels = []string{"method", "route"}
+
+	// labels partitioning our in-flight requests
+	routeLabels = []string{"route"}
+
+	// methods we label as themselves, anything else is "other"
+	methods = map[string]bool{
+		"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+		"DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true,
+	}
 )
 
 const (
 	reqsName    = "requests_total"
-	reqsHelp    = "HTTP requests processed, partitioned by status code, method and HTTP path."
-	latencyName = "request_duration_milliseconds"
-	latencyHelp = "How long it took to process the request, partitioned by status code, method and HTTP path."
+	reqsHelp    = "HTTP requests processed, partitioned by status code, status class, method and route pattern."
+	latencyName = "request_duration_seconds"
+	latencyHelp = "How long it took to process the request in seconds, partitioned by status code, status class, method and route pattern."
+	sizeName    = "response_size_bytes"
+	sizeHelp    = "A histogram of response sizes in bytes, partitioned by method and route pattern."
+	reqSizeName = "request_size_bytes"
+	reqSizeHelp = "A histogram of request body sizes in bytes, partitioned by method and route pattern."
+
+	inflightName = "requests_in_flight"
+	inflightHelp = "HTTP requests currently being served, partitioned by route pattern."
+	canceledName = "http_requests_canceled_total"
+	canceledHelp = "HTTP requests whose client disconnected before the handler finished, partitioned by method and route pattern."
+
+	// StatsD names, timers are in milliseconds
+	statsdReqsName     = "requests"
+	statsdLatencyName  = "request_duration_ms"
+	statsdCanceledName = "requests_canceled"
+
+	// exemplar label linking a latency observation to its trace
+	exemplarLabel = "trace_id"
 )
 
+// Options describes the metrics options
+type Options struct {
+	// Registerer our metrics are registered with. A fresh registry is
+	// used if nil.
+	Registerer prometheus.Registerer
+
+	// Gatherer that serves the metrics, i.e. what '/metrics' should
+	// serve. Defaults to the Registerer if it is also a Gatherer (e.g.
+	// a *prometheus.Registry).
+	Gatherer prometheus.Gatherer
+
+	Namespace string // metric name prefix, e.g. "myapp"
+	Subsystem string // metric name infix, e.g. "http"
+
+	LatencyBuckets []float64 // in seconds, = prometheus.DefBuckets
+	SizeBuckets    []float64 // in bytes, = 1kB, 5kB, 10kB, 500kB
+
+	Host        string            // "host" constant label
+	Service     string            // "service" constant label
+	ConstLabels prometheus.Labels // extra constant labels
+
+	// Labels is an allowlist of the request labels to use out of code,
+	// class, method and route. All of them are used if empty.
+	Labels []string
+
+	// Runtime registers the Go runtime and process collectors as well.
+	// Leave it off for the global registry, which already has them.
+	Runtime bool
+
+	// TraceID returns the ID of the sampled trace in ctx, if any. When
+	// set, latency observations carry it as an OpenMetrics exemplar so a
+	// latency spike links straight to a trace (see tracing.TraceID).
+	TraceID func(ctx context.Context) (string, bool)
+
+	// StatsD emits our request metrics to a StatsD agent as well, with
+	// the request labels as tags (see NewStatsD).
+	StatsD *StatsD
+
+	// SLOs to track per route, exported as objective, SLI, error budget
+	// and burn rate gauges (see LoadSLOs).
+	SLOs []SLO
+}
+
 // Metrics holds our prometheus metrics buckets
 type Metrics struct {
-	reqs    *prometheus.CounterVec
-	latency *prometheus.HistogramVec
-	size    *prometheus.HistogramVec
+	reqs     *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	reqSize  *prometheus.HistogramVec
+	inflight *prometheus.GaugeVec
+	canceled *prometheus.CounterVec
+	gatherer prometheus.Gatherer
+	traceID  func(ctx context.Context) (string, bool)
+	slo      *sloCollector
+	stats    *liveStats
+	statsd   *StatsD
+
+	// allowed label names of each metric
+	labels      map[string]bool
+	reqLabels   []string
+	sizeLabels  []string
+	routeLabels []string
 }
 
-// NewMetrics returns a new instance of prometheus middleware for Negroni.
+// NewMetrics returns a new instance of prometheus middleware for Negroni
+// registered with the global prometheus registry. Latency buckets are in
+// seconds. It panics if the metrics are already registered, use New to
+// register with a registry of your own.
 func NewMetrics(host string, service string, buckets ...float64) *Metrics {
+	m, err := New(Options{
+		Registerer:     prometheus.DefaultRegisterer,
+		Gatherer:       prometheus.DefaultGatherer,
+		Host:           host,
+		Service:        service,
+		LatencyBuckets: buckets,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// New returns a new instance of prometheus middleware for Negroni
+// registered with opts.Registerer.
+func New(opts Options) (*Metrics, error) {
 	var m Metrics
 
+	if opts.Registerer == nil {
+		reg := prometheus.NewRegistry()
+		opts.Registerer, opts.Gatherer = reg, reg
+	}
+	if opts.Gatherer == nil {
+		g, ok := opts.Registerer.(prometheus.Gatherer)
+		if !ok {
+			return nil, errors.New("metrics: a Gatherer is required when the Registerer is not one")
+		}
+		opts.Gatherer = g
+	}
+	m.gatherer = opts.Gatherer
+	m.traceID = opts.TraceID
+	m.stats = newLiveStats()
+	m.statsd = opts.StatsD
+
+	if len(opts.LatencyBuckets) == 0 {
+		opts.LatencyBuckets = dflLatencyBuckets
+	}
+	if len(opts.SizeBuckets) == 0 {
+		opts.SizeBuckets = dflSizeBuckets
+	}
+
+	// constant labels
+	constLabels := prometheus.Labels{}
+	for k, v := range opts.ConstLabels {
+		constLabels[k] = v
+	}
+	if opts.Host != "" {
+		constLabels["host"] = opts.Host
+	}
+	if opts.Service != "" {
+		constLabels["service"] = opts.Service
+	}
+
+	// request labels
+	if len(opts.Labels) == 0 {
+		opts.Labels = labels
+	}
+	m.labels = make(map[string]bool)
+	for _, l := range opts.Labels {
+		if !contains(labels, l) {
+			return nil, errors.Errorf("metrics: unknown label %q", l)
+		}
+		m.labels[l] = true
+	}
+	m.reqLabels = m.allowed(labels)
+	m.sizeLabels = m.allowed(sizeLabels)
+	m.routeLabels = m.allowed(routeLabels)
+
 	// requests
 	m.reqs = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
 			Name:        reqsName,
 			Help:        reqsHelp,
-			ConstLabels: prometheus.Labels{"host": host, "service": service},
+			ConstLabels: constLabels,
 		},
-		[]string{"code", "method", "path"},
+		m.reqLabels,
 	)
-	prometheus.MustRegister(m.reqs)
 
 	// latency
-	if len(buckets) == 0 {
-		buckets = dflBuckets
-	}
 	m.latency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
 			Name:        latencyName,
 			Help:        latencyHelp,
-			ConstLabels: prometheus.Labels{"host": host, "service": service},
-			Buckets:     buckets,
+			ConstLabels: constLabels,
+			Buckets:     opts.LatencyBuckets,
 		},
-		[]string{"code", "method", "path"},
+		m.reqLabels,
 	)
-	prometheus.MustRegister(m.latency)
 
-	// responseSize has no labels, making it a zero-dimensional ObserverVec.
+	// response size
 	m.size = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:        "response_size_bytes",
-			Help:        "A histogram of response sizes for requests.",
-			ConstLabels: prometheus.Labels{"host": host, "service": service},
-			Buckets:     []float64{1000, 5000, 10000, 500000},
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        sizeName,
+			Help:        sizeHelp,
+			ConstLabels: constLabels,
+			Buckets:     opts.SizeBuckets,
+		},
+		m.sizeLabels,
+	)
+
+	// request body size
+	m.reqSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        reqSizeName,
+			Help:        reqSizeHelp,
+			ConstLabels: constLabels,
+			Buckets:     opts.SizeBuckets,
+		},
+		m.sizeLabels,
+	)
+
+	// in-flight requests
+	m.inflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        inflightName,
+			Help:        inflightHelp,
+			ConstLabels: constLabels,
 		},
-		[]string{},
+		m.routeLabels,
 	)
-	prometheus.MustRegister(m.size)
 
-	return &m
+	// requests canceled by the client
+	m.canceled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        canceledName,
+			Help:        canceledHelp,
+			ConstLabels: constLabels,
+		},
+		m.sizeLabels,
+	)
+
+	collectors := []prometheus.Collector{m.reqs, m.latency, m.size, m.reqSize, m.inflight, m.canceled}
+	if len(opts.SLOs) > 0 {
+		trackers, err := newSLOTrackers(opts.SLOs)
+		if err != nil {
+			return nil, err
+		}
+		m.slo = newSLOCollector(trackers, opts, constLabels)
+		collectors = append(collectors, m.slo)
+	}
+	if opts.Runtime {
+		collectors = append(collectors,
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{Namespace: opts.Namespace}),
+		)
+	}
+	for _, c := range collectors {
+		if err := opts.Registerer.Register(c); err != nil {
+			return nil, errors.Wrap(err, "metrics: registration failed")
+		}
+	}
+
+	return &m, nil
+}
+
+// Gatherer returns the registry our metrics are served from
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.gatherer
 }
 
 // Negroni middleware to capture prometheus stats
 func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	start := time.Now()
 
+	// the router records the matched route pattern on the request, the
+	// request is in flight from the moment we know its route
+	r = route.New(r)
+	var inflight prometheus.Gauge
+	m.stats.begin()
+	route.OnSet(r, func(pattern string) {
+		inflight = m.inflight.WithLabelValues(labelValues(m.routeLabels, map[string]string{"route": pattern})...)
+		inflight.Inc()
+		n := m.stats.matched(pattern)
+		if m.statsd != nil {
+			m.statsd.Gauge(inflightName, float64(n), tags(m.routeLabels, map[string]string{"route": pattern})...)
+		}
+	})
+
+	// count the request body as the handler reads it
+	body := &countingBody{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+
+	// the handler may panic, to be recovered further out into a 500: it
+	// is counted as one, and is no longer in flight
+	done := false
+	defer func() {
+		code := rw.(negroni.ResponseWriter).Status()
+		if !done {
+			code = http.StatusInternalServerError
+		}
+		m.observe(rw, r, body, start, inflight, code)
+	}()
+
 	next(rw, r)
+	done = true
+}
+
+// observe records the request r served with code
+func (m *Metrics) observe(rw http.ResponseWriter, r *http.Request, body *countingBody, start time.Time, inflight prometheus.Gauge, code int) {
+	if inflight != nil {
+		inflight.Dec()
+	}
 
+	elapsed := time.Since(start)
 	res := rw.(negroni.ResponseWriter)
-	status := http.StatusText(res.Status())
+	codeLabel, class := status(code)
+	pattern := route.Pattern(r)
+	if pattern == "" {
+		pattern = route.Other
+	}
+	values := map[string]string{
+		"code":   codeLabel,
+		"class":  class,
+		"method": normalizeMethod(r.Method),
+		"route":  pattern,
+	}
+	lv := labelValues(m.reqLabels, values)
+	sv := labelValues(m.sizeLabels, values)
 
 	// captures metrics
-	m.reqs.WithLabelValues(status, r.Method, r.URL.Path).Inc()
-	m.latency.WithLabelValues(status, r.Method, r.URL.Path).Observe(float64(time.Since(start).Nanoseconds()) / 1000000)
-	m.size.WithLabelValues().Observe(float64(res.Size()))
+	m.reqs.WithLabelValues(lv...).Inc()
+	m.observeLatency(r.Context(), m.latency.WithLabelValues(lv...), elapsed.Seconds())
+	m.size.WithLabelValues(sv...).Observe(float64(res.Size()))
+	m.reqSize.WithLabelValues(sv...).Observe(float64(requestSize(r, body)))
+	if r.Context().Err() == context.Canceled {
+		m.canceled.WithLabelValues(sv...).Inc()
+	}
+	if m.slo != nil {
+		m.slo.observe(pattern, code, elapsed)
+	}
+	n := m.stats.end(pattern, inflight != nil, code, elapsed)
+
+	// the same metrics for StatsD
+	if m.statsd != nil {
+		lt, st := tags(m.reqLabels, values), tags(m.sizeLabels, values)
+		m.statsd.Count(statsdReqsName, 1, lt...)
+		m.statsd.Timing(statsdLatencyName, elapsed, lt...)
+		m.statsd.Histogram(sizeName, float64(res.Size()), st...)
+		m.statsd.Histogram(reqSizeName, float64(requestSize(r, body)), st...)
+		if inflight != nil {
+			m.statsd.Gauge(inflightName, float64(n), tags(m.routeLabels, values)...)
+		}
+		if r.Context().Err() == context.Canceled {
+			m.statsd.Count(statsdCanceledName, 1, st...)
+		}
+	}
+}
+
+// observeLatency observes v, attaching the trace ID in ctx as an exemplar
+// if there is a sampled trace.
+func (m *Metrics) observeLatency(ctx context.Context, o prometheus.Observer, v float64) {
+	if m.traceID != nil {
+		if id, ok := m.traceID(ctx); ok {
+			if eo, ok := o.(prometheus.ExemplarObserver); ok {
+				eo.ObserveWithExemplar(v, prometheus.Labels{exemplarLabel: id})
+				return
+			}
+		}
+	}
+	o.Observe(v)
+}
+
+// allowed returns the labels out of list that are in the allowlist
+func (m *Metrics) allowed(list []string) []string {
+	names := []string{}
+	for _, l := range list {
+		if m.labels[l] {
+			names = append(names, l)
+		}
+	}
+	return names
+}
+
+// labelValues returns the values of names in order
+func labelValues(names []string, values map[string]string) []string {
+	lv := make([]string, 0, len(names))
+	for _, l := range names {
+		lv = append(lv, values[l])
+	}
+	return lv
+}
+
+// tags returns the values of names as "name:value" tags
+func tags(names []string, values map[string]string) []string {
+	t := make([]string, 0, len(names))
+	for _, l := range names {
+		t = append(t, l+":"+values[l])
+	}
+	return t
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// requestSize returns the size of the request body, which is its
+// Content-Length unless the handler read more than that (e.g. chunked)
+func requestSize(r *http.Request, body *countingBody) int64 {
+	if r.ContentLength > body.n {
+		return r.ContentLength
+	}
+	return body.n
+}
+
+// status returns the numeric status code and its class (e.g. "2xx").
+// A handler that never wrote anything sent a 200.
+func status(code int) (string, string) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return strconv.Itoa(code), strconv.Itoa(code/100) + "xx"
+}
+
+// normalizeMethod bounds the method label to the standard methods
+func normalizeMethod(method string) string {
+	if methods[method] {
+		return method
+	}
+	return route.Other
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
 }
@@ -1,13 +1,16 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
-	// "github.com/prometheus/client_golang/prometheus"
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
 )
@@ -15,16 +18,21 @@ import (
 func TestLogger(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
+	// a registry of its own, so the test can run more than once
+	reg := prometheus.NewRegistry()
+	m, err := New(Options{Registerer: reg, Host: "test host", Service: "test service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	n := negroni.New()
-	m := NewMetrics("test host", "test service")
 	n.Use(m)
-	// n.Use(negroni.Wrap(Capture(m)))
 	r := http.NewServeMux()
-	r.Handle("/metrics", promhttp.Handler())
-	r.HandleFunc(`/ok`, func(w http.ResponseWriter, r *http.Request) {
+	r.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	r.Handle(`/ok`, route.Handler("/ok", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "ok")
-	})
+	})))
 	n.UseHandler(r)
 
 	req1, err := http.NewRequest("GET", "http://localhost:3000/ok", nil)
@@ -36,7 +44,13 @@ func TestLogger(t *testing.T) {
 		t.Error(err)
 	}
 
+	req3, err := http.NewRequest("GET", "http://localhost:3000/nonexistant/1", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
 	n.ServeHTTP(recorder, req1)
+	n.ServeHTTP(httptest.NewRecorder(), req3)
 	n.ServeHTTP(recorder, req2)
 	body := recorder.Body.String()
 	if !strings.Contains(body, reqsName) {
@@ -45,4 +59,233 @@ func TestLogger(t *testing.T) {
 	if !strings.Contains(body, latencyName) {
 		t.Errorf("body does not contain request duration entry '%s'", reqsName)
 	}
+
+	// requests are labelled by route pattern and numeric status
+	for _, label := range []string{
+		`class="2xx",code="200"`,
+		`method="GET",route="/ok"`,
+		`class="4xx",code="404"`,
+		`method="GET",route="other"`,
+	} {
+		if !strings.Contains(body, label) {
+			t.Errorf("body does not contain labels '%s'", label)
+		}
+	}
+	if strings.Contains(body, "nonexistant") {
+		t.Errorf("unmatched paths should be reported as '%s'", route.Other)
+	}
+}
+
+func TestStatus(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		status int
+		code   string
+		class  string
+	}{
+		{0, "200", "2xx"},
+		{200, "200", "2xx"},
+		{301, "301", "3xx"},
+		{404, "404", "4xx"},
+		{503, "503", "5xx"},
+	}
+
+	for _, tt := range tests {
+		code, class := status(tt.status)
+		if code != tt.code || class != tt.class {
+			t.Errorf("status %d: got %s %s want %s %s", tt.status, code, class, tt.code, tt.class)
+		}
+	}
+
+	if m := normalizeMethod("GET"); m != "GET" {
+		t.Errorf("method GET: got %s", m)
+	}
+	if m := normalizeMethod("BREW"); m != route.Other {
+		t.Errorf("method BREW: got %s want %s", m, route.Other)
+	}
+}
+
+func TestNew(t *testing.T) {
+
+	// two instances with their own registries
+	for i := 0; i < 2; i++ {
+		m, err := New(Options{
+			Namespace:      "test",
+			Subsystem:      "http",
+			LatencyBuckets: []float64{.1, 1},
+			ConstLabels:    prometheus.Labels{"zone": "a"},
+			Labels:         []string{"code", "route"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := negroni.New()
+		n.Use(m)
+		r := http.NewServeMux()
+		r.Handle("/metrics", promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}))
+		n.UseHandler(r)
+
+		req, err := http.NewRequest("GET", "http://localhost:3000/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ServeHTTP(httptest.NewRecorder(), req)
+		recorder := httptest.NewRecorder()
+		n.ServeHTTP(recorder, req)
+		body := recorder.Body.String()
+
+		for _, s := range []string{
+			`test_http_requests_total{code="200",route="other",zone="a"} 1`,
+			`test_http_request_duration_seconds_bucket{code="200",route="other",zone="a",le="0.1"} 1`,
+		} {
+			if !strings.Contains(body, s) {
+				t.Errorf("body does not contain '%s'", s)
+			}
+		}
+		if strings.Contains(body, `method=`) {
+			t.Errorf("body contains a label that is not allowed")
+		}
+	}
+
+	// registering twice with the same registry is an error, not a panic
+	reg := prometheus.NewRegistry()
+	_, err := New(Options{Registerer: reg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(Options{Registerer: reg})
+	if err == nil {
+		t.Error("expected a registration error")
+	}
+
+	// unknown labels are an error
+	_, err = New(Options{Labels: []string{"path"}})
+	if err == nil {
+		t.Error("expected an unknown label error")
+	}
+}
+
+func TestRED(t *testing.T) {
+	m, err := New(Options{Runtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.Use(m)
+	r := http.NewServeMux()
+	r.Handle("/metrics", promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}))
+	r.Handle("/upload", route.Handler("/upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, "ok")
+	})))
+	r.Handle("/slow", route.Handler("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// report the in-flight gauge while we are in flight
+		rr := httptest.NewRecorder()
+		promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}).ServeHTTP(rr, r)
+		if !strings.Contains(rr.Body.String(), `requests_in_flight{route="/slow"} 1`) {
+			t.Errorf("request is not in flight")
+		}
+	})))
+	n.UseHandler(r)
+
+	// upload a body
+	req, err := http.NewRequest("POST", "http://localhost:3000/upload", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	// a canceled request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err = http.NewRequest("GET", "http://localhost:3000/slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	req, err = http.NewRequest("GET", "http://localhost:3000/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	body := recorder.Body.String()
+
+	for _, s := range []string{
+		`request_size_bytes_sum{method="POST",route="/upload"} 11`,
+		`response_size_bytes_sum{method="POST",route="/upload"} 2`,
+		`requests_in_flight{route="/slow"} 0`,
+		`http_requests_canceled_total{method="GET",route="/slow"} 1`,
+		`go_goroutines`,
+		`process_`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body does not contain '%s'", s)
+		}
+	}
+}
+
+func TestPanic(t *testing.T) {
+	m, err := New(Options{SLOs: []SLO{{Route: "/panic", Objective: 0.9}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a panicking handler is recovered outside of our middleware
+	n := negroni.New(negroni.NewRecovery())
+	n.Use(m)
+	n.UseHandler(route.Handler("/panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+
+	recorder := httptest.NewRecorder()
+	promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, s := range []string{
+		`requests_in_flight{route="/panic"} 0`,
+		`requests_total{class="5xx",code="500",method="GET",route="/panic"} 1`,
+		`slo_sli_ratio{route="/panic",slo="/panic-availability"} 0`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body does not contain '%s'", s)
+		}
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	m, err := New(Options{
+		TraceID: func(ctx context.Context) (string, bool) { return "4bf92f3577b34da6", true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.Use(m)
+	r := http.NewServeMux()
+	r.Handle("/metrics", promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	n.UseHandler(r)
+
+	req, err := http.NewRequest("GET", "http://localhost:3000/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	n.ServeHTTP(httptest.NewRecorder(), req)
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	body := recorder.Body.String()
+
+	if !strings.Contains(recorder.Header().Get("Content-Type"), "application/openmetrics-text") {
+		t.Errorf("OpenMetrics was not negotiated: %s", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, `# {trace_id="4bf92f3577b34da6"}`) {
+		t.Errorf("body does not contain a trace exemplar")
+	}
 }
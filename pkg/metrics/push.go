@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/info"
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Counter increments since the last scrape are lost when an instance
+// shuts down, and batch-mode runs may not live long enough to be scraped
+// at all. A Pusher pushes the registry to a Pushgateway instead:
+//
+//	p, err := metrics.NewPusher(m.Gatherer(), metrics.PushOptions{
+//		URL:      "http://pushgateway:9091",
+//		Interval: 30 * time.Second, // batch mode, 0 pushes on Stop only
+//	})
+//	p.Start()
+//
+// The grouping labels must not be labels of the metrics pushed, e.g. the
+// version of go_info, so our version goes in service_version.
+//	s.OnShutdown(func() { p.Stop() })
+
+const (
+	dflPushTimeout = 10 * time.Second
+)
+
+var logger = logging.Named("metrics")
+
+// PushOptions describes the Pushgateway options
+type PushOptions struct {
+	URL      string            // Pushgateway URL, e.g. "http://pushgateway:9091"
+	Job      string            // = the program name from info.Report
+	Grouping map[string]string // = instance and service_version from info.Report
+	Interval time.Duration     // push interval; only pushes on Stop if zero
+	Timeout  time.Duration     // per push, = 10 seconds
+}
+
+// Pusher pushes a registry to a Pushgateway on an interval and a final
+// time when it is stopped.
+type Pusher struct {
+	opts   PushOptions
+	pusher *push.Pusher
+
+	once sync.Once
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPusher returns a Pusher pushing the metrics gathered by g. It
+// returns an error if a grouping label is a label of those metrics, which
+// the Pushgateway would refuse.
+func NewPusher(g prometheus.Gatherer, opts PushOptions) (*Pusher, error) {
+	if opts.Job == "" {
+		opts.Job = strings.ToLower(info.Report.Program)
+	}
+	if opts.Grouping == nil {
+		opts.Grouping = map[string]string{
+			"instance":        info.Report.HostName,
+			"service_version": info.Report.Version,
+		}
+	}
+	if err := checkGrouping(g, opts.Grouping); err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = dflPushTimeout
+	}
+
+	p := push.New(opts.URL, opts.Job).
+		Gatherer(g).
+		Client(&http.Client{Timeout: opts.Timeout})
+	for k, v := range opts.Grouping {
+		if v != "" {
+			p = p.Grouping(k, v)
+		}
+	}
+
+	return &Pusher{
+		opts:   opts,
+		pusher: p,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// checkGrouping returns an error if one of the grouping labels is a label
+// of the metrics gathered by g
+func checkGrouping(g prometheus.Gatherer, grouping map[string]string) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return errors.Wrap(err, "metrics: cannot gather metrics to push")
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if _, ok := grouping[l.GetName()]; ok {
+					return errors.Errorf("metrics: grouping label %q is a label of %s", l.GetName(), mf.GetName())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Push replaces the metrics of our group on the Pushgateway with the
+// current state of the registry
+func (p *Pusher) Push() error {
+	return errors.Wrap(p.pusher.Push(), "metrics: push failed")
+}
+
+// Start pushes every Interval until Stop is called. Failed pushes are
+// logged and retried on the next tick.
+func (p *Pusher) Start() {
+	if p.opts.Interval <= 0 {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := p.Push(); err != nil {
+					logger.Error("cannot push metrics", "err", err)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops pushing on the interval and pushes the final state of the
+// registry, e.g. during a graceful shutdown.
+func (p *Pusher) Stop() error {
+	p.once.Do(func() { close(p.done) })
+	p.wg.Wait()
+	return p.Push()
+}
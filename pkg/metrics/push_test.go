@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/info"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// gateway is a local stand-in for a Pushgateway
+type gateway struct {
+	mu     sync.Mutex
+	pushes []*http.Request
+	bodies []string
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pushes = append(g.pushes, r)
+	g.bodies = append(g.bodies, string(b))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *gateway) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.pushes)
+}
+
+// grouping returns the grouping labels of a push path, which come in no
+// particular order, e.g. /metrics/job/<job>/<label>/<value>
+func grouping(path string) map[string]string {
+	g := make(map[string]string)
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		g[parts[i]] = parts[i+1]
+	}
+	return g
+}
+
+func TestPusher(t *testing.T) {
+	gw := &gateway{}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs."})
+	reg.MustRegister(c)
+
+	info.Report.Program = "Test"
+	info.Report.HostName = "host1"
+	info.Report.Version = "1.0.0"
+
+	p, err := NewPusher(reg, PushOptions{URL: srv.URL, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+
+	// pushes on the interval
+	deadline := time.Now().Add(time.Second)
+	for gw.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if gw.count() == 0 {
+		t.Fatal("no push on the interval")
+	}
+
+	// and the final state on stop
+	c.Add(3)
+	err = p.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := gw.count()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, n, gw.count(), "pushed after Stop")
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	last := gw.pushes[len(gw.pushes)-1]
+	assert.Equal(t, "PUT", last.Method)
+	assert.Equal(t, map[string]string{"job": "test", "instance": "host1", "service_version": "1.0.0"}, grouping(last.URL.Path))
+	assert.True(t, strings.Contains(gw.bodies[len(gw.bodies)-1], "jobs_total"))
+}
+
+func TestPusherError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	// stop without start only pushes once
+	p, err := NewPusher(prometheus.NewRegistry(), PushOptions{URL: srv.URL, Job: "batch", Grouping: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, p.Stop())
+}
+
+func TestPusherRuntime(t *testing.T) {
+	gw := &gateway{}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	// the registry main pushes, with go_info and its version label
+	m, err := New(Options{Runtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.Report.Version = "1.0.0"
+	p, err := NewPusher(m.Gatherer(), PushOptions{URL: srv.URL, Job: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, p.Stop())
+	if assert.Equal(t, 1, gw.count()) {
+		assert.Contains(t, gw.bodies[0], "go_info")
+	}
+
+	// grouping labels can't be metric labels
+	_, err = NewPusher(m.Gatherer(), PushOptions{URL: srv.URL, Grouping: map[string]string{"version": "1.0.0"}})
+	assert.Error(t, err)
+}
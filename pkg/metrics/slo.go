@@ -0,0 +1,370 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SLOs are declared per route pattern in a JSON file (see LoadSLOs):
+//
+//	[
+//		{"name": "hello-availability", "route": "/hello/:name", "objective": 0.999},
+//		{"name": "index-latency", "route": "/", "objective": 0.99, "latency": "300ms"}
+//	]
+//
+// An SLO without a latency is an availability SLO, where a request is bad
+// if it returned a 5xx. With a latency a request is bad if it took longer.
+// An empty route covers every request. The window is the compliance
+// period the error budget is spent over, 30 days if not set.
+
+const (
+	sloResolution    = time.Minute
+	dflSLOWindow     = 30 * 24 * time.Hour
+	dflSLOTemplate   = "slo.html"
+	sloObjectiveName = "slo_objective_ratio"
+	sloObjectiveHelp = "The SLO target, i.e. the ratio of good requests aimed for."
+	sloSLIName       = "slo_sli_ratio"
+	sloSLIHelp       = "The ratio of good requests over the SLO window."
+	sloBudgetName    = "slo_error_budget_remaining_ratio"
+	sloBudgetHelp    = "The ratio of the error budget left over the SLO window, negative once it is overspent."
+	sloBurnName      = "slo_burn_rate"
+	sloBurnHelp      = "How fast the error budget is being spent over the last window, 1 spends it exactly over the SLO window."
+)
+
+var (
+	// windows we export burn rates over, in pairs for multi-window
+	// alerting (1h/5m, 6h/30m, 1d/2h and 3d/6h)
+	burnWindows = []struct {
+		name string
+		d    time.Duration
+	}{
+		{"5m", 5 * time.Minute},
+		{"30m", 30 * time.Minute},
+		{"1h", time.Hour},
+		{"2h", 2 * time.Hour},
+		{"6h", 6 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"3d", 3 * 24 * time.Hour},
+	}
+)
+
+// SLO describes a service level objective for a route
+type SLO struct {
+	Name      string        // = route + "-availability" or "-latency"
+	Route     string        // route pattern, e.g. "/hello/:name"; all routes if empty
+	Objective float64       // ratio of good requests, e.g. 0.999
+	Latency   time.Duration // latency threshold; availability SLO if zero
+	Window    time.Duration // compliance window, = 30 days
+}
+
+// BurnRate is the burn rate of an error budget over a window
+type BurnRate struct {
+	Window string  `json:"window"`
+	Rate   float64 `json:"rate"`
+}
+
+// SLOStatus describes the current standing of an SLO
+type SLOStatus struct {
+	Name      string     `json:"name"`
+	Route     string     `json:"route"`
+	Objective float64    `json:"objective"`
+	Latency   string     `json:"latency,omitempty"`
+	Window    string     `json:"window"`
+	Total     uint64     `json:"total"`
+	Bad       uint64     `json:"bad"`
+	SLI       float64    `json:"sli"`
+	Budget    float64    `json:"errorBudgetRemaining"`
+	BurnRates []BurnRate `json:"burnRates"`
+	Met       bool       `json:"met"`
+}
+
+// LoadSLOs reads SLO definitions from a JSON file. Latencies and windows
+// are Go durations, e.g. "300ms" or "720h".
+func LoadSLOs(path string) ([]SLO, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "slo: config unavailable")
+	}
+
+	var defs []struct {
+		Name      string  `json:"name"`
+		Route     string  `json:"route"`
+		Objective float64 `json:"objective"`
+		Latency   string  `json:"latency"`
+		Window    string  `json:"window"`
+	}
+	err = json.Unmarshal(b, &defs)
+	if err != nil {
+		return nil, errors.Wrap(err, "slo: invalid config")
+	}
+
+	slos := make([]SLO, 0, len(defs))
+	for _, d := range defs {
+		s := SLO{Name: d.Name, Route: d.Route, Objective: d.Objective}
+		if d.Latency != "" {
+			s.Latency, err = time.ParseDuration(d.Latency)
+			if err != nil {
+				return nil, errors.Wrapf(err, "slo: invalid latency for %q", d.Name)
+			}
+		}
+		if d.Window != "" {
+			s.Window, err = time.ParseDuration(d.Window)
+			if err != nil {
+				return nil, errors.Wrapf(err, "slo: invalid window for %q", d.Name)
+			}
+		}
+		slos = append(slos, s)
+	}
+	return slos, nil
+}
+
+// sloTracker counts good and bad requests of an SLO in per-minute slots
+// over its window, so any trailing window can be summed up.
+type sloTracker struct {
+	SLO
+
+	mu    sync.Mutex
+	total []uint64
+	bad   []uint64
+	slot  []int64 // minute each slot holds, to skip stale ones
+}
+
+// newSLOTrackers validates slos and returns a tracker for each of them
+func newSLOTrackers(slos []SLO) ([]*sloTracker, error) {
+	names := map[string]bool{}
+	trackers := make([]*sloTracker, 0, len(slos))
+	for _, s := range slos {
+		if s.Objective <= 0 || s.Objective >= 1 {
+			return nil, errors.Errorf("metrics: SLO %q objective must be between 0 and 1", s.Name)
+		}
+		if s.Window <= 0 {
+			s.Window = dflSLOWindow
+		}
+		if s.Window < sloResolution {
+			return nil, errors.Errorf("metrics: SLO %q window is shorter than %v", s.Name, sloResolution)
+		}
+		if s.Name == "" {
+			s.Name = s.Route + "-availability"
+			if s.Latency > 0 {
+				s.Name = s.Route + "-latency"
+			}
+		}
+		if names[s.Name] {
+			return nil, errors.Errorf("metrics: duplicate SLO %q", s.Name)
+		}
+		names[s.Name] = true
+
+		n := int(s.Window / sloResolution)
+		trackers = append(trackers, &sloTracker{
+			SLO:   s,
+			total: make([]uint64, n),
+			bad:   make([]uint64, n),
+			slot:  make([]int64, n),
+		})
+	}
+	return trackers, nil
+}
+
+// observe counts a request to pattern that ended at now
+func (t *sloTracker) observe(now time.Time, pattern string, code int, d time.Duration) {
+	if t.Route != "" && t.Route != pattern {
+		return
+	}
+
+	bad := code >= 500
+	if t.Latency > 0 {
+		bad = d > t.Latency
+	}
+
+	minute := now.Unix() / int64(sloResolution/time.Second)
+	i := int(minute % int64(len(t.slot)))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.slot[i] != minute {
+		t.slot[i], t.total[i], t.bad[i] = minute, 0, 0
+	}
+	t.total[i]++
+	if bad {
+		t.bad[i]++
+	}
+}
+
+// sum returns the total and bad requests over the window d ending at now
+func (t *sloTracker) sum(now time.Time, d time.Duration) (total, bad uint64) {
+	minute := now.Unix() / int64(sloResolution/time.Second)
+	n := int64(d / sloResolution)
+	if n > int64(len(t.slot)) {
+		n = int64(len(t.slot))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for m := minute - n + 1; m <= minute; m++ {
+		i := int(m % int64(len(t.slot)))
+		if t.slot[i] == m {
+			total += t.total[i]
+			bad += t.bad[i]
+		}
+	}
+	return total, bad
+}
+
+// burnRate is the error rate over the window relative to the error rate
+// the objective allows
+func (t *sloTracker) burnRate(now time.Time, d time.Duration) float64 {
+	total, bad := t.sum(now, d)
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - t.Objective)
+}
+
+// status returns the standing of the SLO at now
+func (t *sloTracker) status(now time.Time) SLOStatus {
+	total, bad := t.sum(now, t.Window)
+	s := SLOStatus{
+		Name:      t.Name,
+		Route:     t.Route,
+		Objective: t.Objective,
+		Window:    t.Window.String(),
+		Total:     total,
+		Bad:       bad,
+		SLI:       1,
+		Budget:    1,
+		BurnRates: make([]BurnRate, 0, len(burnWindows)),
+	}
+	if t.Latency > 0 {
+		s.Latency = t.Latency.String()
+	}
+	if total > 0 {
+		s.SLI = 1 - float64(bad)/float64(total)
+		s.Budget = 1 - t.burnRate(now, t.Window)
+	}
+	s.Met = s.SLI >= s.Objective
+	for _, w := range burnWindows {
+		s.BurnRates = append(s.BurnRates, BurnRate{Window: w.name, Rate: t.burnRate(now, w.d)})
+	}
+	return s
+}
+
+// sloCollector exports the standing of our SLOs as gauges, computed
+// when scraped.
+type sloCollector struct {
+	trackers  []*sloTracker
+	now       func() time.Time
+	objective *prometheus.Desc
+	sli       *prometheus.Desc
+	budget    *prometheus.Desc
+	burn      *prometheus.Desc
+}
+
+func newSLOCollector(trackers []*sloTracker, opts Options, constLabels prometheus.Labels) *sloCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, name),
+			help,
+			append([]string{"slo", "route"}, labels...),
+			constLabels,
+		)
+	}
+	return &sloCollector{
+		trackers:  trackers,
+		now:       time.Now,
+		objective: desc(sloObjectiveName, sloObjectiveHelp),
+		sli:       desc(sloSLIName, sloSLIHelp),
+		budget:    desc(sloBudgetName, sloBudgetHelp),
+		burn:      desc(sloBurnName, sloBurnHelp, "window"),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.objective
+	ch <- c.sli
+	ch <- c.budget
+	ch <- c.burn
+}
+
+// Collect implements prometheus.Collector
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.status() {
+		ch <- prometheus.MustNewConstMetric(c.objective, prometheus.GaugeValue, s.Objective, s.Name, s.Route)
+		ch <- prometheus.MustNewConstMetric(c.sli, prometheus.GaugeValue, s.SLI, s.Name, s.Route)
+		ch <- prometheus.MustNewConstMetric(c.budget, prometheus.GaugeValue, s.Budget, s.Name, s.Route)
+		for _, b := range s.BurnRates {
+			ch <- prometheus.MustNewConstMetric(c.burn, prometheus.GaugeValue, b.Rate, s.Name, s.Route, b.Window)
+		}
+	}
+}
+
+// observe counts a finished request against every SLO
+func (c *sloCollector) observe(pattern string, code int, d time.Duration) {
+	now := c.now()
+	for _, t := range c.trackers {
+		t.observe(now, pattern, code, d)
+	}
+}
+
+// status returns the standing of every SLO
+func (c *sloCollector) status() []SLOStatus {
+	now := c.now()
+	status := make([]SLOStatus, 0, len(c.trackers))
+	for _, t := range c.trackers {
+		status = append(status, t.status(now))
+	}
+	return status
+}
+
+// SLOs returns the current standing of our SLOs
+func (m *Metrics) SLOs() []SLOStatus {
+	if m.slo == nil {
+		return []SLOStatus{}
+	}
+	return m.slo.status()
+}
+
+// SLOHandler serves the current standing of our SLOs as JSON, or as the
+// rendered "slo.html" page to browsers if r is not nil.
+func (m *Metrics) SLOHandler(r *tmpl.Render) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := m.SLOs()
+
+		if r != nil && strings.Contains(req.Header.Get("Accept"), "text/html") {
+			// page data to render page
+			windows := []string{}
+			for _, w := range burnWindows {
+				windows = append(windows, w.name)
+			}
+			data := map[string]interface{}{
+				"title":   "SLOs",
+				"SLOs":    status,
+				"Windows": windows,
+			}
+
+			// render page template
+			err := r.TemplateContext(req.Context(), w, dflSLOTemplate, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		j, err := json.MarshalIndent(status, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(j)
+	})
+}
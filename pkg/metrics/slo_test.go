@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+func TestSLOTracker(t *testing.T) {
+	trackers, err := newSLOTrackers([]SLO{
+		{Route: "/hello/:name", Objective: 0.9, Window: time.Hour},
+		{Route: "/hello/:name", Objective: 0.5, Latency: 100 * time.Millisecond, Window: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	avail, latency := trackers[0], trackers[1]
+	assert.Equal(t, "/hello/:name-availability", avail.Name)
+	assert.Equal(t, "/hello/:name-latency", latency.Name)
+
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// an hour ago, outside the window at the end
+	for _, tr := range trackers {
+		tr.observe(now.Add(-time.Hour), "/hello/:name", 500, time.Second)
+	}
+
+	// 10 requests in the last 5 minutes, 2 failed and 5 slow
+	for i := 0; i < 10; i++ {
+		code, d := 200, 10*time.Millisecond
+		if i < 2 {
+			code = 500
+		}
+		if i >= 5 {
+			d = time.Second
+		}
+		for _, tr := range trackers {
+			tr.observe(now.Add(-time.Duration(i)*time.Second), "/hello/:name", code, d)
+			tr.observe(now, "/other", 500, time.Second) // not our route
+		}
+	}
+
+	s := avail.status(now)
+	assert.Equal(t, uint64(10), s.Total)
+	assert.Equal(t, uint64(2), s.Bad)
+	assert.InDelta(t, 0.8, s.SLI, 1e-9)
+	assert.InDelta(t, -1.0, s.Budget, 1e-9) // spent twice over
+	assert.False(t, s.Met)
+	assert.Equal(t, "5m", s.BurnRates[0].Window)
+	assert.InDelta(t, 2.0, s.BurnRates[0].Rate, 1e-9)
+
+	s = latency.status(now)
+	assert.Equal(t, uint64(5), s.Bad)
+	assert.InDelta(t, 0.5, s.SLI, 1e-9)
+	assert.True(t, s.Met)
+	assert.Equal(t, "100ms", s.Latency)
+
+	// an hour later it has all rolled out of the window
+	s = avail.status(now.Add(time.Hour))
+	assert.Equal(t, uint64(0), s.Total)
+	assert.Equal(t, 1.0, s.SLI)
+	assert.Equal(t, 1.0, s.Budget)
+	assert.Equal(t, 0.0, s.BurnRates[0].Rate)
+}
+
+func TestSLOValidation(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		slos []SLO
+		ok   bool
+	}{
+		{[]SLO{{Route: "/", Objective: 0.999}}, true},
+		{[]SLO{{Route: "/", Objective: 1}}, false},
+		{[]SLO{{Route: "/", Objective: 0}}, false},
+		{[]SLO{{Route: "/", Objective: 0.9, Window: time.Second}}, false},
+		{[]SLO{{Name: "a", Objective: 0.9}, {Name: "a", Objective: 0.99}}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := New(Options{SLOs: tt.slos})
+		if (err == nil) != tt.ok {
+			t.Errorf("SLOs %+v: got error %v", tt.slos, err)
+		}
+	}
+}
+
+func TestLoadSLOs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slo.json")
+	err = ioutil.WriteFile(path, []byte(`[
+		{"name": "hello-availability", "route": "/hello/:name", "objective": 0.999},
+		{"name": "index-latency", "route": "/", "objective": 0.99, "latency": "300ms", "window": "168h"}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slos, err := LoadSLOs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []SLO{
+		{Name: "hello-availability", Route: "/hello/:name", Objective: 0.999},
+		{Name: "index-latency", Route: "/", Objective: 0.99, Latency: 300 * time.Millisecond, Window: 7 * 24 * time.Hour},
+	}, slos)
+
+	err = ioutil.WriteFile(path, []byte(`[{"latency": "fast"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadSLOs(path)
+	assert.Error(t, err)
+
+	_, err = LoadSLOs(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestSLOHandler(t *testing.T) {
+	m, err := New(Options{
+		SLOs: []SLO{{Name: "ok-availability", Route: "/ok", Objective: 0.99}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.Use(m)
+	r := http.NewServeMux()
+	r.Handle("/metrics", promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}))
+	r.Handle("/slo", m.SLOHandler(tmpl.New(tmpl.Options{TemplateDirectory: "../../templates"})))
+	r.Handle("/ok", route.Handler("/ok", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})))
+	n.UseHandler(r)
+
+	for _, path := range []string{"/ok", "/ok", "/ok", "/ok?fail=1"} {
+		req, err := http.NewRequest("GET", "http://localhost:3000"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// JSON
+	req, err := http.NewRequest("GET", "http://localhost:3000/slo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var status []SLOStatus
+	err = json.Unmarshal(recorder.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, status, 1) {
+		assert.Equal(t, uint64(4), status[0].Total)
+		assert.Equal(t, uint64(1), status[0].Bad)
+		assert.InDelta(t, -24.0, status[0].Budget, 1e-9)
+	}
+
+	// HTML
+	req.Header.Set("Accept", "text/html")
+	recorder = httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "ok-availability")
+
+	// gauges
+	req, err = http.NewRequest("GET", "http://localhost:3000/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	body := recorder.Body.String()
+	for _, metric := range []string{
+		`slo_objective_ratio{route="/ok",slo="ok-availability"} 0.99`,
+		`slo_sli_ratio{route="/ok",slo="ok-availability"} 0.75`,
+		`slo_burn_rate{route="/ok",slo="ok-availability",window="5m"} 24.9`,
+		sloBudgetName,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("body does not contain %s", metric)
+		}
+	}
+
+	// no SLOs
+	m, err = New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, m.SLOs())
+}
@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+)
+
+// Besides Prometheus our middleware keeps a few live stats of its own
+// (in the spirit of thoas/stats), so a single replica can be looked at on
+// '/debug/stats' without Prometheus or Grafana.
+
+const (
+	dflStatsTemplate = "stats.html"
+	statsSamples     = 1024 // latency samples kept per route
+	statsRateWindow  = 60   // seconds the request rate is averaged over
+)
+
+// RouteStats describes the live stats of a route
+type RouteStats struct {
+	Route    string  `json:"route"`
+	Requests uint64  `json:"requests"`
+	InFlight int64   `json:"inFlight"`
+	P50      float64 `json:"p50Ms"`
+	P95      float64 `json:"p95Ms"`
+	P99      float64 `json:"p99Ms"`
+}
+
+// Stats describes the live stats of this instance
+type Stats struct {
+	Uptime      string            `json:"uptime"`
+	UptimeSec   float64           `json:"uptimeSec"`
+	Requests    uint64            `json:"requests"`
+	Rate        float64           `json:"requestsPerSec"`
+	InFlight    int64             `json:"inFlight"`
+	StatusCodes map[string]uint64 `json:"statusCodes"`
+	Routes      []RouteStats      `json:"routes"`
+}
+
+// liveStats tracks the live stats of our requests
+type liveStats struct {
+	start time.Time
+	now   func() time.Time
+
+	mu       sync.Mutex
+	requests uint64
+	inflight int64
+	codes    map[int]uint64
+	routes   map[string]*routeStats
+	rate     [statsRateWindow]uint64 // requests per second
+	rateSec  [statsRateWindow]int64  // second each slot holds
+}
+
+// routeStats tracks a route, keeping the latest latency samples
+type routeStats struct {
+	requests uint64
+	inflight int64
+	samples  []float64 // in seconds
+	next     int
+}
+
+func newLiveStats() *liveStats {
+	return &liveStats{
+		start:  time.Now(),
+		now:    time.Now,
+		codes:  make(map[int]uint64),
+		routes: make(map[string]*routeStats),
+	}
+}
+
+// route returns the stats of pattern. s.mu must be held.
+func (s *liveStats) route(pattern string) *routeStats {
+	rs, ok := s.routes[pattern]
+	if !ok {
+		rs = &routeStats{samples: make([]float64, 0, statsSamples)}
+		s.routes[pattern] = rs
+	}
+	return rs
+}
+
+// begin counts a request in flight
+func (s *liveStats) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight++
+}
+
+// matched counts a request to pattern in flight and returns the requests
+// in flight on it
+func (s *liveStats) matched(pattern string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := s.route(pattern)
+	rs.inflight++
+	return rs.inflight
+}
+
+// end counts a finished request and returns the requests still in flight
+// on its route. matched tells whether it was counted in flight on it.
+func (s *liveStats) end(pattern string, matched bool, code int, d time.Duration) int64 {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	sec := s.now().Unix()
+	i := int(sec % statsRateWindow)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.inflight--
+	s.codes[code]++
+	if s.rateSec[i] != sec {
+		s.rateSec[i], s.rate[i] = sec, 0
+	}
+	s.rate[i]++
+
+	rs := s.route(pattern)
+	rs.requests++
+	if matched {
+		rs.inflight--
+	}
+	if len(rs.samples) < statsSamples {
+		rs.samples = append(rs.samples, d.Seconds())
+	} else {
+		rs.samples[rs.next] = d.Seconds()
+	}
+	rs.next = (rs.next + 1) % statsSamples
+	return rs.inflight
+}
+
+// snapshot returns the current stats
+func (s *liveStats) snapshot() Stats {
+	now := s.now()
+	uptime := now.Sub(s.start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		Uptime:      (uptime - uptime%time.Second).String(),
+		UptimeSec:   uptime.Seconds(),
+		Requests:    s.requests,
+		InFlight:    s.inflight,
+		StatusCodes: make(map[string]uint64, len(s.codes)),
+		Routes:      make([]RouteStats, 0, len(s.routes)),
+	}
+	for code, n := range s.codes {
+		st.StatusCodes[strconv.Itoa(code)] = n
+	}
+
+	// average over the last complete seconds, or since we started
+	var n uint64
+	sec := now.Unix()
+	for i := range s.rate {
+		if s.rateSec[i] < sec && s.rateSec[i] >= sec-statsRateWindow {
+			n += s.rate[i]
+		}
+	}
+	window := math.Min(statsRateWindow, math.Floor(uptime.Seconds()))
+	if window > 0 {
+		st.Rate = float64(n) / window
+	}
+
+	for pattern, rs := range s.routes {
+		samples := append([]float64(nil), rs.samples...)
+		sort.Float64s(samples)
+		st.Routes = append(st.Routes, RouteStats{
+			Route:    pattern,
+			Requests: rs.requests,
+			InFlight: rs.inflight,
+			P50:      percentile(samples, 0.50) * 1000,
+			P95:      percentile(samples, 0.95) * 1000,
+			P99:      percentile(samples, 0.99) * 1000,
+		})
+	}
+	sort.Slice(st.Routes, func(i, j int) bool { return st.Routes[i].Route < st.Routes[j].Route })
+
+	return st
+}
+
+// percentile returns the q-th percentile of sorted samples, by the
+// nearest rank method
+func percentile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Stats returns the live stats of this instance
+func (m *Metrics) Stats() Stats {
+	return m.stats.snapshot()
+}
+
+// StatsHandler serves the live stats as JSON, or as the rendered
+// "stats.html" dashboard to browsers if r is not nil. The dashboard
+// polls the same URL for JSON to update itself.
+func (m *Metrics) StatsHandler(r *tmpl.Render) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stats := m.Stats()
+
+		if r != nil && strings.Contains(req.Header.Get("Accept"), "text/html") {
+			// page data to render page
+			data := map[string]interface{}{
+				"title": "Stats",
+				"Stats": stats,
+			}
+
+			// render page template
+			err := r.TemplateContext(req.Context(), w, dflStatsTemplate, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		j, err := json.MarshalIndent(stats, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(j)
+	})
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+func TestPercentile(t *testing.T) {
+	samples := []float64{}
+	for i := 1; i <= 100; i++ {
+		samples = append(samples, float64(i))
+	}
+
+	// test data
+	var tests = []struct {
+		samples  []float64
+		q        float64
+		expected float64
+	}{
+		{samples, 0.50, 50},
+		{samples, 0.95, 95},
+		{samples, 0.99, 99},
+		{samples, 0, 1},
+		{[]float64{7}, 0.99, 7},
+		{[]float64{}, 0.50, 0},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(tt.samples, tt.q); got != tt.expected {
+			t.Errorf("percentile(%v) of %d samples: got %v want %v", tt.q, len(tt.samples), got, tt.expected)
+		}
+	}
+}
+
+func TestLiveStats(t *testing.T) {
+	s := newLiveStats()
+	now := s.start.Add(2 * time.Minute)
+	s.now = func() time.Time { return now }
+
+	// more than we keep samples of, only the latest count
+	for i := 0; i < statsSamples+10; i++ {
+		s.begin()
+		s.matched("/hello/:name")
+		s.end("/hello/:name", true, 0, 10*time.Millisecond)
+	}
+	s.begin()
+	s.matched("/hello/:name") // still in flight
+	s.begin()
+	s.end(route.Other, false, http.StatusNotFound, time.Millisecond)
+
+	// rates count complete seconds only
+	now = now.Add(time.Second)
+	st := s.snapshot()
+
+	assert.Equal(t, "2m1s", st.Uptime)
+	assert.Equal(t, uint64(statsSamples+11), st.Requests)
+	assert.InDelta(t, float64(statsSamples+11)/statsRateWindow, st.Rate, 1e-9)
+	assert.Equal(t, int64(1), st.InFlight)
+	assert.Equal(t, map[string]uint64{"200": statsSamples + 10, "404": 1}, st.StatusCodes)
+	if assert.Len(t, st.Routes, 2) {
+		assert.Equal(t, RouteStats{Route: "/hello/:name", Requests: statsSamples + 10, InFlight: 1, P50: 10, P95: 10, P99: 10}, st.Routes[0])
+		assert.Equal(t, route.Other, st.Routes[1].Route)
+		assert.Equal(t, int64(0), st.Routes[1].InFlight)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.Use(m)
+	r := http.NewServeMux()
+	r.Handle("/debug/stats", m.StatsHandler(tmpl.New(tmpl.Options{TemplateDirectory: "../../templates"})))
+	r.Handle("/ok", route.Handler("/ok", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	n.UseHandler(r)
+
+	req, err := http.NewRequest("GET", "http://localhost:3000/ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	// JSON
+	req, err = http.NewRequest("GET", "http://localhost:3000/debug/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var st Stats
+	err = json.Unmarshal(recorder.Body.Bytes(), &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(1), st.Requests)
+	assert.Equal(t, uint64(1), st.StatusCodes["200"])
+	if assert.Len(t, st.Routes, 1) {
+		assert.Equal(t, "/ok", st.Routes[0].Route)
+	}
+
+	// HTML
+	req.Header.Set("Accept", "text/html")
+	recorder = httptest.NewRecorder()
+	n.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<code>/ok</code>")
+}
@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Part of our fleet reports to a StatsD agent rather than being scraped.
+// A StatsD client passed in the Options makes our middleware emit the
+// same request metrics over UDP as well:
+//
+//	sd, err := metrics.NewStatsD(metrics.StatsDOptions{
+//		Addr:      "localhost:8125",
+//		Prefix:    "myapp.",
+//		Tags:      []string{"env:prod"},
+//		DogStatsD: true,
+//	})
+//	defer sd.Close()
+//	m, err := metrics.New(metrics.Options{StatsD: sd})
+//
+// Plain StatsD has no tags, so they are folded into the metric name
+// instead, e.g. "myapp.requests.env.prod.route._hello__name:1|c" for the
+// tags "env:prod" and "route:/hello/:name". Characters that StatsD and
+// Graphite would split on become underscores.
+
+const (
+	dflStatsDFlushInterval = 1 * time.Second
+	dflStatsDPacketSize    = 1432 // fits an ethernet MTU
+)
+
+// StatsDOptions describes the StatsD client options
+type StatsDOptions struct {
+	Addr          string        // agent address, e.g. "localhost:8125"
+	Prefix        string        // metric name prefix, e.g. "myapp."
+	Tags          []string      // tags sent with every metric, e.g. "env:prod"
+	DogStatsD     bool          // send tags and histograms in DogStatsD format, = tags folded into names
+	SampleRate    float64       // ratio of counters and timers sent, = 1
+	FlushInterval time.Duration // = 1 second
+	MaxPacketSize int           // = 1432 bytes
+}
+
+// StatsD sends metrics to a StatsD (or DogStatsD) agent over UDP. Metrics
+// are batched into packets of up to MaxPacketSize bytes that are sent
+// when full and every FlushInterval. It is safe for concurrent use.
+type StatsD struct {
+	opts StatsDOptions
+	conn net.Conn
+	tags string // the constant tags, formatted
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	rand      *rand.Rand
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewStatsD returns a StatsD client sending to opts.Addr
+func NewStatsD(opts StatsDOptions) (*StatsD, error) {
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = dflStatsDFlushInterval
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = dflStatsDPacketSize
+	}
+
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "statsd: dial failed")
+	}
+
+	tags := strings.Join(opts.Tags, ",")
+	if !opts.DogStatsD {
+		tags = foldTags(opts.Tags)
+	}
+
+	s := &StatsD{
+		opts: opts,
+		conn: conn,
+		tags: tags,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		done: make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.loop()
+
+	return s, nil
+}
+
+// Count adds value to the counter name
+func (s *StatsD) Count(name string, value int64, tags ...string) {
+	s.send(name, strconv.FormatInt(value, 10), "c", true, tags)
+}
+
+// Timing records a duration in milliseconds
+func (s *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	ms := float64(d) / float64(time.Millisecond)
+	s.send(name, strconv.FormatFloat(ms, 'f', -1, 64), "ms", true, tags)
+}
+
+// Histogram records a value in a distribution. Plain StatsD has no
+// histograms, so it is sent as a timer there.
+func (s *StatsD) Histogram(name string, value float64, tags ...string) {
+	typ := "ms"
+	if s.opts.DogStatsD {
+		typ = "h"
+	}
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), typ, true, tags)
+}
+
+// Gauge sets the gauge name to value. Gauges are never sampled.
+func (s *StatsD) Gauge(name string, value float64, tags ...string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", false, tags)
+}
+
+// Flush sends the metrics batched so far
+func (s *StatsD) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// Close flushes the metrics batched so far and closes the connection.
+// Closing again does nothing and returns the same error.
+func (s *StatsD) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+
+		s.closeErr = s.Flush()
+		if err := s.conn.Close(); s.closeErr == nil {
+			s.closeErr = err
+		}
+	})
+	return s.closeErr
+}
+
+// loop flushes every FlushInterval until the client is closed
+func (s *StatsD) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// send formats and batches a metric, e.g. "myapp.requests:1|c|@0.5|#route:/",
+// or "myapp.requests.route._:1|c|@0.5" in plain StatsD
+func (s *StatsD) send(name, value, typ string, sampled bool, tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sampled && s.opts.SampleRate < 1 && s.rand.Float64() >= s.opts.SampleRate {
+		return
+	}
+
+	var line bytes.Buffer
+	line.WriteString(s.opts.Prefix)
+	line.WriteString(name)
+	if !s.opts.DogStatsD {
+		line.WriteString(s.tags)
+		line.WriteString(foldTags(tags))
+	}
+	line.WriteByte(':')
+	line.WriteString(value)
+	line.WriteByte('|')
+	line.WriteString(typ)
+	if sampled && s.opts.SampleRate < 1 {
+		line.WriteString("|@")
+		line.WriteString(strconv.FormatFloat(s.opts.SampleRate, 'f', -1, 64))
+	}
+	if s.opts.DogStatsD && (s.tags != "" || len(tags) > 0) {
+		line.WriteString("|#")
+		line.WriteString(s.tags)
+		if s.tags != "" && len(tags) > 0 {
+			line.WriteByte(',')
+		}
+		line.WriteString(strings.Join(tags, ","))
+	}
+
+	// metrics are separated by newlines, flush first if it would not fit
+	if s.buf.Len() > 0 && s.buf.Len()+1+line.Len() > s.opts.MaxPacketSize {
+		s.flush()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.Write(line.Bytes())
+}
+
+// flush sends the batched metrics. s.mu must be held.
+func (s *StatsD) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return errors.Wrap(err, "statsd: write failed")
+}
+
+// foldTags returns tags as metric name segments for plain StatsD, e.g.
+// ".route._hello__name.code.200" for "route:/hello/:name" and "code:200"
+func foldTags(tags []string) string {
+	var b strings.Builder
+	for _, t := range tags {
+		for _, part := range strings.SplitN(t, ":", 2) {
+			b.WriteByte('.')
+			b.WriteString(strings.Map(nameChar, part))
+		}
+	}
+	return b.String()
+}
+
+// nameChar maps the characters StatsD and Graphite split on, or reserve,
+// to underscores
+func nameChar(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+		return r
+	}
+	return '_'
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+// listen returns a local UDP listener standing in for a StatsD agent
+func listen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// packets reads n packets from conn
+func packets(t *testing.T, conn *net.UDPConn, n int) []string {
+	var p []string
+	buf := make([]byte, 65536)
+	for i := 0; i < n; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		l, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = append(p, string(buf[:l]))
+	}
+	return p
+}
+
+func TestStatsD(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	// test data
+	var tests = []struct {
+		opts     StatsDOptions
+		send     func(s *StatsD)
+		expected string
+	}{
+		{
+			StatsDOptions{Prefix: "app."},
+			func(s *StatsD) {
+				s.Count("requests", 1, "route:/")
+				s.Timing("latency", 1500*time.Microsecond)
+				s.Histogram("size", 512)
+				s.Gauge("in_flight", 3)
+			},
+			"app.requests.route._:1|c\napp.latency:1.5|ms\napp.size:512|ms\napp.in_flight:3|g",
+		},
+		{
+			// plain StatsD folds the tags into the name
+			StatsDOptions{Tags: []string{"env:test"}},
+			func(s *StatsD) {
+				s.Count("requests", 1, "route:/hello/:name", "code:200")
+				s.Gauge("in_flight", 1)
+			},
+			"requests.env.test.route._hello__name.code.200:1|c\nin_flight.env.test:1|g",
+		},
+		{
+			StatsDOptions{Tags: []string{"env:test"}, DogStatsD: true},
+			func(s *StatsD) {
+				s.Count("requests", 1, "route:/", "code:200")
+				s.Histogram("size", 512)
+			},
+			"requests:1|c|#env:test,route:/,code:200\nsize:512|h|#env:test",
+		},
+		{
+			// everything is sampled out but the gauge
+			StatsDOptions{SampleRate: 0.0000001, DogStatsD: true},
+			func(s *StatsD) {
+				s.Count("requests", 1, "route:/")
+				s.Gauge("in_flight", 1, "route:/")
+			},
+			"in_flight:1|g|#route:/",
+		},
+	}
+
+	for _, tt := range tests {
+		tt.opts.Addr = conn.LocalAddr().String()
+		tt.opts.FlushInterval = time.Hour
+		s, err := NewStatsD(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.send(s)
+		err = s.Close() // flushes
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{tt.expected}, packets(t, conn, 1))
+		assert.NoError(t, s.Close()) // again
+	}
+}
+
+func TestStatsDBatching(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	s, err := NewStatsD(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		SampleRate:    0.5,
+		FlushInterval: time.Hour,
+		MaxPacketSize: 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// "in_flight:1|g" is 13 bytes, two fit in a packet
+	for i := 0; i < 3; i++ {
+		s.Gauge("in_flight", 1)
+	}
+	s.Flush()
+	assert.Equal(t, []string{"in_flight:1|g\nin_flight:1|g", "in_flight:1|g"}, packets(t, conn, 2))
+
+	// sampled counters carry their rate
+	for i := 0; i < 100; i++ {
+		s.Count("c", 1)
+	}
+	s.Flush()
+	p := packets(t, conn, 1)
+	assert.True(t, strings.HasPrefix(p[0], "c:1|c|@0.5"), p[0])
+}
+
+func TestStatsDMiddleware(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	sd, err := NewStatsD(StatsDOptions{
+		Addr:          conn.LocalAddr().String(),
+		Prefix:        "app.",
+		DogStatsD:     true,
+		FlushInterval: time.Hour,
+		MaxPacketSize: 65000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(Options{StatsD: sd, Labels: []string{"code", "route"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := negroni.New()
+	n.Use(m)
+	n.UseHandler(route.Handler("/ok", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+
+	req, err := http.NewRequest("GET", "http://localhost:3000/ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.ServeHTTP(httptest.NewRecorder(), req)
+	sd.Close()
+
+	p := strings.Split(packets(t, conn, 1)[0], "\n")
+	for _, expected := range []string{
+		"app.requests_in_flight:1|g|#route:/ok",
+		"app.requests:1|c|#code:200,route:/ok",
+		"app.response_size_bytes:2|h|#route:/ok",
+		"app.request_size_bytes:0|h|#route:/ok",
+		"app.requests_in_flight:0|g|#route:/ok",
+	} {
+		assert.Contains(t, p, expected)
+	}
+	assert.Len(t, p, 6) // and the latency
+}
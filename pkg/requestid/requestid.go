@@ -0,0 +1,197 @@
+/*
+Package requestid implements Negroni middleware giving every request an
+ID, so a user reporting an error can quote something we can find in our
+logs and traces. Every response carries the request ID and the trace ID:
+
+	X-Request-Id: 0f8fad5b-d9cb-469f-a165-70867728950e
+	X-Trace-Id: 4bf92f3577b34da6a3ce929d0e0e4736
+
+An inbound X-Request-Id is kept when it comes from one of our trusted
+proxies (e.g. the load balancer that already logged it), anyone else
+gets a fresh one. Use it as the first middleware, inside the tracing
+middleware, so the IDs are there for everything after it, including the
+panic page:
+
+	rid, err := requestid.New(requestid.Options{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		TraceID:        tracing.TraceID,
+	})
+	n.Use(rid)
+	n.Use(negroni.NewRecovery())
+
+Handlers read the IDs with RequestID and TraceID. Everything logged with
+the request context has them (see logging.With), and they are set on the
+request headers as well, so negroni's Logger can show them with LogFormat.
+*/
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	RequestIDHeader = "X-Request-Id"
+	TraceIDHeader   = "X-Trace-Id"
+
+	// LogFormat is negroni's default access log format with the IDs
+	LogFormat = "{{.StartTime}} | {{.Status}} | \t {{.Duration}} | {{.Hostname}} | {{.Method}} {{.Path}} | " +
+		"request_id={{.Request.Header.Get \"X-Request-Id\"}} trace_id={{.Request.Header.Get \"X-Trace-Id\"}} \n"
+
+	maxLength = 128 // of an inbound request ID
+	spanTag   = "request.id"
+)
+
+type key int
+
+const idsKey key = 0
+
+type ids struct {
+	request string
+	trace   string
+}
+
+// Options describes the middleware options
+type Options struct {
+	// TrustedProxies are the IPs or CIDRs (e.g. "10.0.0.0/8") whose
+	// X-Request-Id we keep. Nobody is trusted if empty.
+	TrustedProxies []string
+
+	// TraceID returns the ID of the trace in ctx, if any (see
+	// tracing.TraceID). No X-Trace-Id is sent if nil.
+	TraceID func(ctx context.Context) (string, bool)
+}
+
+// Middleware is a Negroni middleware assigning request IDs
+type Middleware struct {
+	trusted []*net.IPNet
+	traceID func(ctx context.Context) (string, bool)
+}
+
+// New returns a new request ID Middleware
+func New(opts ...Options) (*Middleware, error) {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+
+	m := &Middleware{traceID: opt.TraceID}
+	for _, p := range opt.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "requestid: invalid trusted proxy %q", p)
+		}
+		m.trusted = append(m.trusted, n)
+	}
+	return m, nil
+}
+
+func (m *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(RequestIDHeader)
+	if !m.trustedProxy(r) || !valid(id) {
+		id = newID()
+	}
+
+	var trace string
+	if m.traceID != nil {
+		trace, _ = m.traceID(r.Context())
+	}
+
+	rw.Header().Set(RequestIDHeader, id)
+	r.Header.Set(RequestIDHeader, id)
+	if trace != "" {
+		rw.Header().Set(TraceIDHeader, trace)
+		r.Header.Set(TraceIDHeader, trace)
+	} else {
+		r.Header.Del(TraceIDHeader)
+	}
+
+	if span := opentracing.SpanFromContext(r.Context()); span != nil {
+		span.SetTag(spanTag, id)
+	}
+
+	ctx := context.WithValue(r.Context(), idsKey, ids{id, trace})
+	if trace != "" {
+		ctx = logging.With(ctx, "request_id", id, "trace_id", trace)
+	} else {
+		ctx = logging.With(ctx, "request_id", id)
+	}
+	next(rw, r.WithContext(ctx))
+}
+
+// trustedProxy tells whether r comes straight from a trusted proxy
+func (m *Middleware) trustedProxy(r *http.Request) bool {
+	if len(m.trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range m.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// valid tells whether an inbound request ID is safe to log and echo
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/+=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newID returns a random (version 4) UUID
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// RequestID returns the ID of the request with context ctx, "" if the
+// middleware didn't run
+func RequestID(ctx context.Context) string {
+	v, _ := ctx.Value(idsKey).(ids)
+	return v.request
+}
+
+// TraceID returns the ID of the trace of the request with context ctx, ""
+// if it isn't traced
+func TraceID(ctx context.Context) string {
+	v, _ := ctx.Value(idsKey).(ids)
+	return v.trace
+}
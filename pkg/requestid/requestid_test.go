@@ -0,0 +1,132 @@
+package requestid
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+var uuid = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestMiddleware(t *testing.T) {
+	m, err := New(Options{
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "::1"},
+		TraceID: func(ctx context.Context) (string, bool) {
+			return "4bf92f3577b34da6a3ce929d0e0e4736", true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// test data
+	var tests = []struct {
+		remote string
+		id     string
+		kept   bool
+	}{
+		{"10.1.2.3:1234", "abc-123", true},
+		{"192.168.1.1:1234", "Root=1-5759e988-bd862e3fe1be46a994272793", true},
+		{"[::1]:1234", "abc-123", true},
+		{"192.168.1.2:1234", "abc-123", false}, // not our proxy
+		{"10.1.2.3:1234", "", false},
+		{"10.1.2.3:1234", "abc 123", false},                // not a safe ID
+		{"10.1.2.3:1234", "<script>", false},               // not a safe ID
+		{"10.1.2.3:1234", strings.Repeat("a", 129), false}, // too long
+		{"10.1.2.3:1234", strings.Repeat("a", maxLength), true},
+	}
+
+	for _, tt := range tests {
+		var request, trace string
+		next := func(w http.ResponseWriter, r *http.Request) {
+			request, trace = RequestID(r.Context()), TraceID(r.Context())
+			assert.Equal(t, request, r.Header.Get(RequestIDHeader))
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		req.Header.Set(RequestIDHeader, tt.id)
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, req, next)
+
+		if tt.kept {
+			assert.Equal(t, tt.id, request, tt.remote)
+		} else {
+			assert.Regexp(t, uuid, request, tt.remote)
+		}
+		assert.Equal(t, request, rr.Header().Get(RequestIDHeader), tt.remote)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace, tt.remote)
+		assert.Equal(t, trace, rr.Header().Get(TraceIDHeader), tt.remote)
+	}
+}
+
+func TestUntraced(t *testing.T) {
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	req.Header.Set(TraceIDHeader, "forged")
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", TraceID(r.Context()))
+		assert.Equal(t, "", r.Header.Get(TraceIDHeader))
+	})
+
+	// nobody is trusted
+	assert.Regexp(t, uuid, rr.Header().Get(RequestIDHeader))
+	assert.Equal(t, "", rr.Header().Get(TraceIDHeader))
+
+	// no middleware, no IDs
+	assert.Equal(t, "", RequestID(context.Background()))
+	assert.Equal(t, "", TraceID(context.Background()))
+}
+
+func TestSpanTag(t *testing.T) {
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("HTTP GET /")
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, req, func(w http.ResponseWriter, r *http.Request) {})
+	span.Finish()
+
+	assert.Equal(t, rr.Header().Get(RequestIDHeader), tracer.FinishedSpans()[0].Tag(spanTag))
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{TrustedProxies: []string{"10.0.0.0/8", "not-an-ip"}})
+	assert.Error(t, err)
+}
+
+func TestLogFormat(t *testing.T) {
+	var b strings.Builder
+	l := negroni.NewLogger()
+	l.ALogger = log.New(&b, "", 0)
+	l.SetFormat(LogFormat)
+
+	m, _ := New(Options{TraceID: func(ctx context.Context) (string, bool) { return "abc", false }})
+	n := negroni.New(m, l)
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	rr := httptest.NewRecorder()
+	n.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	assert.Contains(t, b.String(), "request_id="+rr.Header().Get(RequestIDHeader)+" trace_id=abc")
+}
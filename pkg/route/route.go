@@ -0,0 +1,102 @@
+/*
+Package route implements a library to make the matched route pattern
+(e.g. '/hello/:name') available to middleware that runs before the router,
+such as our metrics. Labelling by pattern instead of the raw URL path keeps
+the number of time series bounded.
+
+Middleware installs a holder on the request before calling the next
+handler, the router records the pattern into it when a route matches, and
+the middleware reads it back afterwards:
+
+	r = route.New(r)
+	next(rw, r)
+	pattern := route.Pattern(r) // "" if no route matched
+
+Requests that matched no route (404s, 405s) should be reported as
+route.Other.
+*/
+package route
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Other is the label to use for requests that matched no route
+const Other = "other"
+
+type key int
+
+const holderKey key = 0
+
+type holder struct {
+	mu      sync.RWMutex
+	pattern string
+	onSet   []func(pattern string)
+}
+
+// New returns a shallow copy of r carrying a route holder. If r already
+// carries one it is returned unchanged, so every middleware sees the same
+// holder.
+func New(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(holderKey).(*holder); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), holderKey, &holder{}))
+}
+
+// Set records the matched route pattern for r and calls any functions
+// registered with OnSet.
+func Set(r *http.Request, pattern string) {
+	if h, ok := r.Context().Value(holderKey).(*holder); ok {
+		h.mu.Lock()
+		h.pattern = pattern
+		fns := h.onSet
+		h.mu.Unlock()
+
+		for _, fn := range fns {
+			fn(pattern)
+		}
+	}
+}
+
+// OnSet registers fn to be called as soon as the router matches a route
+// for r, i.e. before the route's handler runs. r must carry a holder
+// (see New).
+func OnSet(r *http.Request, fn func(pattern string)) {
+	if h, ok := r.Context().Value(holderKey).(*holder); ok {
+		h.mu.Lock()
+		h.onSet = append(h.onSet, fn)
+		h.mu.Unlock()
+	}
+}
+
+// Pattern returns the matched route pattern for r, or "" if no route has
+// matched (yet).
+func Pattern(r *http.Request) string {
+	if h, ok := r.Context().Value(holderKey).(*holder); ok {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return h.pattern
+	}
+	return ""
+}
+
+// Handle wraps an httprouter handle so it records pattern when it is called
+func Handle(pattern string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		Set(r, pattern)
+		h(w, r, p)
+	}
+}
+
+// Handler wraps an http.Handler so it records pattern when it is called
+func Handler(pattern string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Set(r, pattern)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPattern(t *testing.T) {
+
+	router := httprouter.New()
+	router.GET("/hello/:name", Handle("/hello/:name", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {}))
+	router.Handler("GET", "/static/*filepath", Handler("/static/*filepath", http.NotFoundHandler()))
+
+	// test data
+	var tests = []struct {
+		path    string
+		pattern string
+	}{
+		{"/hello/Dan", "/hello/:name"},
+		{"/hello/Bob", "/hello/:name"},
+		{"/static/css/app.css", "/static/*filepath"},
+		{"/nonexistant", ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the holder survives the router making its own copies
+		req = New(req)
+		assert.Equal(t, req, New(req), "New should be idempotent")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.Equal(t, tt.pattern, Pattern(req), tt.path)
+	}
+
+	// without a holder nothing is recorded
+	req, err := http.NewRequest("GET", "/hello/Dan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "", Pattern(req))
+}
+
+func TestOnSet(t *testing.T) {
+
+	var matched string
+	router := httprouter.New()
+	router.GET("/hello/:name", Handle("/hello/:name", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		// the callback has already run when the handler is called
+		assert.Equal(t, "/hello/:name", matched)
+	}))
+
+	req, err := http.NewRequest("GET", "/hello/Dan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = New(req)
+	OnSet(req, func(pattern string) { matched = pattern })
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "/hello/:name", matched)
+}
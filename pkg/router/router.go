@@ -5,19 +5,49 @@ package router
 
 import (
 	"net/http"
-	"sync/atomic"
 
+	"github.com/dstroot/simple-go-webserver/pkg/admin"
 	handle "github.com/dstroot/simple-go-webserver/pkg/handlers"
 	"github.com/dstroot/simple-go-webserver/pkg/health"
 	"github.com/dstroot/simple-go-webserver/pkg/info"
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/dstroot/simple-go-webserver/pkg/maintenance"
+	"github.com/dstroot/simple-go-webserver/pkg/route"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Options describes the router options
+type Options struct {
+	Health      *health.Checker     // liveness and readiness checks; a fresh one if nil
+	Maintenance *maintenance.Mode   // maintenance state; a fresh one if nil
+	AdminToken  string              // bearer token for /admin; admin is disabled if empty
+	Gatherer    prometheus.Gatherer // served on /metrics; the global registry if nil
+	SLO         http.Handler        // served on /slo to admins; not served if nil
+	Stats       http.Handler        // served on /debug/stats to admins; not served if nil
+	Traces      http.Handler        // served on /debug/traces to admins; not served if nil
+}
+
 // New creates a new router with our routes
-func New() *httprouter.Router {
+func New(opts ...Options) *httprouter.Router {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Health == nil {
+		opt.Health = health.NewChecker()
+	}
+	if opt.Maintenance == nil {
+		opt.Maintenance = maintenance.New()
+	}
+	if opt.Gatherer == nil {
+		opt.Gatherer = prometheus.DefaultGatherer
+	}
 
-	r := httprouter.New()
+	// every route records its pattern so our metrics are labelled by
+	// '/hello/:name' rather than by each raw path
+	r := routes{httprouter.New()}
 
 	// // Instrument the handlers with all the metrics, injecting the "handler"
 	// // label by currying.
@@ -35,20 +65,56 @@ func New() *httprouter.Router {
 	// handler for serving info
 	r.Handler("GET", "/info", info.HandlerFunc())
 
-	// Prometheus metrics
-	r.Handler("GET", "/metrics", promhttp.Handler())
+	// Prometheus metrics, in OpenMetrics format (with trace exemplars)
+	// when the scraper negotiates it
+	r.Handler("GET", "/metrics", promhttp.HandlerFor(opt.Gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
+
+	// SLO standing (JSON or HTML), admin only as are the other views of
+	// our traffic and errors
+	if opt.SLO != nil {
+		r.Handler("GET", "/slo", admin.Authorize(opt.AdminToken, opt.SLO))
+	}
+
+	// live stats dashboard (JSON or HTML), admin only
+	if opt.Stats != nil {
+		r.Handler("GET", "/debug/stats", admin.Authorize(opt.AdminToken, opt.Stats))
+	}
 
-	// healthz (for Kubernetes)
-	r.Handler("GET", "/healthz", health.HandlerFunc())
+	// recorded traces (JSON or HTML), admin only as they carry request
+	// details
+	if opt.Traces != nil {
+		r.Handler("GET", "/debug/traces", admin.Authorize(opt.AdminToken, opt.Traces))
+	}
 
 	// readyz (for Kubernetes).
 	// For the readiness probe we might need to wait for some event
 	// (e.g. the database is ready) to be able to serve traffic. We
-	// return 200 only if the variable "isReady" is true.
-	// Here we simply set isReady to true.
-	isReady := &atomic.Value{}
-	isReady.Store(true)
-	r.Handler("GET", "/readyz", health.ReadyFunc(isReady))
+	// return 200 only if every readiness check passes. Maintenance mode
+	// takes us out of rotation without stopping the server.
+	opt.Health.AddReadinessCheck("maintenance", opt.Maintenance.Check)
+
+	// healthz, livez and readyz (for Kubernetes). All of them are fed
+	// by the same checks, see the health package for the formats.
+	r.Handler("GET", "/healthz", opt.Health.Healthz())
+	r.Handler("GET", "/livez", opt.Health.Handler(health.Liveness))
+	r.Handler("GET", "/livez/:check", opt.Health.CheckHandler(health.Liveness))
+	r.Handler("GET", "/readyz", opt.Health.Handler(health.Readiness))
+	r.Handler("GET", "/readyz/:check", opt.Health.CheckHandler(health.Readiness))
+
+	// maintenance mode admin endpoint
+	maint := admin.Authorize(opt.AdminToken, opt.Maintenance.HandlerFunc())
+	r.Handler("GET", "/admin/maintenance", maint)
+	r.Handler("POST", "/admin/maintenance", maint)
+	r.Handler("PUT", "/admin/maintenance", maint)
+
+	// log level admin endpoint
+	levels := admin.Authorize(opt.AdminToken, logging.LevelHandlerFunc())
+	r.Handler("GET", "/admin/log-level", levels)
+	r.Handler("POST", "/admin/log-level", levels)
+	r.Handler("PUT", "/admin/log-level", levels)
+	r.Handler("DELETE", "/admin/log-level", levels)
 
 	// handler for serving static files
 	r.ServeFiles("/public/*filepath", http.Dir("public"))
@@ -56,5 +122,31 @@ func New() *httprouter.Router {
 	// handle 404's gracefully
 	r.NotFound = http.HandlerFunc(handle.NotFound)
 
-	return r
+	return r.Router
+}
+
+// routes wraps an httprouter.Router so every route records its pattern
+type routes struct {
+	*httprouter.Router
+}
+
+// GET registers a GET handle recording its pattern
+func (r routes) GET(path string, h httprouter.Handle) {
+	r.Router.GET(path, route.Handle(path, h))
+}
+
+// Handler registers an http.Handler recording its pattern
+func (r routes) Handler(method, path string, h http.Handler) {
+	r.Router.Handler(method, path, route.Handler(path, h))
+}
+
+// ServeFiles serves files from root like httprouter's ServeFiles. All
+// files are recorded under the single pattern path (e.g.
+// '/public/*filepath').
+func (r routes) ServeFiles(path string, root http.FileSystem) {
+	fileServer := http.FileServer(root)
+	r.GET(path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		req.URL.Path = ps.ByName("filepath")
+		fileServer.ServeHTTP(w, req)
+	})
 }
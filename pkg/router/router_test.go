@@ -6,7 +6,10 @@ import (
 	"testing"
 
 	"github.com/dstroot/simple-go-webserver/pkg/handlers"
+	"github.com/dstroot/simple-go-webserver/pkg/maintenance"
 	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
 )
 
 func TestRoutes(t *testing.T) {
@@ -30,6 +33,14 @@ func TestRoutes(t *testing.T) {
 		{"GET", "/hello/Dan", http.StatusOK},
 		{"GET", "/debug/vars", http.StatusOK},
 		{"GET", "/nonexistant", http.StatusOK},
+		{"GET", "/healthz", http.StatusOK},
+		{"GET", "/livez", http.StatusOK},
+		{"GET", "/livez/ping", http.StatusOK},
+		{"GET", "/readyz", http.StatusOK},
+		{"GET", "/readyz/maintenance", http.StatusOK},
+		{"GET", "/readyz/nonexistant", http.StatusNotFound},
+		{"GET", "/admin/maintenance", http.StatusForbidden},
+		{"GET", "/admin/log-level", http.StatusForbidden},
 	}
 
 	// instantiate a router
@@ -55,3 +66,81 @@ func TestRoutes(t *testing.T) {
 		}
 	}
 }
+
+func TestAdminOnly(t *testing.T) {
+	view := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := New(Options{AdminToken: "s3cret", SLO: view, Stats: view, Traces: view})
+
+	// test data
+	var tests = []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer guess", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	}
+
+	for _, path := range []string{"/slo", "/debug/stats", "/debug/traces"} {
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", tt.auth)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code, path+" "+tt.auth)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+
+	// set template path
+	render := tmpl.New(
+		tmpl.Options{
+			TemplateDirectory: "../../templates",
+		},
+	)
+	handlers.Render = render
+
+	// the router behind the maintenance middleware, as in main
+	mode := maintenance.New()
+	traces := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	n := negroni.New()
+	n.Use(maintenance.NewMiddleware(mode, maintenance.Options{Render: render}))
+	n.UseHandler(New(Options{Maintenance: mode, AdminToken: "s3cret", Traces: traces}))
+	mode.Enable("database upgrade")
+
+	// test data
+	var routes = []struct {
+		route  string
+		status int
+		page   bool // the maintenance page
+	}{
+		{"/", http.StatusServiceUnavailable, true},
+		{"/hello/Dan", http.StatusServiceUnavailable, true},
+		{"/healthz", http.StatusOK, false},
+		{"/livez", http.StatusOK, false},
+		{"/livez/ping", http.StatusOK, false},
+		{"/readyz", http.StatusServiceUnavailable, false}, // out of rotation
+		{"/readyz/maintenance", http.StatusServiceUnavailable, false},
+		{"/readyz/ping", http.StatusOK, false},
+		{"/metrics", http.StatusOK, false},
+		{"/debug/traces", http.StatusOK, false},
+		{"/admin/maintenance", http.StatusOK, false},
+	}
+
+	for _, r := range routes {
+		req := httptest.NewRequest("GET", r.route, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		n.ServeHTTP(rr, req)
+
+		assert.Equal(t, r.status, rr.Code, r.route)
+		if r.page {
+			assert.Contains(t, rr.Body.String(), "database upgrade", r.route)
+			assert.NotEmpty(t, rr.Header().Get("Retry-After"), r.route)
+		} else {
+			assert.Empty(t, rr.Header().Get("Retry-After"), r.route)
+		}
+	}
+}
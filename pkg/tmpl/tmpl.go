@@ -8,12 +8,16 @@ Also see: https://github.com/thedevsaddam/renderer
 package tmpl
 
 import (
+	"context"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"path/filepath"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/oxtoacart/bpool"
 )
 
@@ -24,8 +28,15 @@ const (
 	defaultTemplatePagePath    = "pages"
 	defaultTemplateExtension   = ".html"
 	defaultTemplateBaseLayout  = "layout"
+
+	// render span
+	spanName = "render template"
+	tagName  = "template.name"
+	tagSize  = "template.size"
 )
 
+var logger = logging.Named("tmpl")
+
 type (
 	// Options describes an option type
 	Options struct {
@@ -102,19 +113,19 @@ func (r *Render) parseTemplates() {
 	// get layouts
 	layouts, err := filepath.Glob(filepath.Join(r.opts.TemplateDirectory, r.opts.TemplateLayoutPath, "*"+r.opts.TemplateExtension))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "cannot find layouts", "err", err)
 	}
 
 	// get includes
 	includes, err := filepath.Glob(filepath.Join(r.opts.TemplateDirectory, r.opts.TemplatePartialPath, "*"+r.opts.TemplateExtension))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "cannot find partials", "err", err)
 	}
 
 	// get pages
 	pages, err := filepath.Glob(filepath.Join(r.opts.TemplateDirectory, r.opts.TemplatePagePath, "*"+r.opts.TemplateExtension))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "cannot find pages", "err", err)
 	}
 
 	// Generate our templates map - one for each page
@@ -134,6 +145,26 @@ func (r *Render) parseTemplates() {
 // It writes into a bytes.Buffer before writing to the http.ResponseWriter to catch
 // any errors resulting from populating the template.
 func (r *Render) Template(w http.ResponseWriter, name string, data map[string]interface{}) error {
+	return r.TemplateContext(context.Background(), w, name, data)
+}
+
+// TemplateContext renders our template like Template, in a child span of
+// the span in ctx (e.g. the request's), tagged with the template name,
+// the output size and any error. Handlers pass r.Context().
+func (r *Render) TemplateContext(ctx context.Context, w http.ResponseWriter, name string, data map[string]interface{}) (err error) {
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		span := parent.Tracer().StartSpan(spanName, opentracing.ChildOf(parent.Context()))
+		span.SetTag(tagName, name)
+		defer func() {
+			if err != nil {
+				ext.Error.Set(span, true)
+				span.LogFields(otlog.String("event", "error"), otlog.Error(err))
+			}
+			span.Finish()
+		}()
+		w = &sizeWriter{ResponseWriter: w, span: span}
+	}
+
 	// Ensure the template exists in the map.
 	tmpl, ok := r.templates[name]
 	if !ok {
@@ -145,7 +176,7 @@ func (r *Render) Template(w http.ResponseWriter, name string, data map[string]in
 	defer r.bufpool.Put(buf)
 
 	// render the template and check for errors
-	err := tmpl.ExecuteTemplate(buf, r.opts.TemplateBaseLayout, data)
+	err = tmpl.ExecuteTemplate(buf, r.opts.TemplateBaseLayout, data)
 	if err != nil {
 		return err
 	}
@@ -155,3 +186,15 @@ func (r *Render) Template(w http.ResponseWriter, name string, data map[string]in
 	_, err = buf.WriteTo(w)
 	return err
 }
+
+// sizeWriter tags the render span with the size of the output
+type sizeWriter struct {
+	http.ResponseWriter
+	span opentracing.Span
+}
+
+func (w *sizeWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.span.SetTag(tagSize, n)
+	return n, err
+}
@@ -1,10 +1,15 @@
 package tmpl
 
 import (
+	"context"
 	"fmt"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBuildOptions(t *testing.T) {
@@ -124,3 +129,50 @@ func TestRenderTemplates(t *testing.T) {
 	fmt.Println("Output:", rr)
 
 }
+
+func TestTemplateContext(t *testing.T) {
+	render := New(
+		Options{
+			TemplateDirectory: "../../templates",
+		},
+	)
+
+	// test data
+	var tests = []struct {
+		name  string
+		error bool
+	}{
+		{"page.html", false},
+		{"nonexistent.html", true},
+	}
+
+	for _, tt := range tests {
+		tracer := mocktracer.New()
+		parent := tracer.StartSpan("HTTP GET /page")
+		ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+		rr := httptest.NewRecorder()
+		err := render.TemplateContext(ctx, rr, tt.name, map[string]interface{}{"title": "Page 2"})
+		parent.Finish()
+		if (err != nil) != tt.error {
+			t.Errorf("rendering %s returned %v", tt.name, err)
+		}
+
+		// the render span is a child of the request's
+		spans := tracer.FinishedSpans()
+		if !assert.Len(t, spans, 2, tt.name) {
+			continue
+		}
+		span := spans[0]
+		assert.Equal(t, spanName, span.OperationName, tt.name)
+		assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID, tt.name)
+		assert.Equal(t, tt.name, span.Tag(tagName), tt.name)
+		if tt.error {
+			assert.Equal(t, true, span.Tag("error"), tt.name)
+			assert.Nil(t, span.Tag(tagSize), tt.name)
+		} else {
+			assert.Nil(t, span.Tag("error"), tt.name)
+			assert.Equal(t, rr.Body.Len(), span.Tag(tagSize), tt.name)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package tracing
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/transport"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// Our Jaeger client predates its own support for the JAEGER_* environment
+// variables, so FromEnv reads the standard ones itself:
+//
+//	JAEGER_DISABLED                   true returns a no-op tracer
+//	JAEGER_SAMPLER_TYPE               const, probabilistic, rateLimiting or remote
+//	JAEGER_SAMPLER_PARAM              e.g. 0.001 for probabilistic
+//	JAEGER_SAMPLER_MANAGER_HOST_PORT  agent sampling server, for remote
+//	JAEGER_AGENT_HOST                 agent host for spans over UDP
+//	JAEGER_AGENT_PORT                 agent port for spans over UDP
+//	JAEGER_ENDPOINT                   collector URL, sends spans over HTTP instead
+//	JAEGER_USER, JAEGER_PASSWORD      basic auth for the collector
+//	JAEGER_REPORTER_MAX_QUEUE_SIZE    spans kept before dropping new ones
+//	JAEGER_REPORTER_FLUSH_INTERVAL    e.g. 1s
+//	JAEGER_REPORTER_LOG_SPANS         true logs every span
+//	JAEGER_TAGS                       global tags, e.g. "env=prod,pod=${POD_NAME:unknown}"
+//
+// and the standard OpenTelemetry ones for the OTLP backend:
+//
+//	OTEL_TRACES_EXPORTER              otlp selects the OTLP backend, memory the Recorder, none disables tracing
+//	OTEL_EXPORTER_OTLP_ENDPOINT       e.g. http://collector:4318, http is insecure, a path gets /v1/traces appended
+//	OTEL_EXPORTER_OTLP_PROTOCOL       http/protobuf or grpc
+//	OTEL_EXPORTER_OTLP_HEADERS        e.g. "api-key=secret"
+//	OTEL_PROPAGATORS                  e.g. "tracecontext,baggage,b3multi", for either backend
+//
+// and our own for tail sampling, with the Jaeger or memory backend:
+//
+//	TRACING_TAIL_SAMPLING             true keeps traces as they end (sent on as sampled), see tail.go
+//	TRACING_TAIL_LATENCY              e.g. 500ms, slower traces are kept
+//	TRACING_TAIL_RATE                 e.g. 0.01, of the other traces kept
+//	TRACING_TAIL_MAX_SPANS            spans buffered before deciding early
+
+const (
+	dflAgentHost          = "localhost"
+	dflAgentPort          = "6831"
+	dflSamplerType        = jaeger.SamplerTypeRemote
+	dflSamplerParam       = 0.001 // until the remote strategy is known
+	dflReporterFlushEvery = 1 * time.Second
+)
+
+// Options describes the tracer options. The zero value traces to an agent
+// on localhost, with the sampling strategy set remotely by the agent.
+type Options struct {
+	Disabled bool   // returns a no-op tracer
+	Backend  string // jaeger, otlp or memory, = jaeger
+
+	SamplerType       string  // const, probabilistic, rateLimiting or remote, = remote (probabilistic for otlp)
+	SamplerParam      float64 // see the Jaeger sampler docs, = 0.001 for remote or the otlp default
+	SamplingServerURL string  // agent sampling server for remote, = http://localhost:5778/sampling
+
+	AgentHost         string // = localhost
+	AgentPort         string // = 6831
+	CollectorEndpoint string // e.g. http://jaeger-collector:14268/api/traces, overrides the agent
+	CollectorUser     string // basic auth for the collector
+	CollectorPassword string
+
+	QueueSize     int           // spans kept before dropping new ones, = 100
+	FlushInterval time.Duration // = 1 second
+	LogSpans      bool          // log every span as well
+
+	Tags map[string]string // global tags on every span
+
+	Propagators []string // header formats, see PropagatorTraceContext, = tracecontext, baggage and jaeger
+
+	OTLPEndpoint string            // collector host:port, = localhost:4318 or localhost:4317 for grpc
+	OTLPPath     string            // URL path for http/protobuf, e.g. /otlp/v1/traces behind a gateway, = /v1/traces
+	OTLPProtocol string            // http/protobuf or grpc, = http/protobuf
+	OTLPInsecure bool              // plain HTTP or gRPC without TLS
+	OTLPHeaders  map[string]string // sent with every export, e.g. an API key
+
+	Recorder *Recorder // keeps the spans with the memory backend
+
+	TailSampling bool          // sample every request, keep traces as they end, see tail.go
+	TailLatency  time.Duration // traces this slow are kept, = 1 second
+	TailRate     float64       // probability of keeping any other trace, = 0.01
+	TailMaxSpans int           // spans buffered, = 10000
+	TailMaxWait  time.Duration // a trace is buffered, = 30 seconds
+}
+
+// FromEnv returns opts overridden by the standard JAEGER_* environment
+// variables that are set.
+func FromEnv(opts Options) (Options, error) {
+	var err error
+
+	if v := os.Getenv("JAEGER_DISABLED"); v != "" {
+		opts.Disabled, err = strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse JAEGER_DISABLED")
+		}
+	}
+	if v := os.Getenv("JAEGER_SAMPLER_TYPE"); v != "" {
+		opts.SamplerType = v
+	}
+	if v := os.Getenv("JAEGER_SAMPLER_PARAM"); v != "" {
+		opts.SamplerParam, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse JAEGER_SAMPLER_PARAM")
+		}
+	}
+	if v := os.Getenv("JAEGER_SAMPLER_MANAGER_HOST_PORT"); v != "" {
+		opts.SamplingServerURL = "http://" + v + "/sampling"
+	}
+	if v := os.Getenv("JAEGER_AGENT_HOST"); v != "" {
+		opts.AgentHost = v
+	}
+	if v := os.Getenv("JAEGER_AGENT_PORT"); v != "" {
+		opts.AgentPort = v
+	}
+	if v := os.Getenv("JAEGER_ENDPOINT"); v != "" {
+		opts.CollectorEndpoint = v
+	}
+	if v := os.Getenv("JAEGER_USER"); v != "" {
+		opts.CollectorUser = v
+	}
+	if v := os.Getenv("JAEGER_PASSWORD"); v != "" {
+		opts.CollectorPassword = v
+	}
+	if v := os.Getenv("JAEGER_REPORTER_MAX_QUEUE_SIZE"); v != "" {
+		opts.QueueSize, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse JAEGER_REPORTER_MAX_QUEUE_SIZE")
+		}
+	}
+	if v := os.Getenv("JAEGER_REPORTER_FLUSH_INTERVAL"); v != "" {
+		opts.FlushInterval, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse JAEGER_REPORTER_FLUSH_INTERVAL")
+		}
+	}
+	if v := os.Getenv("JAEGER_REPORTER_LOG_SPANS"); v != "" {
+		opts.LogSpans, err = strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse JAEGER_REPORTER_LOG_SPANS")
+		}
+	}
+	if v := os.Getenv("JAEGER_TAGS"); v != "" {
+		tags := parseTags(v)
+		for k, v := range opts.Tags {
+			if _, ok := tags[k]; !ok {
+				tags[k] = v
+			}
+		}
+		opts.Tags = tags
+	}
+
+	switch v := os.Getenv("OTEL_TRACES_EXPORTER"); v {
+	case "":
+	case "none":
+		opts.Disabled = true
+	case BackendJaeger, BackendOTLP, BackendMemory:
+		opts.Backend = v
+	default:
+		return opts, errors.Errorf("unsupported OTEL_TRACES_EXPORTER %q", v)
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		opts.OTLPEndpoint, opts.OTLPPath, opts.OTLPInsecure, err = parseEndpoint(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); v != "" {
+		opts.OTLPProtocol = v
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		opts.OTLPHeaders = parseTags(v)
+	}
+	if v := os.Getenv("TRACING_TAIL_SAMPLING"); v != "" {
+		opts.TailSampling, err = strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse TRACING_TAIL_SAMPLING")
+		}
+	}
+	if v := os.Getenv("TRACING_TAIL_LATENCY"); v != "" {
+		opts.TailLatency, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse TRACING_TAIL_LATENCY")
+		}
+	}
+	if v := os.Getenv("TRACING_TAIL_RATE"); v != "" {
+		opts.TailRate, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse TRACING_TAIL_RATE")
+		}
+	}
+	if v := os.Getenv("TRACING_TAIL_MAX_SPANS"); v != "" {
+		opts.TailMaxSpans, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, errors.Wrap(err, "cannot parse TRACING_TAIL_MAX_SPANS")
+		}
+	}
+	if v := os.Getenv("OTEL_PROPAGATORS"); v != "" {
+		opts.Propagators = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Propagators = append(opts.Propagators, name)
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+// parseTags parses "key=value" pairs separated by commas. Values of the
+// form ${ENV_VAR:default} are taken from the environment.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if strings.HasPrefix(v, "${") && strings.HasSuffix(v, "}") {
+			ed := strings.SplitN(v[2:len(v)-1], ":", 2)
+			v = os.Getenv(ed[0])
+			if v == "" && len(ed) == 2 {
+				v = ed[1]
+			}
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// sampler returns the sampler type and param with the defaults applied
+func (o Options) sampler() (string, float64) {
+	if o.TailSampling {
+		// the tail reporter decides
+		return jaeger.SamplerTypeConst, 1
+	}
+	if o.SamplerType == "" && o.Backend == BackendMemory {
+		// no agent to ask, and we're here to see every trace
+		return jaeger.SamplerTypeConst, 1
+	}
+	if o.SamplerType == "" && o.Backend == BackendOTLP {
+		// no agent to ask, so the rate remote sampling starts at
+		if o.SamplerParam == 0 {
+			o.SamplerParam = dflSamplerParam
+		}
+		return jaeger.SamplerTypeProbabilistic, o.SamplerParam
+	}
+	if o.SamplerType == "" {
+		o.SamplerType = dflSamplerType
+	}
+	if o.SamplerType == jaeger.SamplerTypeRemote && o.SamplerParam == 0 {
+		o.SamplerParam = dflSamplerParam
+	}
+	return o.SamplerType, o.SamplerParam
+}
+
+// newReporter returns a reporter sending spans to the collector if there
+// is an endpoint, or to the agent over UDP.
+func (o Options) newReporter(metricsFactory metrics.Factory, logger jaeger.Logger) (jaeger.Reporter, error) {
+	var sender jaeger.Transport
+	if o.CollectorEndpoint != "" {
+		var opts []transport.HTTPOption
+		if o.CollectorUser != "" {
+			opts = append(opts, transport.HTTPBasicAuth(o.CollectorUser, o.CollectorPassword))
+		}
+		sender = transport.NewHTTPTransport(o.CollectorEndpoint, opts...)
+	} else {
+		host, port := o.AgentHost, o.AgentPort
+		if host == "" {
+			host = dflAgentHost
+		}
+		if port == "" {
+			port = dflAgentPort
+		}
+		var err error
+		sender, err = jaeger.NewUDPTransport(net.JoinHostPort(host, port), 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create agent transport")
+		}
+	}
+
+	flush := o.FlushInterval
+	if flush <= 0 {
+		flush = dflReporterFlushEvery
+	}
+	opts := []jaeger.ReporterOption{
+		jaeger.ReporterOptions.BufferFlushInterval(flush),
+		jaeger.ReporterOptions.Logger(logger),
+		jaeger.ReporterOptions.Metrics(jaeger.NewMetrics(metricsFactory, nil)),
+	}
+	if o.QueueSize > 0 {
+		opts = append(opts, jaeger.ReporterOptions.QueueSize(o.QueueSize))
+	}
+
+	reporter := jaeger.NewRemoteReporter(sender, opts...)
+	if o.LogSpans {
+		reporter = jaeger.NewCompositeReporter(jaeger.NewLoggingReporter(logger), reporter)
+	}
+	return reporter, nil
+}
@@ -0,0 +1,152 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"JAEGER_DISABLED":                  "false",
+		"JAEGER_SAMPLER_TYPE":              "probabilistic",
+		"JAEGER_SAMPLER_PARAM":             "0.25",
+		"JAEGER_SAMPLER_MANAGER_HOST_PORT": "agent:5778",
+		"JAEGER_AGENT_HOST":                "agent",
+		"JAEGER_AGENT_PORT":                "6832",
+		"JAEGER_ENDPOINT":                  "http://collector:14268/api/traces",
+		"JAEGER_USER":                      "user",
+		"JAEGER_PASSWORD":                  "secret",
+		"JAEGER_REPORTER_MAX_QUEUE_SIZE":   "500",
+		"JAEGER_REPORTER_FLUSH_INTERVAL":   "5s",
+		"JAEGER_REPORTER_LOG_SPANS":        "true",
+		"JAEGER_TAGS":                      "env=prod, pod=${TEST_POD_NAME:unknown},zone=${TEST_ZONE}",
+		"TEST_ZONE":                        "us-west-1",
+		"TRACING_TAIL_SAMPLING":            "true",
+		"TRACING_TAIL_LATENCY":             "500ms",
+		"TRACING_TAIL_RATE":                "0.05",
+		"TRACING_TAIL_MAX_SPANS":           "2000",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	opts, err := FromEnv(Options{
+		SamplerType: "const",
+		Tags:        map[string]string{"env": "dev", "team": "web"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Options{
+		SamplerType:       "probabilistic",
+		SamplerParam:      0.25,
+		SamplingServerURL: "http://agent:5778/sampling",
+		AgentHost:         "agent",
+		AgentPort:         "6832",
+		CollectorEndpoint: "http://collector:14268/api/traces",
+		CollectorUser:     "user",
+		CollectorPassword: "secret",
+		QueueSize:         500,
+		FlushInterval:     5 * time.Second,
+		LogSpans:          true,
+		Tags:              map[string]string{"env": "prod", "pod": "unknown", "zone": "us-west-1", "team": "web"},
+		TailSampling:      true,
+		TailLatency:       500 * time.Millisecond,
+		TailRate:          0.05,
+		TailMaxSpans:      2000,
+	}, opts)
+
+	// invalid values are errors
+	for _, k := range []string{"JAEGER_DISABLED", "JAEGER_SAMPLER_PARAM", "JAEGER_REPORTER_MAX_QUEUE_SIZE", "JAEGER_REPORTER_FLUSH_INTERVAL", "TRACING_TAIL_SAMPLING", "TRACING_TAIL_LATENCY", "TRACING_TAIL_RATE", "TRACING_TAIL_MAX_SPANS"} {
+		os.Setenv(k, "invalid")
+		_, err := FromEnv(Options{})
+		assert.Error(t, err, k)
+		os.Setenv(k, env[k])
+	}
+}
+
+func TestSampler(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		opts  Options
+		typ   string
+		param float64
+	}{
+		{Options{}, "remote", 0.001},
+		{Options{SamplerParam: 0.5}, "remote", 0.5},
+		{Options{SamplerType: "const"}, "const", 0},
+		{Options{SamplerType: "probabilistic", SamplerParam: 0.1}, "probabilistic", 0.1},
+		{Options{Backend: BackendMemory}, "const", 1},
+		{Options{Backend: BackendMemory, SamplerType: "probabilistic", SamplerParam: 0.1}, "probabilistic", 0.1},
+		{Options{Backend: BackendOTLP}, "probabilistic", 0.001},
+		{Options{Backend: BackendOTLP, SamplerParam: 0.5}, "probabilistic", 0.5},
+		{Options{Backend: BackendOTLP, SamplerType: "remote"}, "remote", 0.001}, // rejected
+	}
+
+	for _, tt := range tests {
+		typ, param := tt.opts.sampler()
+		if typ != tt.typ || param != tt.param {
+			t.Errorf("%+v: got %v %v want %v %v", tt.opts, typ, param, tt.typ, tt.param)
+		}
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{Disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, opentracing.NoopTracer{}, tracer)
+	assert.NoError(t, closer.Close())
+}
+
+func TestCollectorEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	var user string
+	spans := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		user, _, _ = r.BasicAuth()
+		mu.Unlock()
+		select {
+		case spans <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		SamplerType:       "const",
+		SamplerParam:      1,
+		CollectorEndpoint: srv.URL,
+		CollectorUser:     "user",
+		CollectorPassword: "secret",
+		Tags:              map[string]string{"env": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer.StartSpan("test").Finish()
+	closer.Close() // flushes
+
+	select {
+	case <-spans:
+	case <-time.After(time.Second):
+		t.Fatal("no spans sent to the collector")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "user", user)
+}
@@ -0,0 +1,277 @@
+package tracing
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kit "github.com/go-kit/kit/metrics"
+	kitexpvar "github.com/go-kit/kit/metrics/expvar"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/go-kit"
+	"github.com/uber/jaeger-lib/metrics/multi"
+)
+
+// jaeger-lib ships a Prometheus factory as well, but the version that
+// goes with our Jaeger client predates client_golang v1, so we bridge it
+// ourselves.
+
+const (
+	expvarBuckets = 10 // buckets for expvar histograms
+)
+
+var (
+	// turns jaeger names (e.g. "jaeger-rpc.http_requests") into valid
+	// Prometheus names
+	normalizer = strings.NewReplacer(".", "_", "-", "_", ":", "_", " ", "_", "/", "_")
+)
+
+// MetricsOptions describes the tracer metrics options
+type MetricsOptions struct {
+	Registerer prometheus.Registerer // = prometheus.DefaultRegisterer
+	Buckets    []float64             // timer buckets in seconds, = prometheus.DefBuckets
+	Expvar     bool                  // publish on /debug/vars as well
+}
+
+// NewMetricsFactory returns a metrics factory for the tracer's internal
+// metrics and rpcmetrics. They are registered with the same Prometheus
+// registry as our HTTP metrics so all of our telemetry is served from
+// '/metrics', and optionally published to expvar as well.
+func NewMetricsFactory(opts ...MetricsOptions) metrics.Factory {
+	var opt MetricsOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Registerer == nil {
+		opt.Registerer = prometheus.DefaultRegisterer
+	}
+
+	var f metrics.Factory = &promFactory{
+		vecs: &vecs{
+			registerer: opt.Registerer,
+			buckets:    opt.Buckets,
+			collectors: make(map[string]prometheus.Collector),
+		},
+	}
+	if opt.Expvar {
+		f = multi.New(f, xkit.Wrap("", expvarFactory))
+	}
+	return f
+}
+
+// promFactory is a jaeger metrics.Factory backed by Prometheus. Each
+// metric name and set of tag names is one vector, tag values are labels.
+type promFactory struct {
+	vecs  *vecs // shared by all namespaces
+	scope string
+	tags  map[string]string
+}
+
+// vecs registers each vector once
+type vecs struct {
+	registerer prometheus.Registerer
+	buckets    []float64
+
+	mu         sync.Mutex
+	collectors map[string]prometheus.Collector
+}
+
+// get returns the vector registered for name and labels, creating it with
+// create if needed. It returns nil, once logged, if the vector can't be
+// registered, e.g. name is already registered with other labels.
+func (v *vecs) get(name string, labels []string, create func() prometheus.Collector) prometheus.Collector {
+	key := name + "|" + strings.Join(labels, ",")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.collectors[key]
+	if !ok {
+		c = create()
+		err := v.registerer.Register(c)
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			c, err = are.ExistingCollector, nil
+		}
+		if err != nil {
+			logger.Error("tracer metric dropped", "name", name, "labels", labels, "err", err)
+			c = nil
+		}
+		v.collectors[key] = c
+	}
+	return c
+}
+
+// Counter implements metrics.Factory
+func (f *promFactory) Counter(name string, tags map[string]string) metrics.Counter {
+	name, labels, values := f.resolve(name, tags)
+	vec := f.vecs.get(name, labels, func() prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: name}, labels)
+	})
+	if cv, ok := vec.(*prometheus.CounterVec); ok {
+		return &counter{cv.WithLabelValues(values...)}
+	}
+	return metrics.NullCounter
+}
+
+// Gauge implements metrics.Factory
+func (f *promFactory) Gauge(name string, tags map[string]string) metrics.Gauge {
+	name, labels, values := f.resolve(name, tags)
+	vec := f.vecs.get(name, labels, func() prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: name}, labels)
+	})
+	if gv, ok := vec.(*prometheus.GaugeVec); ok {
+		return &gauge{gv.WithLabelValues(values...)}
+	}
+	return metrics.NullGauge
+}
+
+// Timer implements metrics.Factory
+func (f *promFactory) Timer(name string, tags map[string]string) metrics.Timer {
+	name, labels, values := f.resolve(name, tags)
+	vec := f.vecs.get(name, labels, func() prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name + "_seconds",
+			Help:    name,
+			Buckets: f.vecs.buckets,
+		}, labels)
+	})
+	if hv, ok := vec.(*prometheus.HistogramVec); ok {
+		return &timer{hv.WithLabelValues(values...)}
+	}
+	return metrics.NullTimer
+}
+
+// Namespace implements metrics.Factory
+func (f *promFactory) Namespace(name string, tags map[string]string) metrics.Factory {
+	return &promFactory{
+		vecs:  f.vecs,
+		scope: f.name(name),
+		tags:  f.merge(tags),
+	}
+}
+
+// resolve returns the full metric name, its sorted label names and their
+// values
+func (f *promFactory) resolve(name string, tags map[string]string) (string, []string, []string) {
+	byLabel := make(map[string]string)
+	for k, v := range f.merge(tags) {
+		byLabel[normalizer.Replace(k)] = v
+	}
+	labels := make([]string, 0, len(byLabel))
+	for l := range byLabel {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	values := make([]string, 0, len(labels))
+	for _, l := range labels {
+		values = append(values, byLabel[l])
+	}
+	return f.name(name), labels, values
+}
+
+// name returns name in our scope
+func (f *promFactory) name(name string) string {
+	switch {
+	case f.scope == "":
+		return normalizer.Replace(name)
+	case name == "":
+		return f.scope
+	}
+	return f.scope + "_" + normalizer.Replace(name)
+}
+
+// merge returns our tags with tags added
+func (f *promFactory) merge(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(f.tags)+len(tags))
+	for k, v := range f.tags {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return merged
+}
+
+// expvarFactory publishes go-kit metrics to expvar. Unlike jaeger-lib's
+// it hands out the published metric again when a name is reused (the
+// Jaeger client creates its metrics more than once), instead of letting
+// expvar panic. Expvar is process wide, and so is the factory.
+var expvarFactory = &expvars{
+	counters:   make(map[string]kit.Counter),
+	gauges:     make(map[string]kit.Gauge),
+	histograms: make(map[string]kit.Histogram),
+}
+
+type expvars struct {
+	mu         sync.Mutex
+	counters   map[string]kit.Counter
+	gauges     map[string]kit.Gauge
+	histograms map[string]kit.Histogram
+}
+
+// Counter implements xkit.Factory
+func (e *expvars) Counter(name string) kit.Counter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.counters[name]
+	if !ok {
+		c = kitexpvar.NewCounter(name)
+		e.counters[name] = c
+	}
+	return c
+}
+
+// Gauge implements xkit.Factory
+func (e *expvars) Gauge(name string) kit.Gauge {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	g, ok := e.gauges[name]
+	if !ok {
+		g = kitexpvar.NewGauge(name)
+		e.gauges[name] = g
+	}
+	return g
+}
+
+// Histogram implements xkit.Factory
+func (e *expvars) Histogram(name string) kit.Histogram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h, ok := e.histograms[name]
+	if !ok {
+		h = kitexpvar.NewHistogram(name, expvarBuckets)
+		e.histograms[name] = h
+	}
+	return h
+}
+
+// Capabilities implements xkit.Factory
+func (e *expvars) Capabilities() xkit.Capabilities {
+	return xkit.Capabilities{Tagging: false}
+}
+
+type counter struct {
+	counter prometheus.Counter
+}
+
+func (c *counter) Inc(delta int64) {
+	c.counter.Add(float64(delta))
+}
+
+type gauge struct {
+	gauge prometheus.Gauge
+}
+
+func (g *gauge) Update(value int64) {
+	g.gauge.Set(float64(value))
+}
+
+type timer struct {
+	observer prometheus.Observer
+}
+
+func (t *timer) Record(d time.Duration) {
+	t.observer.Observe(d.Seconds())
+}
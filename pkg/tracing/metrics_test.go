@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+func TestNewMetricsFactory(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		expvar bool
+	}{
+		{false},
+		{true},
+	}
+
+	for _, tt := range tests {
+		reg := prometheus.NewRegistry()
+		f := NewMetricsFactory(MetricsOptions{Registerer: reg, Expvar: tt.expvar})
+
+		tracer, closer, err := Init("test", f.Namespace("test", nil), Options{SamplerType: "const", SamplerParam: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		span := tracer.StartSpan("test")
+		span.Finish()
+		closer.Close()
+
+		// the tracer's internal metrics are in our registry
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, mf := range mfs {
+			names = append(names, mf.GetName())
+		}
+		assert.Contains(t, names, "test_jaeger_finished_spans", "expvar: %v", tt.expvar)
+	}
+}
+
+func TestMetricsFactoryConflict(t *testing.T) {
+	var b bytes.Buffer
+	err := logging.Init(logging.Options{Output: &b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Init(logging.Options{Output: os.Stderr})
+
+	// the same name with other labels can't be registered
+	f := NewMetricsFactory(MetricsOptions{Registerer: prometheus.NewRegistry()})
+	f.Counter("requests", map[string]string{"a": "1"}).Inc(1)
+	c := f.Counter("requests", map[string]string{"b": "1"})
+	c.Inc(1)
+	assert.Equal(t, metrics.NullCounter, c)
+	assert.Contains(t, b.String(), "tracer metric dropped")
+	assert.Contains(t, b.String(), "name=requests")
+}
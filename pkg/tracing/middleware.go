@@ -0,0 +1,130 @@
+package tracing
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/urfave/negroni"
+)
+
+// The nethttp middleware starts the server span before the router has
+// run, so it can only name it by method. Middleware renames the span by
+// the route pattern once the route is matched, so all of '/hello/bob'
+// and '/hello/alice' are the one operation "HTTP GET /hello/:name", and
+// tags it. Install it right after negroni's Recovery and hand LogPanic
+// to the Recovery, so panics end up on the span too:
+//
+//	recovery := negroni.NewRecovery()
+//	recovery.PanicHandlerFunc = tracing.LogPanic
+//	n.Use(recovery)
+//	n.Use(tracing.NewMiddleware())
+//
+// A request with the DebugHeader (or Jaeger's own jaeger-debug-id) is
+// traced whatever the sampler says.
+
+// DebugHeader asks for the request to be traced, e.g. X-Trace-Debug: 1
+const DebugHeader = "X-Trace-Debug"
+
+const (
+	tagRoute        = "http.route"
+	tagUserAgent    = "http.user_agent"
+	tagClientIP     = "http.client_ip"
+	tagRequestSize  = "http.request_content_length"
+	tagResponseSize = "http.response_content_length"
+)
+
+// Middleware is a Negroni middleware naming and tagging the server span
+// started by the nethttp middleware
+type Middleware struct{}
+
+// NewMiddleware returns a new tracing Middleware
+func NewMiddleware() *Middleware {
+	return &Middleware{}
+}
+
+// OperationName returns the name of the server span of a request matching
+// pattern, route.Other if none matched
+func OperationName(method, pattern string) string {
+	return "HTTP " + method + " " + pattern
+}
+
+func (m *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	span := opentracing.SpanFromContext(r.Context())
+	if span == nil {
+		next(rw, r)
+		return
+	}
+
+	r = route.New(r)
+	route.OnSet(r, func(pattern string) {
+		span.SetOperationName(OperationName(r.Method, pattern))
+		span.SetTag(tagRoute, pattern)
+	})
+
+	if ua := r.UserAgent(); ua != "" {
+		span.SetTag(tagUserAgent, ua)
+	}
+	if ip := clientIP(r); ip != "" {
+		span.SetTag(tagClientIP, ip)
+	}
+	if r.ContentLength >= 0 {
+		span.SetTag(tagRequestSize, r.ContentLength)
+	}
+	if r.Header.Get(DebugHeader) != "" || r.Header.Get(jaeger.JaegerDebugHeader) != "" {
+		ext.SamplingPriority.Set(span, 1)
+	}
+
+	next(rw, r)
+
+	if route.Pattern(r) == "" {
+		span.SetOperationName(OperationName(r.Method, route.Other))
+	}
+
+	res := rw.(negroni.ResponseWriter)
+	status := res.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ext.HTTPStatusCode.Set(span, uint16(status))
+	span.SetTag(tagResponseSize, res.Size())
+	if status >= http.StatusInternalServerError {
+		ext.Error.Set(span, true)
+	}
+}
+
+// clientIP returns the IP of the client (or the proxy in front of us)
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LogPanic logs a panic recovered by negroni's Recovery onto the span of
+// the request, with its stack. Use it as the Recovery's PanicHandlerFunc.
+func LogPanic(info *negroni.PanicInformation) {
+	span := opentracing.SpanFromContext(info.Request.Context())
+	if span == nil {
+		return
+	}
+
+	stack := info.Stack
+	if stack == nil {
+		stack = debug.Stack()
+	}
+	ext.Error.Set(span, true)
+	ext.HTTPStatusCode.Set(span, http.StatusInternalServerError)
+	span.LogFields(
+		log.String("event", "panic"),
+		log.String("message", fmt.Sprint(info.RecoveredPanic)),
+		log.String("stack", string(stack)),
+	)
+}
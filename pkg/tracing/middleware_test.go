@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dstroot/simple-go-webserver/pkg/route"
+	"github.com/julienschmidt/httprouter"
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/urfave/negroni"
+)
+
+func TestMiddleware(t *testing.T) {
+	tracer := mocktracer.New()
+
+	r := httprouter.New()
+	r.GET("/hello/:name", route.Handle("/hello/:name", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte("hello"))
+	}))
+	r.GET("/fail", route.Handle("/fail", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		http.Error(w, "failed", http.StatusServiceUnavailable)
+	}))
+	r.GET("/panic", route.Handle("/panic", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		panic("boom")
+	}))
+
+	recovery := negroni.NewRecovery()
+	recovery.Logger = log.New(ioutil.Discard, "", 0)
+	recovery.PanicHandlerFunc = LogPanic
+
+	n := negroni.New()
+	n.Use(recovery)
+	n.Use(NewMiddleware())
+	n.UseHandler(r)
+	h := nethttp.Middleware(tracer, n)
+
+	// test data
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		name   string
+		status uint16
+		size   int
+		error  bool
+	}{
+		{"GET", "/hello/bob", "", "HTTP GET /hello/:name", 200, 5, false},
+		{"GET", "/hello/alice", "", "HTTP GET /hello/:name", 200, 5, false},
+		{"POST", "/hello/bob", "data", "HTTP POST other", 405, 19, false},
+		{"GET", "/nonexistent", "", "HTTP GET other", 404, 19, false},
+		{"GET", "/fail", "", "HTTP GET /fail", 503, 7, true},
+		{"GET", "/panic", "", "HTTP GET /panic", 500, -1, true},
+	}
+
+	for _, tt := range tests {
+		tracer.Reset()
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("User-Agent", "test/1.0")
+		req.RemoteAddr = "10.0.0.1:54321"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := tracer.FinishedSpans()
+		if !assert.Len(t, spans, 1, tt.path) {
+			continue
+		}
+		span := spans[0]
+		assert.Equal(t, tt.name, span.OperationName, tt.path)
+		assert.Equal(t, tt.status, span.Tag("http.status_code"), tt.path)
+		assert.Equal(t, "test/1.0", span.Tag(tagUserAgent), tt.path)
+		assert.Equal(t, "10.0.0.1", span.Tag(tagClientIP), tt.path)
+		assert.Equal(t, int64(len(tt.body)), span.Tag(tagRequestSize), tt.path)
+		if tt.size >= 0 {
+			assert.Equal(t, tt.size, span.Tag(tagResponseSize), tt.path)
+		}
+		if tt.error {
+			assert.Equal(t, true, span.Tag("error"), tt.path)
+		} else {
+			assert.Nil(t, span.Tag("error"), tt.path)
+		}
+	}
+
+	// the panic is logged with its stack
+	logs := tracer.FinishedSpans()[0].Logs()
+	if assert.Len(t, logs, 1) {
+		fields := map[string]string{}
+		for _, f := range logs[0].Fields {
+			fields[f.Key] = f.ValueString
+		}
+		assert.Equal(t, "panic", fields["event"])
+		assert.Equal(t, "boom", fields["message"])
+		assert.Contains(t, fields["stack"], "middleware_test.go")
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	// a tracer sampling nothing, unless asked to
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(false), reporter)
+	defer closer.Close()
+
+	n := negroni.New(NewMiddleware())
+	n.UseHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := nethttp.Middleware(tracer, n)
+
+	// test data
+	var tests = []struct {
+		header string
+		value  string
+		traced bool
+	}{
+		{DebugHeader, "1", true},
+		{"jaeger-debug-id", "abc", true},
+		{"X-Other", "1", false},
+	}
+
+	for _, tt := range tests {
+		reporter.Reset()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(tt.header, tt.value)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if tt.traced {
+			if assert.Equal(t, 1, reporter.SpansSubmitted(), tt.header) {
+				sc := reporter.GetSpans()[0].Context().(jaeger.SpanContext)
+				assert.True(t, sc.IsDebug(), tt.header)
+			}
+		} else {
+			assert.Equal(t, 0, reporter.SpansSubmitted(), tt.header)
+		}
+	}
+}
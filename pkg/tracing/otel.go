@@ -0,0 +1,256 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	jaeger "github.com/uber/jaeger-client-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// With Backend set to "otlp" Init returns an OpenTelemetry SDK tracer
+// exporting to an OpenTelemetry collector over OTLP instead. The tracer
+// is wrapped in the opentracing bridge, so the nethttp middleware and
+// our existing span code keep working unchanged. The sampler, queue size,
+// flush interval, tags and propagators carry over, the Jaeger agent and
+// collector settings do not.
+//
+// Only the const and probabilistic samplers carry over, as ParentBased
+// AlwaysSample/NeverSample and TraceIDRatioBased samplers. OpenTelemetry
+// has no remote or rate limiting sampling, so those are rejected, and the
+// default is probabilistic at 0.001, the rate remote sampling starts at.
+
+const (
+	BackendJaeger = "jaeger"
+	BackendOTLP   = "otlp"
+	BackendMemory = "memory" // a Recorder, see recorder.go
+
+	ProtocolHTTP = "http/protobuf"
+	ProtocolGRPC = "grpc"
+
+	dflShutdownTimeout = 5 * time.Second
+	otlpTracesPath     = "/v1/traces"
+)
+
+// initOTLP returns an opentracing tracer backed by the OpenTelemetry SDK
+func initOTLP(serviceName string, opt Options) (opentracing.Tracer, io.Closer, error) {
+	sampler, err := opt.otelSampler()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	propagator, err := opt.otelPropagator()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exporter, err := opt.newExporter(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flush := opt.FlushInterval
+	if flush <= 0 {
+		flush = dflReporterFlushEvery
+	}
+	batch := []sdktrace.BatchSpanProcessorOption{sdktrace.WithBatchTimeout(flush)}
+	if opt.QueueSize > 0 {
+		batch = append(batch, sdktrace.WithMaxQueueSize(opt.QueueSize))
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(serviceName)}
+	for k, v := range opt.Tags {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithBatcher(exporter, batch...),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+	)
+
+	bridge, _ := otbridge.NewTracerPair(tp.Tracer(serviceName))
+	bridge.SetTextMapPropagator(propagator)
+	bridge.SetWarningHandler(func(msg string) {
+		// the SDK never defers its context setup, which is harmless as the
+		// bridge sets the context up itself
+		if strings.Contains(msg, "deferred the context setup") {
+			return
+		}
+		logger.Warn("opentracing bridge", "warning", strings.TrimSpace(msg))
+	})
+
+	return &baggageTracer{bridge, propagator}, &providerCloser{tp}, nil
+}
+
+// otelSampler maps our sampler options onto an OpenTelemetry sampler
+func (o Options) otelSampler() (sdktrace.Sampler, error) {
+	typ, param := o.sampler()
+
+	var s sdktrace.Sampler
+	switch typ {
+	case jaeger.SamplerTypeConst:
+		s = sdktrace.NeverSample()
+		if param != 0 {
+			s = sdktrace.AlwaysSample()
+		}
+	case jaeger.SamplerTypeProbabilistic:
+		s = sdktrace.TraceIDRatioBased(param)
+	default:
+		return nil, errors.Errorf("sampler type %q is not supported by the %s backend, use %s or %s",
+			typ, BackendOTLP, jaeger.SamplerTypeConst, jaeger.SamplerTypeProbabilistic)
+	}
+
+	// follow the decision of the caller's trace, if any
+	return sdktrace.ParentBased(s), nil
+}
+
+// newExporter returns an OTLP exporter for our endpoint and protocol
+func (o Options) newExporter(ctx context.Context) (*otlptrace.Exporter, error) {
+	switch o.OTLPProtocol {
+	case "", ProtocolHTTP:
+		var opts []otlptracehttp.Option
+		if o.OTLPEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(o.OTLPEndpoint))
+		}
+		if o.OTLPPath != "" {
+			opts = append(opts, otlptracehttp.WithURLPath(o.OTLPPath))
+		}
+		if o.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(o.OTLPHeaders) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(o.OTLPHeaders))
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		return exp, errors.Wrap(err, "cannot create OTLP/HTTP exporter")
+
+	case ProtocolGRPC:
+		if o.OTLPPath != "" {
+			return nil, errors.Errorf("OTLP/gRPC endpoints have no URL path, got %q", o.OTLPPath)
+		}
+		var opts []otlptracegrpc.Option
+		if o.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(o.OTLPEndpoint))
+		}
+		if o.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		if len(o.OTLPHeaders) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(o.OTLPHeaders))
+		}
+		exp, err := otlptracegrpc.New(ctx, opts...)
+		return exp, errors.Wrap(err, "cannot create OTLP/gRPC exporter")
+	}
+
+	return nil, errors.Errorf("unknown OTLP protocol %q", o.OTLPProtocol)
+}
+
+// parseEndpoint splits an OTLP endpoint URL (e.g. "http://collector:4318")
+// into the host:port the exporters want, the URL path of the traces and
+// whether it is insecure. As the OpenTelemetry spec has it, a path in the
+// URL is a base the traces path "/v1/traces" is appended to, e.g.
+// "https://gateway/otlp" exports to "/otlp/v1/traces". A bare host:port
+// is returned as is.
+func parseEndpoint(s string) (string, string, bool, error) {
+	if !strings.Contains(s, "://") {
+		return s, "", false, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", false, err
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	if path != "" {
+		path += otlpTracesPath
+	}
+	switch u.Scheme {
+	case "http":
+		return u.Host, path, true, nil
+	case "https":
+		return u.Host, path, false, nil
+	}
+	return "", "", false, errors.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+// providerCloser flushes and shuts down a tracer provider
+type providerCloser struct {
+	tp *sdktrace.TracerProvider
+}
+
+func (c *providerCloser) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dflShutdownTimeout)
+	defer cancel()
+	return c.tp.Shutdown(ctx)
+}
+
+// baggageTracer starts requests with baggage but no trace context as a
+// new root carrying the baggage, where the bridge drops it
+type baggageTracer struct {
+	*otbridge.BridgeTracer
+	propagator propagation.TextMapPropagator
+}
+
+// baggageContext is the baggage of a request without a trace context. The
+// bridge ignores it as a reference, so StartSpan adds the items itself.
+type baggageContext map[string]string
+
+// ForeachBaggageItem implements opentracing.SpanContext
+func (b baggageContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range b {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+// Extract implements opentracing.Tracer
+func (t *baggageTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	sc, err := t.BridgeTracer.Extract(format, carrier)
+	if err != opentracing.ErrSpanContextNotFound {
+		return sc, err
+	}
+	// the bridge only gets this far with http headers
+	h := http.Header(carrier.(opentracing.HTTPHeadersCarrier))
+	members := baggage.FromContext(t.propagator.Extract(context.Background(), propagation.HeaderCarrier(h))).Members()
+	if len(members) == 0 {
+		return nil, err
+	}
+	b := make(baggageContext, len(members))
+	for _, m := range members {
+		b[m.Key()] = m.Value()
+	}
+	return b, nil
+}
+
+// StartSpan implements opentracing.Tracer
+func (t *baggageTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	span := t.BridgeTracer.StartSpan(operationName, opts...)
+	sso := opentracing.StartSpanOptions{}
+	for _, opt := range opts {
+		opt.Apply(&sso)
+	}
+	for _, ref := range sso.References {
+		if b, ok := ref.ReferencedContext.(baggageContext); ok {
+			for k, v := range b {
+				span.SetBaggageItem(k, v)
+			}
+		}
+	}
+	return span
+}
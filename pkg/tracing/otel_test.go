@@ -0,0 +1,292 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver stands in for an OpenTelemetry collector, keeping the spans
+// it is sent
+type receiver struct {
+	coltrace.UnimplementedTraceServiceServer
+
+	mu      sync.Mutex
+	spans   map[string]string // name -> hex trace ID
+	service string
+	apiKey  string
+}
+
+func newReceiver() *receiver {
+	return &receiver{spans: make(map[string]string)}
+}
+
+func (rc *receiver) keep(req *coltrace.ExportTraceServiceRequest, apiKey string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.apiKey = apiKey
+	for _, rs := range req.GetResourceSpans() {
+		for _, kv := range rs.GetResource().GetAttributes() {
+			if kv.GetKey() == "service.name" {
+				rc.service = kv.GetValue().GetStringValue()
+			}
+		}
+		for _, ils := range rs.GetInstrumentationLibrarySpans() {
+			for _, s := range ils.GetSpans() {
+				rc.spans[s.GetName()] = hex.EncodeToString(s.GetTraceId())
+			}
+		}
+	}
+}
+
+// ServeHTTP receives OTLP/HTTP
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc.keep(&req, r.Header.Get("api-key"))
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+// Export receives OTLP/gRPC
+func (rc *receiver) Export(ctx context.Context, req *coltrace.ExportTraceServiceRequest) (*coltrace.ExportTraceServiceResponse, error) {
+	var apiKey string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("api-key")) > 0 {
+		apiKey = md.Get("api-key")[0]
+	}
+	rc.keep(req, apiKey)
+	return &coltrace.ExportTraceServiceResponse{}, nil
+}
+
+// start serves rc over protocol and returns its host:port and a func to
+// stop it
+func (rc *receiver) start(t *testing.T, protocol string) (string, func()) {
+	if protocol == ProtocolHTTP {
+		ts := httptest.NewServer(rc)
+		return ts.Listener.Addr().String(), ts.Close
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	coltrace.RegisterTraceServiceServer(s, rc)
+	go s.Serve(lis)
+	return lis.Addr().String(), s.Stop
+}
+
+func TestOTLP(t *testing.T) {
+	const parent = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	for _, protocol := range []string{ProtocolHTTP, ProtocolGRPC} {
+		rc := newReceiver()
+		endpoint, stop := rc.start(t, protocol)
+
+		tracer, closer, err := Init("test", metrics.NullFactory, Options{
+			Backend:      BackendOTLP,
+			SamplerType:  "const",
+			SamplerParam: 1,
+			OTLPEndpoint: endpoint,
+			OTLPProtocol: protocol,
+			OTLPInsecure: true,
+			OTLPHeaders:  map[string]string{"api-key": "secret"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the nethttp middleware and span code work as they do with Jaeger
+		var id string
+		var sampled bool
+		h := nethttp.Middleware(tracer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, sampled = TraceID(r.Context())
+			span, _ := opentracing.StartSpanFromContextWithTracer(r.Context(), tracer, "child")
+			span.SetTag("hello", "test")
+			span.Finish()
+		}), nethttp.OperationNameFunc(func(r *http.Request) string {
+			return "HTTP " + r.Method
+		}))
+
+		// continuing the caller's W3C trace
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("traceparent", "00-"+parent+"-00f067aa0ba902b7-01")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		// flushes the spans
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		stop()
+
+		assert.Equal(t, parent, id, protocol)
+		assert.True(t, sampled, protocol)
+		assert.Equal(t, map[string]string{"HTTP GET": parent, "child": parent}, rc.spans, protocol)
+		assert.Equal(t, "test", rc.service, protocol)
+		assert.Equal(t, "secret", rc.apiKey, protocol)
+	}
+}
+
+func TestOTLPPath(t *testing.T) {
+
+	// a collector behind a gateway on /otlp
+	rc := newReceiver()
+	ts := httptest.NewServer(http.StripPrefix("/otlp", rc))
+	defer ts.Close()
+
+	endpoint, path, insecure, err := parseEndpoint(ts.URL + "/otlp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		Backend:      BackendOTLP,
+		SamplerType:  "const",
+		SamplerParam: 1,
+		OTLPEndpoint: endpoint,
+		OTLPPath:     path,
+		OTLPInsecure: insecure,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer.StartSpan("test").Finish()
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	assert.Contains(t, rc.spans, "test")
+}
+
+func TestOTLPErrors(t *testing.T) {
+	for _, opts := range []Options{
+		{Backend: "zipkin"},
+		{Backend: BackendOTLP, SamplerType: "rateLimiting", SamplerParam: 10},
+		{Backend: BackendOTLP, SamplerType: "remote"},
+		{Backend: BackendOTLP, OTLPProtocol: "http/json"},
+		{Backend: BackendOTLP, OTLPProtocol: ProtocolGRPC, OTLPPath: "/otlp/v1/traces"},
+	} {
+		_, _, err := Init("test", metrics.NullFactory, opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
+
+func TestOTLPSampler(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, "TraceIDRatioBased{0.001}"},
+		{Options{SamplerType: "probabilistic", SamplerParam: 0.5}, "TraceIDRatioBased{0.5}"},
+		{Options{SamplerType: "const", SamplerParam: 1}, "AlwaysOnSampler"},
+		{Options{SamplerType: "const"}, "AlwaysOffSampler"},
+	}
+
+	for _, tt := range tests {
+		tt.opts.Backend = BackendOTLP
+		s, err := tt.opts.otelSampler()
+		if assert.NoError(t, err, "%+v", tt.opts) {
+			assert.Contains(t, s.Description(), "root:"+tt.want, "%+v", tt.opts)
+		}
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		in       string
+		endpoint string
+		path     string
+		insecure bool
+		err      bool
+	}{
+		{"collector:4318", "collector:4318", "", false, false},
+		{"http://collector:4318", "collector:4318", "", true, false},
+		{"https://collector:4318/", "collector:4318", "", false, false},
+		{"https://gateway/otlp/", "gateway", "/otlp/v1/traces", false, false},
+		{"ftp://collector:4318", "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		endpoint, path, insecure, err := parseEndpoint(tt.in)
+		if tt.err {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.endpoint, endpoint, tt.in)
+		assert.Equal(t, tt.path, path, tt.in)
+		assert.Equal(t, tt.insecure, insecure, tt.in)
+	}
+}
+
+func TestFromEnvOTLP(t *testing.T) {
+	env := map[string]string{
+		"OTEL_TRACES_EXPORTER":        "otlp",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4317",
+		"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "api-key=secret",
+		"OTEL_PROPAGATORS":            "tracecontext, b3,",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	opts, err := FromEnv(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Options{
+		Backend:      BackendOTLP,
+		OTLPEndpoint: "collector:4317",
+		OTLPProtocol: ProtocolGRPC,
+		OTLPInsecure: true,
+		OTLPHeaders:  map[string]string{"api-key": "secret"},
+		Propagators:  []string{PropagatorTraceContext, PropagatorB3},
+	}, opts)
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "none")
+	opts, err = FromEnv(Options{})
+	assert.NoError(t, err)
+	assert.True(t, opts.Disabled)
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "memory")
+	opts, err = FromEnv(Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, BackendMemory, opts.Backend)
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	_, err = FromEnv(Options{})
+	assert.Error(t, err)
+}
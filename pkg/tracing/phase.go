@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// A request traced as one opaque server span doesn't tell where its time
+// went. Handlers wrap their phases (loading data, calling a service,
+// rendering) in child spans so the trace does:
+//
+//	err := tracing.Phase(r.Context(), "load items", func(ctx context.Context) error {
+//		items, err = store.Items(ctx)
+//		return err
+//	})
+//
+// or, when a closure is awkward:
+//
+//	span, ctx := tracing.StartPhase(r.Context(), "load items")
+//	defer span.Finish()
+
+// StartPhase starts a span for a phase of the request with context ctx,
+// a child of the span in ctx, and returns it with a context holding it
+// for nested phases. With no span in ctx the phase isn't traced: the span
+// is a no-op, rather than the root of a trace of its own.
+func StartPhase(ctx context.Context, name string) (opentracing.Span, context.Context) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return opentracing.NoopTracer{}.StartSpan(name), ctx
+	}
+	span := parent.Tracer().StartSpan(name, opentracing.ChildOf(parent.Context()))
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// Phase runs fn in a phase span (see StartPhase), and marks the span
+// failed if fn returns an error, which Phase returns
+func Phase(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	span, ctx := StartPhase(ctx, name)
+	defer span.Finish()
+
+	err := fn(ctx)
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.String("event", "error"), log.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhase(t *testing.T) {
+	tracer := mocktracer.New()
+	request := tracer.StartSpan("HTTP GET /")
+	ctx := opentracing.ContextWithSpan(context.Background(), request)
+
+	// test data
+	var tests = []struct {
+		name string
+		err  error
+	}{
+		{"load data", nil},
+		{"call inventory", errors.New("inventory is down")},
+	}
+
+	for _, tt := range tests {
+		tracer.Reset()
+		var nested opentracing.Span
+		err := Phase(ctx, tt.name, func(ctx context.Context) error {
+			// phases nest
+			nested, _ = StartPhase(ctx, "query")
+			nested.Finish()
+			return tt.err
+		})
+		assert.Equal(t, tt.err, err, tt.name)
+
+		spans := tracer.FinishedSpans()
+		if !assert.Len(t, spans, 2, tt.name) {
+			continue
+		}
+		query, phase := spans[0], spans[1]
+		assert.Equal(t, tt.name, phase.OperationName)
+		assert.Equal(t, request.Context().(mocktracer.MockSpanContext).SpanID, phase.ParentID, tt.name)
+		assert.Equal(t, phase.SpanContext.SpanID, query.ParentID, tt.name)
+		if tt.err != nil {
+			assert.Equal(t, true, phase.Tag("error"), tt.name)
+			assert.Len(t, phase.Logs(), 1, tt.name)
+		} else {
+			assert.Nil(t, phase.Tag("error"), tt.name)
+		}
+	}
+}
+
+func TestPhaseUntraced(t *testing.T) {
+	span, ctx := StartPhase(context.Background(), "load data")
+	span.Finish()
+
+	// no orphan trace, and nothing in ctx
+	assert.Equal(t, opentracing.NoopTracer{}, span.Tracer())
+	assert.Nil(t, opentracing.SpanFromContext(ctx))
+}
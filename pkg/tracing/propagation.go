@@ -0,0 +1,361 @@
+package tracing
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	jaeger "github.com/uber/jaeger-client-go"
+	b3prop "go.opentelemetry.io/contrib/propagators/b3"
+	jaegerprop "go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Propagators are named as in OTEL_PROPAGATORS. Inbound requests are
+// extracted with each configured propagator in turn (later ones win if a
+// request carries more than one trace context), outbound requests get
+// the headers of all of them. Baggage comes from every propagator that
+// carries it, also without a trace context: the request then starts a
+// new trace carrying the baggage.
+//
+// Our Jaeger client only knows its own uber-trace-id headers, so for the
+// Jaeger backend the formats are implemented here. A W3C tracestate is
+// only passed on by the OTLP backend, a Jaeger span context has no room
+// for it.
+
+const (
+	PropagatorTraceContext = "tracecontext" // W3C traceparent and tracestate
+	PropagatorBaggage      = "baggage"      // W3C baggage
+	PropagatorB3           = "b3"           // B3 single header
+	PropagatorB3Multi      = "b3multi"      // B3 X-B3-* headers
+	PropagatorJaeger       = "jaeger"       // uber-trace-id and uberctx-* baggage
+)
+
+var (
+	// w3c and jaeger, so both our gateway's and Jaeger clients' traces
+	// are continued
+	dflPropagators = []string{PropagatorTraceContext, PropagatorBaggage, PropagatorJaeger}
+)
+
+const (
+	traceparentHeader   = "traceparent"
+	baggageHeader       = "baggage"
+	b3Header            = "b3"
+	b3TraceIDHeader     = "x-b3-traceid"
+	b3SpanIDHeader      = "x-b3-spanid"
+	b3ParentIDHeader    = "x-b3-parentspanid"
+	b3SampledHeader     = "x-b3-sampled"
+	b3FlagsHeader       = "x-b3-flags"
+	jaegerHeader        = "uber-trace-id"
+	jaegerBaggagePrefix = "uberctx-"
+)
+
+// propagators returns the configured propagator names, "none" turns
+// propagation off
+func (o Options) propagators() []string {
+	switch {
+	case len(o.Propagators) == 0:
+		return dflPropagators
+	case len(o.Propagators) == 1 && o.Propagators[0] == "none":
+		return nil
+	}
+	return o.Propagators
+}
+
+// otelPropagator returns the configured propagators for the OTLP backend
+func (o Options) otelPropagator() (propagation.TextMapPropagator, error) {
+	var props []propagation.TextMapPropagator
+	for _, name := range o.propagators() {
+		switch name {
+		case PropagatorTraceContext:
+			props = append(props, propagation.TraceContext{})
+		case PropagatorBaggage:
+			props = append(props, propagation.Baggage{})
+		case PropagatorB3:
+			props = append(props, b3prop.New(b3prop.WithInjectEncoding(b3prop.B3SingleHeader)))
+		case PropagatorB3Multi:
+			props = append(props, b3prop.New(b3prop.WithInjectEncoding(b3prop.B3MultipleHeader)))
+		case PropagatorJaeger:
+			props = append(props, jaegerprop.Jaeger{})
+		default:
+			return nil, errors.Errorf("unknown propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(props...), nil
+}
+
+// jaegerPropagator returns the configured propagators for the Jaeger
+// backend, as one jaeger.Injector and jaeger.Extractor
+func (o Options) jaegerPropagator() (*propagator, error) {
+	p := &propagator{}
+	for _, name := range o.propagators() {
+		switch name {
+		case PropagatorTraceContext:
+			p.codecs = append(p.codecs, traceContextCodec{})
+		case PropagatorBaggage:
+			p.codecs = append(p.codecs, baggageCodec{})
+		case PropagatorB3:
+			p.codecs = append(p.codecs, b3Codec{})
+		case PropagatorB3Multi:
+			p.codecs = append(p.codecs, b3MultiCodec{})
+		case PropagatorJaeger:
+			p.codecs = append(p.codecs, jaegerCodec{})
+		default:
+			return nil, errors.Errorf("unknown propagator %q", name)
+		}
+	}
+	return p, nil
+}
+
+// wide tells whether any of our formats expects 128 bit trace IDs
+func (p *propagator) wide() bool {
+	for _, c := range p.codecs {
+		switch c.(type) {
+		case traceContextCodec, b3Codec, b3MultiCodec:
+			return true
+		}
+	}
+	return false
+}
+
+// codec is one header format. extract is given the headers with their
+// names in lower case, and returns a span context (or an invalid one)
+// and any baggage.
+type codec interface {
+	inject(sc jaeger.SpanContext, w opentracing.TextMapWriter)
+	extract(h map[string]string) (jaeger.SpanContext, map[string]string)
+}
+
+// propagator injects and extracts jaeger span contexts with its codecs
+type propagator struct {
+	codecs []codec
+}
+
+// Inject implements jaeger.Injector
+func (p *propagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	w, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	for _, c := range p.codecs {
+		c.inject(sc, w)
+	}
+	return nil
+}
+
+// Extract implements jaeger.Extractor
+func (p *propagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	r, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+	h := make(map[string]string)
+	err := r.ForeachKey(func(k, v string) error {
+		h[strings.ToLower(k)] = v
+		return nil
+	})
+	if err != nil {
+		return jaeger.SpanContext{}, err
+	}
+
+	var found jaeger.SpanContext
+	baggage := make(map[string]string)
+	for _, c := range p.codecs {
+		sc, b := c.extract(h)
+		if sc.IsValid() {
+			found = sc
+		}
+		for k, v := range b {
+			baggage[k] = v
+		}
+	}
+	if !found.IsValid() && len(baggage) == 0 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+	// baggage without a trace context starts a new root carrying it
+	for k, v := range baggage {
+		found = found.WithBaggageItem(k, v)
+	}
+	return found, nil
+}
+
+// traceID formats a trace ID as 32 hex digits
+func traceID(id jaeger.TraceID) string {
+	return fmt.Sprintf("%016x%016x", id.High, id.Low)
+}
+
+// spanID formats a span ID as 16 hex digits
+func spanID(id jaeger.SpanID) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// spanContext returns the span context of the hex trace and span IDs, or
+// an invalid one if they don't parse
+func spanContext(trace, span, parent string, sampled bool) jaeger.SpanContext {
+	tid, err := jaeger.TraceIDFromString(trace)
+	if err != nil {
+		return jaeger.SpanContext{}
+	}
+	sid, err := jaeger.SpanIDFromString(span)
+	if err != nil || sid == 0 {
+		return jaeger.SpanContext{}
+	}
+	var pid jaeger.SpanID
+	if parent != "" {
+		pid, _ = jaeger.SpanIDFromString(parent)
+	}
+	return jaeger.NewSpanContext(tid, sid, pid, sampled, nil)
+}
+
+// traceContextCodec is a W3C traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+type traceContextCodec struct{}
+
+func (traceContextCodec) inject(sc jaeger.SpanContext, w opentracing.TextMapWriter) {
+	flags := "00"
+	if sc.IsSampled() {
+		flags = "01"
+	}
+	w.Set(traceparentHeader, "00-"+traceID(sc.TraceID())+"-"+spanID(sc.SpanID())+"-"+flags)
+}
+
+func (traceContextCodec) extract(h map[string]string) (jaeger.SpanContext, map[string]string) {
+	parts := strings.Split(strings.TrimSpace(h[traceparentHeader]), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return jaeger.SpanContext{}, nil
+	}
+	var flags byte
+	if _, err := fmt.Sscanf(parts[3], "%02x", &flags); err != nil {
+		return jaeger.SpanContext{}, nil
+	}
+	return spanContext(parts[1], parts[2], "", flags&1 == 1), nil
+}
+
+// baggageCodec is a W3C baggage header, e.g. "user=bob,tenant=acme"
+type baggageCodec struct{}
+
+func (baggageCodec) inject(sc jaeger.SpanContext, w opentracing.TextMapWriter) {
+	var members []string
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		members = append(members, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		return true
+	})
+	if members != nil {
+		w.Set(baggageHeader, strings.Join(members, ","))
+	}
+}
+
+func (baggageCodec) extract(h map[string]string) (jaeger.SpanContext, map[string]string) {
+	v, ok := h[baggageHeader]
+	if !ok {
+		return jaeger.SpanContext{}, nil
+	}
+	baggage := make(map[string]string)
+	for _, member := range strings.Split(v, ",") {
+		// drop any properties, e.g. "k=v;metadata"
+		member = strings.SplitN(member, ";", 2)[0]
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, err := url.QueryUnescape(strings.TrimSpace(kv[0]))
+		if err != nil || k == "" {
+			continue
+		}
+		val, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+		baggage[k] = val
+	}
+	return jaeger.SpanContext{}, baggage
+}
+
+// b3Codec is a B3 single header, e.g.
+// "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"
+type b3Codec struct{}
+
+func (b3Codec) inject(sc jaeger.SpanContext, w opentracing.TextMapWriter) {
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	v := traceID(sc.TraceID()) + "-" + spanID(sc.SpanID()) + "-" + sampled
+	if sc.ParentID() != 0 {
+		v += "-" + spanID(sc.ParentID())
+	}
+	w.Set(b3Header, v)
+}
+
+func (b3Codec) extract(h map[string]string) (jaeger.SpanContext, map[string]string) {
+	parts := strings.Split(strings.TrimSpace(h[b3Header]), "-")
+	if len(parts) < 2 {
+		return jaeger.SpanContext{}, nil // absent, or a bare sampling decision
+	}
+	var sampled bool
+	var parent string
+	if len(parts) > 2 {
+		sampled = parts[2] == "1" || parts[2] == "d"
+	}
+	if len(parts) > 3 {
+		parent = parts[3]
+	}
+	return spanContext(parts[0], parts[1], parent, sampled), nil
+}
+
+// b3MultiCodec is the B3 X-B3-* headers
+type b3MultiCodec struct{}
+
+func (b3MultiCodec) inject(sc jaeger.SpanContext, w opentracing.TextMapWriter) {
+	w.Set(b3TraceIDHeader, traceID(sc.TraceID()))
+	w.Set(b3SpanIDHeader, spanID(sc.SpanID()))
+	if sc.ParentID() != 0 {
+		w.Set(b3ParentIDHeader, spanID(sc.ParentID()))
+	}
+	if sc.IsSampled() {
+		w.Set(b3SampledHeader, "1")
+	} else {
+		w.Set(b3SampledHeader, "0")
+	}
+}
+
+func (b3MultiCodec) extract(h map[string]string) (jaeger.SpanContext, map[string]string) {
+	sampled := h[b3SampledHeader] == "1" || h[b3SampledHeader] == "true" || h[b3FlagsHeader] == "1"
+	return spanContext(h[b3TraceIDHeader], h[b3SpanIDHeader], h[b3ParentIDHeader], sampled), nil
+}
+
+// jaegerCodec is Jaeger's own uber-trace-id header and uberctx-* baggage
+type jaegerCodec struct{}
+
+func (jaegerCodec) inject(sc jaeger.SpanContext, w opentracing.TextMapWriter) {
+	w.Set(jaegerHeader, sc.String())
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		w.Set(jaegerBaggagePrefix+k, url.QueryEscape(v))
+		return true
+	})
+}
+
+func (jaegerCodec) extract(h map[string]string) (jaeger.SpanContext, map[string]string) {
+	var sc jaeger.SpanContext
+	if v, ok := h[jaegerHeader]; ok {
+		if v, err := url.QueryUnescape(v); err == nil {
+			sc, _ = jaeger.ContextFromString(v)
+		}
+	}
+
+	var baggage map[string]string
+	for k, v := range h {
+		if !strings.HasPrefix(k, jaegerBaggagePrefix) {
+			continue
+		}
+		if baggage == nil {
+			baggage = make(map[string]string)
+		}
+		if v, err := url.QueryUnescape(v); err == nil {
+			baggage[k[len(jaegerBaggagePrefix):]] = v
+		}
+	}
+	return sc, baggage
+}
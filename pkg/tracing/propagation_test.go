@@ -0,0 +1,277 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestExtract(t *testing.T) {
+
+	// test data
+	var tests = []struct {
+		propagators []string
+		headers     map[string]string
+		trace       string // empty if nothing is extracted
+		sampled     bool
+		baggage     map[string]string
+	}{
+		{
+			nil, // the defaults
+			map[string]string{
+				"Traceparent": "00-" + testTraceID + "-" + testSpanID + "-01",
+				"Baggage":     "user=bob,tenant=acme%20inc;prop=1",
+			},
+			testTraceID, true,
+			map[string]string{"user": "bob", "tenant": "acme inc"},
+		},
+		{
+			nil,
+			map[string]string{
+				"Uber-Trace-Id":  testTraceID + ":" + testSpanID + ":0:0",
+				"Uberctx-Tenant": "acme",
+			},
+			testTraceID, false,
+			map[string]string{"tenant": "acme"},
+		},
+		{
+			// later propagators win, baggage comes from all of them
+			[]string{PropagatorJaeger, PropagatorTraceContext, PropagatorBaggage},
+			map[string]string{
+				"Uber-Trace-Id":  "1:2:0:1",
+				"Uberctx-Tenant": "acme",
+				"Traceparent":    "00-" + testTraceID + "-" + testSpanID + "-00",
+				"Baggage":        "user=bob",
+			},
+			testTraceID, false,
+			map[string]string{"user": "bob", "tenant": "acme"},
+		},
+		{
+			[]string{PropagatorB3},
+			map[string]string{"B3": testTraceID + "-" + testSpanID + "-1-05e3ac9a4f6e3b90"},
+			testTraceID, true, nil,
+		},
+		{
+			[]string{PropagatorB3},
+			map[string]string{"B3": "0"}, // a sampling decision only
+			"", false, nil,
+		},
+		{
+			[]string{PropagatorB3Multi},
+			map[string]string{
+				"X-B3-Traceid": "64fe8b2a57d3eff7",
+				"X-B3-Spanid":  testSpanID,
+				"X-B3-Sampled": "1",
+			},
+			"000000000000000064fe8b2a57d3eff7", true, nil,
+		},
+		{
+			// not configured, not extracted
+			[]string{PropagatorJaeger},
+			map[string]string{"Traceparent": "00-" + testTraceID + "-" + testSpanID + "-01"},
+			"", false, nil,
+		},
+		{
+			nil,
+			map[string]string{"Traceparent": "00-" + testTraceID + "-0000000000000000-01"},
+			"", false, nil,
+		},
+		{
+			// baggage only, a new root carries it
+			nil,
+			map[string]string{"Baggage": "user=bob"},
+			"", false, map[string]string{"user": "bob"},
+		},
+	}
+
+	for i, tt := range tests {
+		tracer, closer, err := Init("test", metrics.NullFactory, Options{
+			SamplerType:  "const",
+			SamplerParam: 1,
+			Propagators:  tt.propagators,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := make(http.Header)
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+		closer.Close()
+
+		if tt.trace == "" && tt.baggage == nil {
+			assert.Equal(t, opentracing.ErrSpanContextNotFound, err, "test %d", i)
+			continue
+		}
+		if !assert.NoError(t, err, "test %d", i) {
+			continue
+		}
+		jsc := sc.(jaeger.SpanContext)
+		if tt.trace == "" {
+			assert.False(t, jsc.IsValid(), "test %d", i)
+		} else {
+			assert.Equal(t, tt.trace, traceID(jsc.TraceID()), "test %d", i)
+		}
+		assert.Equal(t, tt.sampled, jsc.IsSampled(), "test %d", i)
+
+		var baggage map[string]string
+		jsc.ForeachBaggageItem(func(k, v string) bool {
+			if baggage == nil {
+				baggage = make(map[string]string)
+			}
+			baggage[k] = v
+			return true
+		})
+		assert.Equal(t, tt.baggage, baggage, "test %d", i)
+	}
+}
+
+func TestExtractBaggage(t *testing.T) {
+	rc := newReceiver()
+	endpoint, stop := rc.start(t, ProtocolHTTP)
+	defer stop()
+
+	for _, backend := range []string{BackendJaeger, BackendOTLP} {
+		tracer, closer, err := Init("test", metrics.NullFactory, Options{
+			Backend:      backend,
+			SamplerType:  "const",
+			SamplerParam: 1,
+			OTLPEndpoint: endpoint,
+			OTLPInsecure: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// baggage without a trace context starts a new trace carrying it
+		h := make(http.Header)
+		h.Set("Baggage", "user=bob")
+		sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+		if !assert.NoError(t, err, backend) {
+			closer.Close()
+			continue
+		}
+		span := tracer.StartSpan("test", opentracing.ChildOf(sc))
+		assert.Equal(t, "bob", span.BaggageItem("user"), backend)
+		_, sampled := TraceID(opentracing.ContextWithSpan(context.Background(), span))
+		assert.True(t, sampled, backend)
+		span.Finish()
+
+		// and no headers at all are still not found
+		_, err = tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(http.Header{}))
+		assert.Equal(t, opentracing.ErrSpanContextNotFound, err, backend)
+		closer.Close()
+	}
+}
+
+func TestInject(t *testing.T) {
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		SamplerType:  "const",
+		SamplerParam: 1,
+		Propagators: []string{
+			PropagatorTraceContext,
+			PropagatorBaggage,
+			PropagatorB3,
+			PropagatorB3Multi,
+			PropagatorJaeger,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	span := tracer.StartSpan("test")
+	span.SetBaggageItem("user", "bob smith")
+	defer span.Finish()
+
+	h := make(http.Header)
+	err = tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := span.Context().(jaeger.SpanContext)
+	trace, id := traceID(sc.TraceID()), spanID(sc.SpanID())
+	assert.NotEqual(t, uint64(0), sc.TraceID().High, "128 bit trace IDs")
+	assert.Equal(t, "00-"+trace+"-"+id+"-01", h.Get("traceparent"))
+	assert.Equal(t, "user=bob+smith", h.Get("baggage"))
+	assert.Equal(t, trace+"-"+id+"-1", h.Get("b3"))
+	assert.Equal(t, trace, h.Get("x-b3-traceid"))
+	assert.Equal(t, id, h.Get("x-b3-spanid"))
+	assert.Equal(t, "1", h.Get("x-b3-sampled"))
+	assert.Equal(t, sc.String(), h.Get("uber-trace-id"))
+	assert.Equal(t, "bob+smith", h.Get("uberctx-user"))
+
+	// and back again, with each propagator on its own
+	for _, p := range []string{PropagatorTraceContext, PropagatorB3, PropagatorB3Multi, PropagatorJaeger} {
+		prop, err := Options{Propagators: []string{p, PropagatorBaggage}}.jaegerPropagator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := prop.Extract(opentracing.HTTPHeadersCarrier(h))
+		if !assert.NoError(t, err, p) {
+			continue
+		}
+		assert.Equal(t, sc.TraceID(), got.TraceID(), p)
+		assert.Equal(t, sc.SpanID(), got.SpanID(), p)
+		assert.True(t, got.IsSampled(), p)
+	}
+}
+
+func TestOTelPropagator(t *testing.T) {
+	rc := newReceiver()
+	endpoint, stop := rc.start(t, ProtocolHTTP)
+	defer stop()
+
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		Backend:      BackendOTLP,
+		SamplerType:  "const",
+		SamplerParam: 1,
+		OTLPEndpoint: endpoint,
+		OTLPInsecure: true,
+		Propagators:  []string{PropagatorB3Multi, PropagatorBaggage},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	in := make(http.Header)
+	in.Set("X-B3-Traceid", testTraceID)
+	in.Set("X-B3-Spanid", testSpanID)
+	in.Set("X-B3-Sampled", "1")
+	in.Set("Baggage", "user=bob")
+	sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span := tracer.StartSpan("test", opentracing.ChildOf(sc))
+	defer span.Finish()
+	assert.Equal(t, "bob", span.BaggageItem("user"))
+
+	out := make(http.Header)
+	err = tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testTraceID, out.Get("X-B3-Traceid"))
+	assert.Equal(t, "User=bob", out.Get("Baggage")) // the bridge canonicalizes baggage keys
+	assert.Empty(t, out.Get("Traceparent"))
+
+	_, _, err = Init("test", metrics.NullFactory, Options{Propagators: []string{"xray"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,355 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	"github.com/opentracing/opentracing-go/ext"
+	jaeger "github.com/uber/jaeger-client-go"
+	thrift "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+)
+
+// Running Jaeger just to look at our own traces is heavy for local
+// development. The memory backend (OTEL_TRACES_EXPORTER=memory) reports
+// spans to a Recorder instead, which keeps the last traces in process and
+// serves them on /debug/traces as a waterfall:
+//
+//	opts.Backend = tracing.BackendMemory
+//	opts.Recorder = tracing.NewRecorder()
+//	tracer, closer, err := tracing.Init("app", metricsFactory, opts)
+//	...
+//	r.Handler("GET", "/debug/traces", opts.Recorder.Handler(render))
+//
+// Errored and slow traces are kept apart from the last ones, so a burst of
+// healthy traffic doesn't push the interesting ones out. A trace keeps at
+// most Spans spans, and late spans of a trace that was already pushed out
+// are dropped rather than recorded as a partial trace of their own. The
+// URLs in span tags are redacted, and the handler is for admins only.
+
+const (
+	dflRecorderTraces = 100
+	dflRecorderKept   = 100
+	dflRecorderSlow   = time.Second
+	dflRecorderSpans  = 1000
+
+	// recently evicted trace IDs remembered to drop their late spans
+	recorderEvicted = 1000
+
+	dflTracesTemplate = "traces.html"
+)
+
+// RecorderOptions describes the recorder options
+type RecorderOptions struct {
+	Traces int           // last traces kept, = 100
+	Kept   int           // errored and slow traces kept besides, = 100 of each
+	Slow   time.Duration // a trace taking this long is slow, = 1 second
+	Spans  int           // spans kept per trace, = 1000
+
+	Redactor *logging.Redactor // masks the URL tags, = logging.DefaultRedactor()
+}
+
+// Recorder is a jaeger.Reporter keeping traces in memory
+type Recorder struct {
+	opts RecorderOptions
+
+	mu      sync.Mutex
+	traces  map[string]*recorded
+	recent  []*recorded // oldest first, as are the others
+	errored []*recorded
+	slow    []*recorded
+
+	evicted    map[string]bool // recently evicted trace IDs
+	evictedIDs []string        // oldest first
+}
+
+// recorded is a trace as it's being recorded
+type recorded struct {
+	id      string
+	spans   []Span
+	dropped int // spans over RecorderOptions.Spans
+}
+
+// Trace is a recorded trace
+type Trace struct {
+	ID        string        `json:"traceId"`
+	Operation string        `json:"operation"` // of its root span
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	Error     bool          `json:"error"`
+	Slow      bool          `json:"slow"`
+	Dropped   int           `json:"dropped,omitempty"` // spans over the limit
+	Spans     []Span        `json:"spans,omitempty"`   // parents before their children
+}
+
+// Span is a recorded span, placed in the waterfall of its trace
+type Span struct {
+	ID        string            `json:"spanId"`
+	ParentID  string            `json:"parentId,omitempty"`
+	Operation string            `json:"operation"`
+	Start     time.Time         `json:"start"`
+	Duration  time.Duration     `json:"duration"`
+	Error     bool              `json:"error"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Logs      []string          `json:"logs,omitempty"`
+
+	Depth  int     `json:"depth"`  // in the span tree, 0 for the root
+	Offset float64 `json:"offset"` // start, in percent of the trace
+	Width  float64 `json:"width"`  // duration, in percent of the trace
+}
+
+// NewRecorder returns a new Recorder
+func NewRecorder(opts ...RecorderOptions) *Recorder {
+	var opt RecorderOptions
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Traces <= 0 {
+		opt.Traces = dflRecorderTraces
+	}
+	if opt.Kept <= 0 {
+		opt.Kept = dflRecorderKept
+	}
+	if opt.Slow <= 0 {
+		opt.Slow = dflRecorderSlow
+	}
+	if opt.Spans <= 0 {
+		opt.Spans = dflRecorderSpans
+	}
+	return &Recorder{opts: opt, traces: map[string]*recorded{}, evicted: map[string]bool{}}
+}
+
+// Report implements jaeger.Reporter
+func (rec *Recorder) Report(span *jaeger.Span) {
+	sc := span.Context().(jaeger.SpanContext)
+	js := jaeger.BuildJaegerThrift(span)
+	s := Span{
+		ID:        sc.SpanID().String(),
+		Operation: js.OperationName,
+		Start:     time.Unix(0, js.StartTime*int64(time.Microsecond)),
+		Duration:  time.Duration(js.Duration) * time.Microsecond,
+	}
+	if sc.ParentID() != 0 {
+		s.ParentID = sc.ParentID().String()
+	}
+	if len(js.Tags) > 0 {
+		s.Tags = make(map[string]string, len(js.Tags))
+		for _, t := range js.Tags {
+			s.Tags[t.Key] = tagValue(t)
+		}
+		if u, ok := s.Tags[string(ext.HTTPUrl)]; ok {
+			redact := rec.opts.Redactor
+			if redact == nil {
+				redact = logging.DefaultRedactor()
+			}
+			s.Tags[string(ext.HTTPUrl)] = redact.URL(u)
+		}
+	}
+	s.Error = failed(js)
+	for _, l := range js.Logs {
+		fields := make([]string, 0, len(l.Fields))
+		for _, f := range l.Fields {
+			fields = append(fields, f.Key+":"+tagValue(f))
+		}
+		at := time.Duration(l.Timestamp-js.StartTime) * time.Microsecond
+		s.Logs = append(s.Logs, at.String()+" "+strings.Join(fields, " "))
+	}
+
+	id := sc.TraceID().String()
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if t, ok := rec.traces[id]; ok {
+		if len(t.spans) >= rec.opts.Spans {
+			t.dropped++
+			return
+		}
+		t.spans = append(t.spans, s)
+		return
+	}
+	if rec.evicted[id] {
+		return
+	}
+	t := &recorded{id: id, spans: []Span{s}}
+	rec.traces[id] = t
+	rec.recent = append(rec.recent, t)
+	if len(rec.recent) <= rec.opts.Traces {
+		return
+	}
+
+	// the oldest trace makes room, unless it's worth keeping
+	old := rec.recent[0]
+	rec.recent = rec.recent[1:]
+	view := old.trace(rec.opts.Slow)
+	switch {
+	case view.Error:
+		rec.errored = rec.keep(rec.errored, old)
+	case view.Slow:
+		rec.slow = rec.keep(rec.slow, old)
+	default:
+		rec.evict(old)
+	}
+}
+
+// evict forgets t, remembering its ID for a while to drop its late spans
+func (rec *Recorder) evict(t *recorded) {
+	delete(rec.traces, t.id)
+	rec.evicted[t.id] = true
+	rec.evictedIDs = append(rec.evictedIDs, t.id)
+	if len(rec.evictedIDs) > recorderEvicted {
+		delete(rec.evicted, rec.evictedIDs[0])
+		rec.evictedIDs = rec.evictedIDs[1:]
+	}
+}
+
+// tagValue returns the value of a span tag or log field as a string
+func tagValue(t *thrift.Tag) string {
+	switch t.VType {
+	case thrift.TagType_BOOL:
+		return fmt.Sprint(t.GetVBool())
+	case thrift.TagType_LONG:
+		return fmt.Sprint(t.GetVLong())
+	case thrift.TagType_DOUBLE:
+		return fmt.Sprint(t.GetVDouble())
+	case thrift.TagType_BINARY:
+		return fmt.Sprintf("%x", t.GetVBinary())
+	}
+	return t.GetVStr()
+}
+
+// keep appends t to kept, dropping the oldest one if it's full
+func (rec *Recorder) keep(kept []*recorded, t *recorded) []*recorded {
+	kept = append(kept, t)
+	if len(kept) > rec.opts.Kept {
+		rec.evict(kept[0])
+		kept = kept[1:]
+	}
+	return kept
+}
+
+// Close implements jaeger.Reporter
+func (rec *Recorder) Close() {}
+
+// Traces returns the recorded traces, newest first, without their spans
+func (rec *Recorder) Traces() []Trace {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	traces := make([]Trace, 0, len(rec.traces))
+	for _, t := range rec.traces {
+		view := t.trace(rec.opts.Slow)
+		view.Spans = nil
+		traces = append(traces, view)
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Start.After(traces[j].Start) })
+	return traces
+}
+
+// Trace returns the recorded trace with ID id
+func (rec *Recorder) Trace(id string) (Trace, bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	t, ok := rec.traces[id]
+	if !ok {
+		return Trace{}, false
+	}
+	return t.trace(rec.opts.Slow), true
+}
+
+// trace returns t with its spans laid out in a waterfall
+func (t *recorded) trace(slow time.Duration) Trace {
+	view := Trace{ID: t.id, Dropped: t.dropped}
+
+	// the trace spans from its first start to its last end
+	var end time.Time
+	ids := map[string]bool{}
+	for i, s := range t.spans {
+		if i == 0 || s.Start.Before(view.Start) {
+			view.Start = s.Start
+		}
+		if e := s.Start.Add(s.Duration); e.After(end) {
+			end = e
+		}
+		view.Error = view.Error || s.Error
+		ids[s.ID] = true
+	}
+	view.Duration = end.Sub(view.Start)
+	view.Slow = view.Duration >= slow
+
+	// spans whose parent we didn't record (e.g. it's in the calling
+	// service) are roots
+	var roots []Span
+	children := map[string][]Span{}
+	for _, s := range t.spans {
+		if s.ParentID == "" || !ids[s.ParentID] {
+			roots = append(roots, s)
+		} else {
+			children[s.ParentID] = append(children[s.ParentID], s)
+		}
+	}
+
+	var walk func(spans []Span, depth int)
+	walk = func(spans []Span, depth int) {
+		sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+		for _, s := range spans {
+			s.Depth = depth
+			if view.Duration > 0 {
+				s.Offset = 100 * float64(s.Start.Sub(view.Start)) / float64(view.Duration)
+				s.Width = 100 * float64(s.Duration) / float64(view.Duration)
+			}
+			view.Spans = append(view.Spans, s)
+			walk(children[s.ID], depth+1)
+		}
+	}
+	walk(roots, 0)
+	if len(view.Spans) > 0 {
+		view.Operation = view.Spans[0].Operation
+	}
+	return view
+}
+
+// Handler serves the recorded traces as JSON, or as the rendered
+// "traces.html" page to browsers if r is not nil. A trace ID in the "id"
+// query parameter serves that trace, with its spans.
+func (rec *Recorder) Handler(r *tmpl.Render) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var v interface{}
+		data := map[string]interface{}{"title": "Traces"}
+		if id := req.URL.Query().Get("id"); id != "" {
+			t, ok := rec.Trace(id)
+			if !ok {
+				http.Error(w, "trace not found", http.StatusNotFound)
+				return
+			}
+			v, data["Trace"] = t, t
+		} else {
+			traces := rec.Traces()
+			v, data["Traces"] = traces, traces
+		}
+
+		if r != nil && strings.Contains(req.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Cache-Control", "no-store")
+			err := r.TemplateContext(req.Context(), w, dflTracesTemplate, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		j, err := json.MarshalIndent(v, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(j)
+	})
+}
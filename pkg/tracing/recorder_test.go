@@ -0,0 +1,199 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dstroot/simple-go-webserver/pkg/tmpl"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// record starts a trace of a request with a child span, finishing both
+// after d, and returns its ID
+func record(tracer opentracing.Tracer, name string, d time.Duration, err error) string {
+	start := time.Now().Add(-d)
+	root := tracer.StartSpan(name, opentracing.StartTime(start))
+	child := tracer.StartSpan("render template", opentracing.ChildOf(root.Context()), opentracing.StartTime(start.Add(d/2)))
+	if err != nil {
+		ext.Error.Set(child, true)
+		child.LogFields(log.Error(err))
+	}
+	child.Finish()
+	root.Finish()
+
+	id, _ := TraceID(opentracing.ContextWithSpan(context.Background(), root))
+	return id
+}
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder(RecorderOptions{Traces: 2, Kept: 1, Slow: time.Second})
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{Backend: BackendMemory, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	failed := record(tracer, "HTTP GET /fail", time.Millisecond, errors.New("boom"))
+	slow := record(tracer, "HTTP GET /slow", 2*time.Second, nil)
+	record(tracer, "HTTP GET /old", time.Millisecond, nil)
+	last := []string{
+		record(tracer, "HTTP GET /", time.Millisecond, nil),
+		record(tracer, "HTTP GET /", time.Millisecond, nil),
+	}
+
+	// the last two, and the errored and slow ones pushed out by them
+	var ids []string
+	for _, tr := range rec.Traces() {
+		ids = append(ids, tr.ID)
+	}
+	assert.ElementsMatch(t, append(last, failed, slow), ids)
+
+	tr, ok := rec.Trace(failed)
+	if assert.True(t, ok) && assert.Len(t, tr.Spans, 2) {
+		assert.Equal(t, "HTTP GET /fail", tr.Operation)
+		assert.True(t, tr.Error)
+		assert.False(t, tr.Slow)
+
+		root, child := tr.Spans[0], tr.Spans[1]
+		assert.Equal(t, 0, root.Depth)
+		assert.Equal(t, 1, child.Depth)
+		assert.Equal(t, root.ID, child.ParentID)
+		assert.Equal(t, "true", child.Tags["error"])
+		assert.Len(t, child.Logs, 1)
+		assert.InDelta(t, 0, root.Offset, 0.01)
+		assert.InDelta(t, 100, root.Width, 0.01)
+		assert.InDelta(t, 50, child.Offset, 5) // to the microsecond
+	}
+
+	tr, _ = rec.Trace(slow)
+	assert.True(t, tr.Slow)
+	assert.False(t, tr.Error)
+
+	// one more errored trace pushes the first one out
+	record(tracer, "HTTP GET /fail", time.Millisecond, errors.New("boom"))
+	record(tracer, "HTTP GET /", time.Millisecond, nil)
+	record(tracer, "HTTP GET /", time.Millisecond, nil)
+	_, ok = rec.Trace(failed)
+	assert.False(t, ok)
+	_, ok = rec.Trace(slow)
+	assert.True(t, ok)
+
+	// the memory backend needs a recorder
+	_, _, err = Init("test", metrics.NullFactory, Options{Backend: BackendMemory})
+	assert.Error(t, err)
+}
+
+func TestRecorderLimits(t *testing.T) {
+	rec := NewRecorder(RecorderOptions{Traces: 1, Spans: 2})
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{Backend: BackendMemory, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	// spans over the limit are counted, not kept
+	root := tracer.StartSpan("HTTP GET /")
+	for i := 0; i < 3; i++ {
+		tracer.StartSpan("query", opentracing.ChildOf(root.Context())).Finish()
+	}
+	root.Finish()
+	id, _ := TraceID(opentracing.ContextWithSpan(context.Background(), root))
+	tr, ok := rec.Trace(id)
+	if assert.True(t, ok) {
+		assert.Len(t, tr.Spans, 2)
+		assert.Equal(t, 2, tr.Dropped)
+	}
+
+	// a late span of a trace pushed out doesn't bring it back
+	late := tracer.StartSpan("HTTP GET /late")
+	child := tracer.StartSpan("render template", opentracing.ChildOf(late.Context()))
+	late.Finish()
+	lateID, _ := TraceID(opentracing.ContextWithSpan(context.Background(), late))
+	last := record(tracer, "HTTP GET /", time.Millisecond, nil)
+	child.Finish()
+
+	var ids []string
+	for _, tr := range rec.Traces() {
+		ids = append(ids, tr.ID)
+	}
+	assert.Equal(t, []string{last}, ids)
+	_, ok = rec.Trace(lateID)
+	assert.False(t, ok)
+}
+
+func TestRecorderRedacts(t *testing.T) {
+	rec := NewRecorder()
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{Backend: BackendMemory, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	span := tracer.StartSpan("HTTP GET /login")
+	ext.HTTPUrl.Set(span, "/login?user=bob&token=s3cret")
+	span.Finish()
+
+	id, _ := TraceID(opentracing.ContextWithSpan(context.Background(), span))
+	tr, ok := rec.Trace(id)
+	if assert.True(t, ok) && assert.Len(t, tr.Spans, 1) {
+		assert.Equal(t, "/login?user=bob&token=[REDACTED]", tr.Spans[0].Tags["http.url"])
+	}
+}
+
+func TestRecorderHandler(t *testing.T) {
+	rec := NewRecorder()
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{Backend: BackendMemory, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	id := record(tracer, "HTTP GET /hello/:name", 10*time.Millisecond, nil)
+
+	h := rec.Handler(tmpl.New(tmpl.Options{TemplateDirectory: "../../templates"}))
+
+	// test data
+	var tests = []struct {
+		url    string
+		accept string
+		status int
+		body   string
+	}{
+		{"/debug/traces", "text/html", 200, `href="?id=` + id + `"`},
+		{"/debug/traces?id=" + id, "text/html", 200, "render template"},
+		{"/debug/traces", "", 200, `"traceId": "` + id + `"`},
+		{"/debug/traces?id=" + id, "", 200, `"depth": 1`},
+		{"/debug/traces?id=nonexistent", "", 404, "trace not found"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Accept", tt.accept)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.status, rr.Code, tt.url)
+		assert.Contains(t, rr.Body.String(), tt.body, tt.url)
+	}
+
+	// the JSON is the trace
+	req := httptest.NewRequest("GET", "/debug/traces?id="+id, nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	var tr Trace
+	if err := json.NewDecoder(rr.Body).Decode(&tr); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, id, tr.ID)
+	assert.True(t, strings.HasPrefix(tr.Spans[0].Operation, "HTTP GET"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
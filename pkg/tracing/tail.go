@@ -0,0 +1,287 @@
+package tracing
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	jaeger "github.com/uber/jaeger-client-go"
+	thrift "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// Probabilistic head sampling decides when a request starts, so it drops
+// most of the failed and slow requests we'd want to look at. With
+// TailSampling the tracer samples every request, and a reporter buffers
+// each trace's spans until its server span ends, then keeps the trace if
+//
+//   - it was asked for, with the DebugHeader (or jaeger-debug-id),
+//   - any of its spans failed, e.g. a 5xx response or a panic,
+//   - it took at least TailLatency,
+//   - or, as for any other trace, with probability TailRate.
+//
+// Traces with no server span, or that outgrow the buffer, are decided on
+// what was buffered once they're TailMaxWait old, checked every tenth of
+// TailMaxWait, or the buffer holds TailMaxSpans spans.
+//
+// The decision is local. The tracer samples every request with a const
+// sampler, and the sampled flag is what we propagate, so:
+//
+//   - the services we call see every trace we start as sampled, whatever
+//     we end up keeping, and record all of them unless they tail sample
+//     too or ignore the flag;
+//   - traces reaching us with the flag unset stay unsampled, as Jaeger
+//     spans inherit the flag of their parent, so they never get here.
+//
+// Tail sampling belongs at the edge, where traces start.
+
+const (
+	dflTailLatency  = time.Second
+	dflTailRate     = 0.01
+	dflTailMaxSpans = 10000
+	dflTailMaxWait  = 30 * time.Second
+
+	// traces decided recently, for their late spans
+	tailDecided = 10000
+
+	// tail sampling decisions
+	decisionDebug   = "debug"
+	decisionError   = "error"
+	decisionSlow    = "slow"
+	decisionSampled = "sampled"
+	decisionDropped = "dropped"
+)
+
+// tailReporter buffers spans by trace, and reports the traces it keeps
+// to next
+type tailReporter struct {
+	next     jaeger.Reporter
+	latency  time.Duration
+	boundary uint64 // of the trace IDs sampled with probability rate
+	maxSpans int
+	maxWait  time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	traces  map[jaeger.TraceID]*list.Element // of pending
+	pending *list.List                       // of *pendingTrace, oldest first
+	spans   int
+	decided map[jaeger.TraceID]bool // kept or not
+	recent  []jaeger.TraceID        // ring of decided
+
+	stop chan struct{} // closed by Close to stop the ticker
+	wg   sync.WaitGroup
+
+	decisions map[string]metrics.Counter
+	expired   metrics.Counter
+}
+
+// pendingTrace is a trace being buffered
+type pendingTrace struct {
+	id      jaeger.TraceID
+	spans   []*jaeger.Span
+	first   time.Time
+	debug   bool
+	errored bool
+}
+
+// newTailReporter returns a tail sampling reporter sending the traces it
+// keeps to next
+func (o Options) newTailReporter(next jaeger.Reporter, metricsFactory metrics.Factory) *tailReporter {
+	r := &tailReporter{
+		next:      next,
+		latency:   o.TailLatency,
+		maxSpans:  o.TailMaxSpans,
+		maxWait:   o.TailMaxWait,
+		now:       time.Now,
+		traces:    map[jaeger.TraceID]*list.Element{},
+		pending:   list.New(),
+		decided:   map[jaeger.TraceID]bool{},
+		stop:      make(chan struct{}),
+		decisions: map[string]metrics.Counter{},
+		expired:   metricsFactory.Counter("tail_sampling_expired_traces", nil),
+	}
+	if r.latency <= 0 {
+		r.latency = dflTailLatency
+	}
+	rate := o.TailRate
+	if rate <= 0 {
+		rate = dflTailRate
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	// as Jaeger's probabilistic sampler does, on the low 63 bits
+	r.boundary = uint64(rate * float64(uint64(1)<<63))
+	if r.maxSpans <= 0 {
+		r.maxSpans = dflTailMaxSpans
+	}
+	if r.maxWait <= 0 {
+		r.maxWait = dflTailMaxWait
+	}
+	for _, d := range []string{decisionDebug, decisionError, decisionSlow, decisionSampled, decisionDropped} {
+		r.decisions[d] = metricsFactory.Counter("tail_sampling_traces", map[string]string{"decision": d})
+	}
+	return r
+}
+
+// Report implements jaeger.Reporter
+func (r *tailReporter) Report(span *jaeger.Span) {
+	sc := span.Context().(jaeger.SpanContext)
+	js := jaeger.BuildJaegerThrift(span)
+
+	var keep []*jaeger.Span
+	defer func() {
+		for _, s := range keep {
+			r.next.Report(s)
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// late spans follow their trace
+	if kept, ok := r.decided[sc.TraceID()]; ok {
+		if kept {
+			keep = append(keep, span)
+		}
+		return
+	}
+
+	e, ok := r.traces[sc.TraceID()]
+	if !ok {
+		e = r.pending.PushBack(&pendingTrace{id: sc.TraceID(), first: r.now()})
+		r.traces[sc.TraceID()] = e
+	}
+	t := e.Value.(*pendingTrace)
+	t.spans = append(t.spans, span)
+	t.debug = t.debug || sc.IsDebug()
+	t.errored = t.errored || failed(js)
+	r.spans++
+
+	// the request is over
+	if sc.ParentID() == 0 || tagString(js, "span.kind") == "server" {
+		keep = append(keep, r.decide(e, time.Duration(js.Duration)*time.Microsecond)...)
+	}
+
+	keep = append(keep, r.expire()...)
+}
+
+// expire decides on the oldest traces while the buffer is full or they
+// have waited long enough, and returns the spans of those kept. The
+// caller holds r.mu.
+func (r *tailReporter) expire() []*jaeger.Span {
+	var keep []*jaeger.Span
+	for e := r.pending.Front(); e != nil; e = r.pending.Front() {
+		if r.spans <= r.maxSpans && r.now().Sub(e.Value.(*pendingTrace).first) < r.maxWait {
+			break
+		}
+		r.expired.Inc(1)
+		keep = append(keep, r.decide(e, 0)...)
+	}
+	return keep
+}
+
+// start expires pending traces every tenth of maxWait, so traces whose
+// spans stop coming are reported without waiting for another span, until
+// Close
+func (r *tailReporter) start() {
+	tick := r.maxWait / 10
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.mu.Lock()
+				keep := r.expire()
+				r.mu.Unlock()
+				for _, s := range keep {
+					r.next.Report(s)
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// decide decides on the trace in e, which took d, and returns its spans
+// if it's kept
+func (r *tailReporter) decide(e *list.Element, d time.Duration) []*jaeger.Span {
+	t := r.pending.Remove(e).(*pendingTrace)
+	delete(r.traces, t.id)
+	r.spans -= len(t.spans)
+
+	var decision string
+	switch {
+	case t.debug:
+		decision = decisionDebug
+	case t.errored:
+		decision = decisionError
+	case d >= r.latency:
+		decision = decisionSlow
+	case t.id.Low&(1<<63-1) < r.boundary:
+		decision = decisionSampled
+	default:
+		decision = decisionDropped
+	}
+	r.decisions[decision].Inc(1)
+
+	kept := decision != decisionDropped
+	if len(r.recent) >= tailDecided {
+		delete(r.decided, r.recent[0])
+		r.recent = r.recent[1:]
+	}
+	r.recent = append(r.recent, t.id)
+	r.decided[t.id] = kept
+
+	if !kept {
+		return nil
+	}
+	return t.spans
+}
+
+// Close implements jaeger.Reporter, stopping the ticker and reporting what
+// is still buffered as if it expired
+func (r *tailReporter) Close() {
+	close(r.stop)
+	r.wg.Wait()
+
+	var keep []*jaeger.Span
+	r.mu.Lock()
+	for e := r.pending.Front(); e != nil; e = r.pending.Front() {
+		keep = append(keep, r.decide(e, 0)...)
+	}
+	r.mu.Unlock()
+
+	for _, s := range keep {
+		r.next.Report(s)
+	}
+	r.next.Close()
+}
+
+// failed tells whether span is tagged as failed or as a 5xx response
+func failed(span *thrift.Span) bool {
+	if tagString(span, "error") == "true" {
+		return true
+	}
+	code, _ := strconv.Atoi(tagString(span, "http.status_code"))
+	return code >= 500
+}
+
+// tagString returns the value of the tag key of span, "" if it has none
+func tagString(span *thrift.Span, key string) string {
+	for _, t := range span.Tags {
+		if t.Key == key {
+			return tagValue(t)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"testing"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/assert"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// tailTracer returns a tracer sampling every request through a tail
+// reporter, the reporter and where the kept spans go
+func tailTracer(opts Options) (opentracing.Tracer, *tailReporter, *jaeger.InMemoryReporter, *metrics.LocalFactory) {
+	kept := jaeger.NewInMemoryReporter()
+	factory := metrics.NewLocalFactory(0)
+	tail := opts.newTailReporter(kept, factory)
+	tracer, _ := jaeger.NewTracer("test", jaeger.NewConstSampler(true), tail)
+	return tracer, tail, kept, factory
+}
+
+func TestTailSampling(t *testing.T) {
+	tracer, _, kept, factory := tailTracer(Options{TailLatency: time.Second, TailRate: 1e-9})
+
+	// test data
+	var tests = []struct {
+		name     string
+		status   uint16
+		took     time.Duration
+		error    bool // in the child span
+		debug    bool
+		decision string
+	}{
+		{"ok", 200, time.Millisecond, false, false, decisionDropped},
+		{"5xx", 503, time.Millisecond, false, false, decisionError},
+		{"failed child", 200, time.Millisecond, true, false, decisionError},
+		{"slow", 200, 2 * time.Second, false, false, decisionSlow},
+		{"debug", 200, time.Millisecond, false, true, decisionDebug},
+	}
+
+	for _, tt := range tests {
+		kept.Reset()
+		start := time.Now().Add(-tt.took)
+		server := tracer.StartSpan("HTTP GET /", ext.SpanKindRPCServer, opentracing.StartTime(start))
+		if tt.debug {
+			ext.SamplingPriority.Set(server, 1)
+		}
+		child := tracer.StartSpan("render template", opentracing.ChildOf(server.Context()))
+		if tt.error {
+			ext.Error.Set(child, true)
+		}
+		child.Finish()
+		ext.HTTPStatusCode.Set(server, tt.status)
+		server.Finish()
+
+		// a span ending after the request follows the decision
+		tracer.StartSpan("cleanup", opentracing.FollowsFrom(server.Context())).Finish()
+
+		if tt.decision == decisionDropped {
+			assert.Equal(t, 0, kept.SpansSubmitted(), tt.name)
+		} else {
+			assert.Equal(t, 3, kept.SpansSubmitted(), tt.name)
+		}
+	}
+
+	counters, _ := factory.Snapshot()
+	for _, d := range []string{decisionDropped, decisionError, decisionSlow, decisionDebug} {
+		want := int64(1)
+		if d == decisionError {
+			want = 2
+		}
+		assert.Equal(t, want, counters["tail_sampling_traces|decision="+d], d)
+	}
+}
+
+func TestTailSamplingRate(t *testing.T) {
+	tracer, _, kept, factory := tailTracer(Options{TailRate: 1})
+	for i := 0; i < 10; i++ {
+		tracer.StartSpan("HTTP GET /", ext.SpanKindRPCServer).Finish()
+	}
+	assert.Equal(t, 10, kept.SpansSubmitted())
+
+	counters, _ := factory.Snapshot()
+	assert.Equal(t, int64(10), counters["tail_sampling_traces|decision="+decisionSampled])
+}
+
+func TestTailSamplingBounds(t *testing.T) {
+	tracer, tail, kept, factory := tailTracer(Options{TailRate: 1, TailMaxSpans: 3, TailMaxWait: time.Minute})
+	now := time.Now()
+	tail.now = func() time.Time { return now }
+
+	// a background job, no server span ever ends its trace
+	job := tracer.StartSpan("job")
+	for i := 0; i < 3; i++ {
+		tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	}
+	assert.Equal(t, 0, kept.SpansSubmitted())
+	assert.Equal(t, 3, tail.spans)
+
+	// the buffer is full
+	tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	assert.Equal(t, 4, kept.SpansSubmitted())
+	assert.Equal(t, 0, tail.spans)
+
+	// or the trace waited too long
+	job = tracer.StartSpan("job")
+	tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	now = now.Add(time.Minute)
+	tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	assert.Equal(t, 6, kept.SpansSubmitted())
+
+	counters, _ := factory.Snapshot()
+	assert.Equal(t, int64(2), counters["tail_sampling_expired_traces"])
+
+	// whatever is left is decided on close
+	job = tracer.StartSpan("job")
+	tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	tail.Close()
+	assert.Equal(t, 7, kept.SpansSubmitted())
+}
+
+func TestTailSamplingTicker(t *testing.T) {
+	rec := NewRecorder()
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		Backend:      BackendMemory,
+		Recorder:     rec,
+		TailSampling: true,
+		TailRate:     1,
+		TailMaxWait:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a background job whose spans stop coming expires on its own
+	job := tracer.StartSpan("job")
+	tracer.StartSpan("step", opentracing.ChildOf(job.Context())).Finish()
+	assert.Eventually(t, func() bool { return len(rec.Traces()) == 1 }, time.Second, time.Millisecond)
+
+	// and closing stops the ticker
+	closer.Close()
+}
+
+func TestTailSamplingOptions(t *testing.T) {
+	typ, param := Options{TailSampling: true, SamplerType: "probabilistic", SamplerParam: 0.1}.sampler()
+	assert.Equal(t, "const", typ)
+	assert.Equal(t, float64(1), param)
+
+	_, _, err := Init("test", metrics.NullFactory, Options{Backend: BackendOTLP, TailSampling: true})
+	assert.Error(t, err)
+
+	// in front of the recorder
+	rec := NewRecorder()
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{
+		Backend:      BackendMemory,
+		Recorder:     rec,
+		TailSampling: true,
+		TailRate:     1e-9,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	tracer.StartSpan("HTTP GET /", ext.SpanKindRPCServer).Finish()
+	span := tracer.StartSpan("HTTP GET /", ext.SpanKindRPCServer)
+	ext.HTTPStatusCode.Set(span, 500)
+	span.Finish()
+	if assert.Len(t, rec.Traces(), 1) {
+		assert.True(t, rec.Traces()[0].Error)
+	}
+}
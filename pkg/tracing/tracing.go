@@ -1,53 +1,156 @@
 package tracing
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"time"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
 	jaeger "github.com/uber/jaeger-client-go"
 	config "github.com/uber/jaeger-client-go/config"
 	"github.com/uber/jaeger-client-go/rpcmetrics"
 	"github.com/uber/jaeger-lib/metrics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // https://github.com/jaegertracing/jaeger-client-go/blob/master/config/config.go
 
-// Init returns an instance of Jaeger Tracer
-func Init(serviceName string, metricsFactory metrics.Factory) (opentracing.Tracer, io.Closer, error) {
-	// create configuration
-	cfg := &config.Configuration{
-		// Valid values for Param field are:
-		// - for "const" sampler, 0 or 1 for always false/true respectively
-		// - for "probabilistic" sampler, a probability between 0 and 1
-		// - for "rateLimiting" sampler, the number of spans per second
-		// - for "remote" sampler, param is the same as for "probabilistic"
-		//   and indicates the initial sampling rate before the actual one
-		//   is received from the mothership
-		Sampler: &config.SamplerConfig{
-			Type:  "const",
-			Param: 1,
-		},
-		Reporter: &config.ReporterConfig{
-			LogSpans:            false, // log all spans to stdout for debug purposes
-			BufferFlushInterval: 1 * time.Second,
-		},
+// Init returns an instance of Jaeger Tracer. Both the tracer's internal
+// metrics and rpcmetrics go to metricsFactory (see NewMetricsFactory).
+// The sampler, reporter and agent come from opts (see FromEnv), a
+// disabled tracer is a no-op. The memory backend reports the spans to
+// opts.Recorder rather than an agent, and TailSampling puts the tail
+// sampler (see tail.go) in front of either. With the OTLP backend it
+// returns an OpenTelemetry tracer behind the opentracing bridge instead,
+// which has no use for metricsFactory.
+func Init(serviceName string, metricsFactory metrics.Factory, opts ...Options) (opentracing.Tracer, io.Closer, error) {
+	var opt Options
+	if opts != nil {
+		opt = opts[0]
+	}
+	if opt.Disabled {
+		return opentracing.NoopTracer{}, nullCloser{}, nil
+	}
+	switch opt.Backend {
+	case "", BackendJaeger:
+	case BackendMemory:
+		if opt.Recorder == nil {
+			return nil, nil, errors.New("the memory tracing backend needs a Recorder")
+		}
+	case BackendOTLP:
+		if opt.TailSampling {
+			return nil, nil, errors.Errorf("tail sampling is not supported by the %s backend", BackendOTLP)
+		}
+		return initOTLP(serviceName, opt)
+	default:
+		return nil, nil, errors.Errorf("unknown tracing backend %q", opt.Backend)
 	}
 
-	// instantiate tracer
-	tracer, closer, err := cfg.New(
-		serviceName,
-		config.Logger(jaeger.StdLogger),
-		config.Observer(rpcmetrics.NewObserver(metricsFactory, rpcmetrics.DefaultNameNormalizer)),
-	)
+	// Valid values for the sampler param are:
+	// - for "const" sampler, 0 or 1 for always false/true respectively
+	// - for "probabilistic" sampler, a probability between 0 and 1
+	// - for "rateLimiting" sampler, the number of spans per second
+	// - for "remote" sampler, param is the same as for "probabilistic"
+	//   and indicates the initial sampling rate before the actual one
+	//   is received from the mothership
+	samplerType, samplerParam := opt.sampler()
+
+	// create sampler
+	cfg := &config.SamplerConfig{
+		Type:              samplerType,
+		Param:             samplerParam,
+		SamplingServerURL: opt.SamplingServerURL,
+	}
+	tracerMetrics := jaeger.NewMetrics(metricsFactory, nil)
+	sampler, err := cfg.NewSampler(serviceName, tracerMetrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reporter jaeger.Reporter = opt.Recorder
+	if opt.Backend != BackendMemory {
+		reporter, err = opt.newReporter(metricsFactory, jaegerLogger{})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// our client's config has no way to set propagators, so we build the
+	// tracer ourselves
+	propagator, err := opt.jaegerPropagator()
 	if err != nil {
 		return nil, nil, err
-		// panic(fmt.Sprintf("ERROR: cannot init Jaeger: %v\n", err))
 	}
 
+	options := []jaeger.TracerOption{
+		jaeger.TracerOptions.Logger(jaegerLogger{}),
+		jaeger.TracerOptions.Metrics(tracerMetrics),
+		jaeger.TracerOptions.Observer(rpcmetrics.NewObserver(metricsFactory, rpcmetrics.DefaultNameNormalizer)),
+		jaeger.TracerOptions.Injector(opentracing.HTTPHeaders, propagator),
+		jaeger.TracerOptions.Extractor(opentracing.HTTPHeaders, propagator),
+		jaeger.TracerOptions.Injector(opentracing.TextMap, propagator),
+		jaeger.TracerOptions.Extractor(opentracing.TextMap, propagator),
+		// W3C and B3 callers expect 128 bit trace IDs
+		jaeger.TracerOptions.Gen128Bit(propagator.wide()),
+	}
+	for k, v := range opt.Tags {
+		options = append(options, jaeger.TracerOptions.Tag(k, v))
+	}
+
+	// the tail sampler expires pending traces until the tracer is closed
+	if opt.TailSampling {
+		tail := opt.newTailReporter(reporter, metricsFactory)
+		tail.start()
+		reporter = tail
+	}
+
+	// instantiate tracer
+	tracer, closer := jaeger.NewTracer(serviceName, sampler, reporter, options...)
+
 	return tracer, closer, nil
 }
 
+var logger = logging.Named("tracing")
+
+// jaegerLogger is the Jaeger client's logger, logging through ours
+type jaegerLogger struct{}
+
+func (jaegerLogger) Error(msg string) {
+	logger.Error(msg)
+}
+
+func (jaegerLogger) Infof(msg string, args ...interface{}) {
+	logger.Info(fmt.Sprintf(msg, args...))
+}
+
+// nullCloser closes nothing
+type nullCloser struct{}
+
+func (nullCloser) Close() error { return nil }
+
+// TraceID returns the ID of the trace of the span in ctx (e.g. the one
+// started by the nethttp middleware) and whether that trace is sampled,
+// i.e. whether it will actually show up in Jaeger.
+func TraceID(ctx context.Context) (string, bool) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return "", false
+	}
+	if sc, ok := span.Context().(jaeger.SpanContext); ok {
+		if !sc.IsValid() {
+			return "", false
+		}
+		return sc.TraceID().String(), sc.IsSampled()
+	}
+
+	// the bridge puts the OpenTelemetry span in the context alongside
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String(), sc.IsSampled()
+	}
+	return "", false
+}
+
 // Another feature that built into the the client libraries was the ability
 // to poll the tracing backend for the sampling strategy. When a service
 // receives a request that has no tracing metadata, the tracing instrumentation
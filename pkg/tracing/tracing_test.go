@@ -1,21 +1,28 @@
 package tracing
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/dstroot/simple-go-webserver/pkg/info"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
-	"github.com/uber/jaeger-lib/metrics/go-kit"
-	"github.com/uber/jaeger-lib/metrics/go-kit/expvar"
+	"github.com/prometheus/client_golang/prometheus"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-lib/metrics"
 )
 
 func TestInit(t *testing.T) {
 
-	metricsFactory := xkit.Wrap("test", expvar.NewFactory(10))
+	metricsFactory := NewMetricsFactory(MetricsOptions{
+		Registerer: prometheus.NewRegistry(),
+		Expvar:     true,
+	})
 	tracer, closer, err := Init(
 		"test",
 		metricsFactory.Namespace(info.Report.Program, nil),
+		Options{SamplerType: "const", SamplerParam: 1},
 	)
 	if err != nil {
 		t.Error("Could not initialize tracer")
@@ -42,3 +49,28 @@ func TestInit(t *testing.T) {
 	span.Finish()
 	closer.Close()
 }
+
+func TestTraceID(t *testing.T) {
+
+	// no span
+	if _, ok := TraceID(context.Background()); ok {
+		t.Error("expected no trace ID without a span")
+	}
+
+	tracer, closer, err := Init("test", metrics.NullFactory, Options{SamplerType: "const", SamplerParam: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	span := tracer.StartSpan("test")
+	defer span.Finish()
+
+	id, ok := TraceID(opentracing.ContextWithSpan(context.Background(), span))
+	if !ok {
+		t.Error("expected a sampled trace")
+	}
+	if expected := span.Context().(jaeger.SpanContext).TraceID().String(); id != expected {
+		t.Errorf("wrong trace ID: got %v want %v", id, expected)
+	}
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime/debug"
-	"strings"
 	"syscall"
 	"time"
 
+	"github.com/dstroot/simple-go-webserver/pkg/logging"
 	// https://dave.cheney.net/2016/04/27/dont-just-check-errors-handle-them-gracefully
 	"github.com/pkg/errors"
 )
@@ -24,25 +23,16 @@ const (
 
 // Server implements our HTTP server
 type Server struct {
-	server *http.Server
+	server   *http.Server
+	signals  map[os.Signal]func()
+	shutdown []func()
+	timeout  time.Duration // of the graceful shutdown
 }
 
-// debugging multiple response.WriteHeader calls
-type debugLogger struct{}
-
-func (d debugLogger) Write(p []byte) (n int, err error) {
-	s := string(p)
-	if strings.Contains(s, "multiple response.WriteHeader") {
-		debug.PrintStack()
-	}
-	return os.Stderr.Write(p)
-}
+var logger = logging.Named("server")
 
 // NewServer creates a new HTTP Server
 func NewServer(hostPort string, h http.Handler) *Server {
-	// Now use the logger with your http.Server:
-	logger := log.New(debugLogger{}, "", 0)
-
 	return &Server{
 		server: &http.Server{
 			Addr:           ":" + hostPort,
@@ -51,11 +41,33 @@ func NewServer(hostPort string, h http.Handler) *Server {
 			WriteTimeout:   10 * time.Second,
 			IdleTimeout:    120 * time.Second, // Go ver >1.8
 			MaxHeaderBytes: 1 << 20,
-			ErrorLog:       logger,
+			ErrorLog:       logging.StdLogger("http", slog.LevelError),
 		},
+		signals: make(map[os.Signal]func()),
+		timeout: timeout,
 	}
 }
 
+// SetErrorLog sets the logger of the errors the HTTP server runs into
+// outside of our handlers, e.g. a logging.NewErrorLog classifying them
+func (s *Server) SetErrorLog(l *log.Logger) {
+	s.server.ErrorLog = l
+}
+
+// OnSignal registers fn to be run whenever the process receives sig while
+// the server is running (e.g. SIGUSR1 to toggle maintenance mode). SIGINT
+// and SIGTERM are reserved for the graceful shutdown.
+func (s *Server) OnSignal(sig os.Signal, fn func()) {
+	s.signals[sig] = fn
+}
+
+// OnShutdown registers fn to be run after the HTTP server has stopped,
+// gracefully or not, e.g. to stop other listeners or flush metrics.
+// Functions run in the order they were registered.
+func (s *Server) OnShutdown(fn func()) {
+	s.shutdown = append(s.shutdown, fn)
+}
+
 // Run starts the HTTP server and performs a graceful shutdown
 func (s *Server) Run() error {
 
@@ -70,8 +82,7 @@ func (s *Server) Run() error {
 
 	// Run server
 	go func() {
-		log.Printf("%s - Web server available on port %v", hostname, s.server.Addr)
-		log.Printf("%s - Press Ctrl+C to stop", hostname)
+		logger.Info("web server available, press Ctrl+C to stop", "host", hostname, "addr", s.server.Addr)
 		listenErr <- s.server.ListenAndServe()
 	}()
 
@@ -79,6 +90,13 @@ func (s *Server) Run() error {
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, syscall.SIGINT, syscall.SIGTERM)
 
+	// user defined signal handling
+	userSignals := make(chan os.Signal, 1)
+	for sig := range s.signals {
+		signal.Notify(userSignals, sig)
+	}
+	defer signal.Stop(userSignals)
+
 	// Handle channels/graceful shutdown
 	for {
 		select {
@@ -86,29 +104,46 @@ func (s *Server) Run() error {
 		// in use" it will return an error.
 		case err := <-listenErr:
 			return err
+		// run the handler registered for this signal
+		case sig := <-userSignals:
+			logger.Info("signal received", "host", hostname, "signal", sig.String())
+			s.signals[sig]()
 		// handle termination signal
 		case <-osSignals:
-			fmt.Printf("\n")
-			log.Printf("%s - Shutdown signal received.\n", hostname)
-
-			// Servers in the process of shutting down should disable KeepAlives.
-			s.server.SetKeepAlivesEnabled(false)
-
-			// Attempt the graceful shutdown by closing the listener
-			// and completing all inflight requests.
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
-			if err := s.server.Shutdown(ctx); err != nil {
+			logger.Info("shutdown signal received", "host", hostname)
+			if err := s.stop(listenErr); err != nil {
 				return err
 			}
-
-			// return any errors from this channel other than "ServerClosed"
-			if err := <-listenErr; err != http.ErrServerClosed {
-				return err
-			}
-
-			log.Printf("%s - Server gracefully stopped.\n", hostname)
+			logger.Info("server gracefully stopped", "host", hostname)
 			return nil
 		}
 	}
 }
+
+// stop shuts the server down gracefully, then runs the OnShutdown
+// functions, even if the in-flight requests did not complete in time
+func (s *Server) stop(listenErr <-chan error) error {
+	// shutdown anything else we are running, last
+	defer func() {
+		for _, fn := range s.shutdown {
+			fn()
+		}
+	}()
+
+	// Servers in the process of shutting down should disable KeepAlives.
+	s.server.SetKeepAlivesEnabled(false)
+
+	// Attempt the graceful shutdown by closing the listener
+	// and completing all inflight requests.
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	// return any errors from this channel other than "ServerClosed"
+	if err := <-listenErr; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
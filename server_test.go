@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // define a handler
@@ -24,6 +29,21 @@ func TestNewServer(t *testing.T) {
 			r.String(), result)
 	}
 
+	// register a signal handler
+	called := false
+	s.OnSignal(syscall.SIGUSR1, func() { called = true })
+	s.signals[syscall.SIGUSR1]()
+	if !called {
+		t.Errorf("signal handler was not registered")
+	}
+
+	// replace the error log
+	l := log.New(ioutil.Discard, "", 0)
+	s.SetErrorLog(l)
+	if s.server.ErrorLog != l {
+		t.Errorf("error log was not set")
+	}
+
 	// go func() {
 	// 	s.Run()
 	// }()
@@ -40,3 +60,36 @@ func TestNewServer(t *testing.T) {
 	// 	t.Errorf("err")
 	// }
 }
+
+func TestStopTimeout(t *testing.T) {
+
+	// a request still in flight when the shutdown times out
+	inflight, release := make(chan struct{}), make(chan struct{})
+	s := NewServer("0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inflight)
+		<-release
+	}))
+	defer close(release)
+	s.timeout = 10 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- s.server.Serve(ln)
+	}()
+	go http.Get("http://" + ln.Addr().String())
+	<-inflight
+
+	// the shutdown functions run anyway
+	stopped := false
+	s.OnShutdown(func() { stopped = true })
+	if err := s.stop(listenErr); err == nil {
+		t.Errorf("shutdown did not time out")
+	}
+	if !stopped {
+		t.Errorf("shutdown functions did not run")
+	}
+}